@@ -0,0 +1,153 @@
+package analytics
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/YangchenYe323/boxtroll/internal/store"
+)
+
+// Above this many multiply-adds, the exact distribution of a draw is too costly to compute on the
+// fly and the normal approximation is used instead. The cost grows quadratically with the number
+// of boxes, so in practice a few dozen boxes are computed exactly.
+const exactLuckMaxOps = 2_000_000
+
+// A number of boxes of the same kind
+type Draw struct {
+	Model *BoxModel
+	Num   int64
+}
+
+// How a drawn value ranks among everyone drawing the same boxes.
+type Luck struct {
+	Unluckier float64 // Chance to draw less, i.e., fraction of people this draw is luckier than
+	Luckier   float64 // Chance to draw more
+	Exact     bool    // Computed from the exact distribution rather than the normal approximation
+}
+
+// e.g., 比92%的人倒霉
+func (l Luck) String() string {
+	if l.Luckier > l.Unluckier {
+		return fmt.Sprintf("比%d%%的人倒霉", int(l.Luckier*100))
+	}
+	return fmt.Sprintf("比%d%%的人幸运", int(l.Unluckier*100))
+}
+
+// Rank the total value of the given draws. Returns false if nothing is drawn.
+func LuckOf(draws []Draw, value int64) (Luck, bool) {
+	var num int64
+	for _, draw := range draws {
+		num += draw.Num
+	}
+	if num == 0 {
+		return Luck{}, false
+	}
+
+	if luck, ok := exactLuck(draws, value); ok {
+		return luck, true
+	}
+	return normalLuck(draws, value), true
+}
+
+// Rank the statistics of a single kind of box. The boxes may have been drawn at different
+// prices, so the value is scaled to the current price of the box.
+func LuckOfStatistics(model *BoxModel, st store.BoxStatistics) (Luck, bool) {
+	if st.TotalNum == 0 || st.TotalOriginalPrice == 0 {
+		return Luck{}, false
+	}
+
+	value := st.TotalPrice
+	if currentPrice := st.TotalNum * model.Price; currentPrice != st.TotalOriginalPrice {
+		value = int64(math.Round(float64(st.TotalPrice) * float64(currentPrice) / float64(st.TotalOriginalPrice)))
+	}
+
+	return LuckOf([]Draw{{Model: model, Num: st.TotalNum}}, value)
+}
+
+// Convolve the outcome distributions in units of the greatest common divisor of the prices.
+// Returns false if that is too costly.
+func exactLuck(draws []Draw, value int64) (Luck, bool) {
+	var unit, size, ops int64
+	for _, draw := range draws {
+		for _, outcome := range draw.Model.Outcomes {
+			unit = gcd(unit, outcome.Price)
+		}
+	}
+	if unit <= 0 {
+		return Luck{}, false
+	}
+
+	// Largest outcome of each draw in units
+	maxUnits := make([]int64, len(draws))
+	for i, draw := range draws {
+		for _, outcome := range draw.Model.Outcomes {
+			maxUnits[i] = max(maxUnits[i], outcome.Price/unit)
+		}
+		for range draw.Num {
+			size += maxUnits[i]
+			ops += size * int64(len(draw.Model.Outcomes))
+			if ops > exactLuckMaxOps {
+				return Luck{}, false
+			}
+		}
+	}
+
+	// dist[i] is the chance of drawing i units in total
+	dist := []float64{1}
+	for k, draw := range draws {
+		for range draw.Num {
+			next := make([]float64, int64(len(dist))+maxUnits[k])
+			for i, p := range dist {
+				if p == 0 {
+					continue
+				}
+				for j, outcome := range draw.Model.Outcomes {
+					next[int64(i)+outcome.Price/unit] += p * draw.Model.Chances[j]
+				}
+			}
+			dist = next
+		}
+	}
+
+	luck := Luck{Exact: true}
+	for i, p := range dist {
+		switch v := int64(i) * unit; {
+		case v < value:
+			luck.Unluckier += p
+		case v > value:
+			luck.Luckier += p
+		}
+	}
+
+	return luck, true
+}
+
+// Central limit theorem on the sum of all boxes
+func normalLuck(draws []Draw, value int64) Luck {
+	var mean, variance float64
+	for _, draw := range draws {
+		mean += float64(draw.Num) * draw.Model.Mean
+		variance += float64(draw.Num) * draw.Model.StdDev * draw.Model.StdDev
+	}
+
+	if variance == 0 {
+		switch {
+		case float64(value) > mean:
+			return Luck{Unluckier: 1}
+		case float64(value) < mean:
+			return Luck{Luckier: 1}
+		default:
+			return Luck{}
+		}
+	}
+
+	cdf := 0.5 * math.Erfc(-(float64(value)-mean)/math.Sqrt(2*variance))
+	return Luck{Unluckier: cdf, Luckier: 1 - cdf}
+}
+
+func gcd(a, b int64) int64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
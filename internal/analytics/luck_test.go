@@ -0,0 +1,67 @@
+package analytics_test
+
+import (
+	"math"
+	"testing"
+
+	"github.com/YangchenYe323/boxtroll/internal/analytics"
+	"github.com/YangchenYe323/boxtroll/internal/store"
+)
+
+func TestLuck(t *testing.T) {
+	model, err := analytics.NewBoxModel(testBox)
+	if err != nil {
+		t.Fatalf("failed to build box model: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		num       int64
+		value     int64
+		unluckier float64
+		luckier   float64
+		exact     bool
+		text      string
+	}{
+		{"single small outcome", 1, 500, 0, 0.1, true, "比10%的人倒霉"},
+		{"one of two boxes big", 2, 5500, 0.81, 0.01, true, "比81%的人幸运"},
+		{"both boxes big", 2, 10000, 0.99, 0, true, "比99%的人幸运"},
+		{"many boxes at the mean", 10000, 9500000, 0.5, 0.5, false, "比50%的人幸运"},
+	}
+
+	for _, test := range tests {
+		luck, ok := analytics.LuckOf([]analytics.Draw{{Model: model, Num: test.num}}, test.value)
+		if !ok {
+			t.Fatalf("%s: expected luck, got none", test.name)
+		}
+		if math.Abs(luck.Unluckier-test.unluckier) > 1e-9 || math.Abs(luck.Luckier-test.luckier) > 1e-9 {
+			t.Fatalf("%s: expected unluckier %v and luckier %v, got %+v", test.name, test.unluckier, test.luckier, luck)
+		}
+		if luck.Exact != test.exact {
+			t.Fatalf("%s: expected exact %v, got %v", test.name, test.exact, luck.Exact)
+		}
+		if luck.String() != test.text {
+			t.Fatalf("%s: expected %s, got %s", test.name, test.text, luck.String())
+		}
+	}
+
+	// The normal approximation is close to the exact distribution for a moderate number of boxes
+	exact, _ := analytics.LuckOf([]analytics.Draw{{Model: model, Num: 40}}, 30000)
+	normal, _ := analytics.LuckOf([]analytics.Draw{{Model: model, Num: 100000}}, 30000*2500)
+	if !exact.Exact || normal.Exact {
+		t.Fatalf("expected exact distribution for 40 boxes and approximation for 100000 boxes")
+	}
+	if exact.Unluckier < 0.2 || exact.Unluckier > 0.5 {
+		t.Fatalf("expected 40 boxes worth 300 电池 to be somewhat unlucky, got %+v", exact)
+	}
+
+	if _, ok := analytics.LuckOf(nil, 0); ok {
+		t.Fatalf("expected no luck without draws")
+	}
+
+	// Boxes drawn at a different price are scaled to the current one
+	luck, ok := analytics.LuckOfStatistics(model, store.BoxStatistics{TotalNum: 1, TotalOriginalPrice: 2000, TotalPrice: 1000})
+	if !ok || luck.Luckier != 0.1 {
+		t.Fatalf("expected a half-price return to rank as the small outcome, got %+v", luck)
+	}
+}
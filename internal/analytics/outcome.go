@@ -0,0 +1,123 @@
+package analytics
+
+import (
+	"math"
+	"slices"
+
+	"github.com/YangchenYe323/boxtroll/internal/store"
+	"github.com/rs/zerolog/log"
+)
+
+// The normal approximation of a binomial count needs this many expected draws and misses
+const MIN_EXPECTED_COUNT = 5
+
+// How often a blind box yielded an outcome compared to its advertised chance.
+type OutcomeReport struct {
+	BoxID            int64   `json:"box_id"`
+	BoxName          string  `json:"box_name"`
+	GiftID           int64   `json:"gift_id"`
+	Name             string  `json:"name"`
+	Price            int64   `json:"price"`
+	AdvertisedChance string  `json:"advertised_chance"` // As advertised, e.g., "0.1%", empty if unlisted
+	Chance           float64 `json:"chance"`            // Normalized advertised chance
+	Num              int64   `json:"num"`               // Times drawn
+	TotalNum         int64   `json:"total_num"`         // Boxes counted
+	ObservedChance   float64 `json:"observed_chance"`
+	Z                float64 `json:"z"` // Deviation of Num in standard deviations
+	Verdict          Verdict `json:"verdict"`
+}
+
+// Compare the outcome counts of a room, e.g., of a single user, with the advertised chances of
+// each blind box. Every advertised outcome of a box drawn at least once is reported, along with
+// outcomes drawn but not advertised. Boxes unknown to the room metadata are skipped.
+func AnalyzeOutcomes(room *store.Room, counts []*store.OutcomeCount) []*OutcomeReport {
+	// boxID -> outcome gift ID -> number
+	drawn := make(map[int64]map[int64]int64)
+	for _, count := range counts {
+		if _, ok := drawn[count.BoxID]; !ok {
+			drawn[count.BoxID] = make(map[int64]int64)
+		}
+		drawn[count.BoxID][count.GiftID] += count.Num
+	}
+
+	var reports []*OutcomeReport
+	for _, gift := range room.Gifts {
+		outcomes, ok := drawn[gift.GiftID]
+		if !ok || len(gift.BlindBoxOutcomes) == 0 {
+			continue
+		}
+
+		model, err := NewBoxModel(gift)
+		if err != nil {
+			log.Warn().Err(err).Int64("room", room.RoomID).Int64("box", gift.GiftID).Msg("无法解析盲盒爆率")
+			continue
+		}
+
+		var total int64
+		for _, num := range outcomes {
+			total += num
+		}
+
+		listed := make(map[int64]bool)
+		for i, outcome := range model.Outcomes {
+			listed[outcome.GiftID] = true
+			report := analyzeOutcome(total, outcomes[outcome.GiftID], model.Chances[i])
+			report.GiftID = outcome.GiftID
+			report.Name = outcome.Name
+			report.Price = outcome.Price
+			report.AdvertisedChance = outcome.Chance
+			report.BoxID = gift.GiftID
+			report.BoxName = gift.Name
+			reports = append(reports, report)
+		}
+
+		var unlisted []int64
+		for giftID := range outcomes {
+			if !listed[giftID] {
+				unlisted = append(unlisted, giftID)
+			}
+		}
+		slices.Sort(unlisted)
+		for _, giftID := range unlisted {
+			report := analyzeOutcome(total, outcomes[giftID], 0)
+			report.GiftID = giftID
+			report.BoxID = gift.GiftID
+			report.BoxName = gift.Name
+			report.Verdict = VerdictUnlisted
+			reports = append(reports, report)
+		}
+	}
+
+	return reports
+}
+
+// Binomial test of num draws out of total with the given chance
+func analyzeOutcome(total int64, num int64, chance float64) *OutcomeReport {
+	report := &OutcomeReport{
+		Chance:   chance,
+		Num:      num,
+		TotalNum: total,
+		Verdict:  VerdictInsufficient,
+	}
+	if total == 0 {
+		return report
+	}
+	report.ObservedChance = float64(num) / float64(total)
+
+	expected := float64(total) * chance
+	if stdDev := math.Sqrt(expected * (1 - chance)); stdDev > 0 {
+		report.Z = (float64(num) - expected) / stdDev
+	}
+
+	switch {
+	case expected < MIN_EXPECTED_COUNT || float64(total)-expected < MIN_EXPECTED_COUNT:
+	case report.Z >= SIGNIFICANCE_Z:
+		report.Verdict = VerdictAbove
+	case report.Z <= -SIGNIFICANCE_Z:
+		report.Verdict = VerdictBelow
+	default:
+		report.Verdict = VerdictNormal
+	}
+
+	return report
+}
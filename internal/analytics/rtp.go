@@ -0,0 +1,230 @@
+// This package computes the return-to-player (RTP) of blind boxes from the advertised outcome
+// chances, and checks what a room has actually drawn against it.
+
+package analytics
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/YangchenYe323/boxtroll/internal/store"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// |z| at or above which a deviation from the expected value is significant (two-sided 95%)
+	SIGNIFICANCE_Z = 1.96
+	// Below this many boxes the normal approximation is unreliable and no verdict is given
+	MIN_SAMPLE_SIZE = 30
+)
+
+// Parse the chance of a blind box outcome, e.g., "0.1%" or "0.001".
+func ParseChance(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	percent := strings.HasSuffix(s, "%") || strings.HasSuffix(s, "％")
+	s = strings.TrimSpace(strings.TrimSuffix(strings.TrimSuffix(s, "%"), "％"))
+
+	chance, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid chance %q: %w", s, err)
+	}
+	if percent {
+		chance /= 100
+	}
+	if chance < 0 || chance > 1 || math.IsNaN(chance) {
+		return 0, fmt.Errorf("chance %q out of range", s)
+	}
+
+	return chance, nil
+}
+
+// Distribution of the value of a single blind box, derived from the advertised outcomes.
+type BoxModel struct {
+	BoxID     int64
+	Name      string
+	Price     int64   // Price of the box
+	Mean      float64 // Expected value of a single box
+	StdDev    float64 // Standard deviation of the value of a single box
+	ChanceSum float64 // Sum of the advertised chances, which are rounded and may not add up to 1
+	// Advertised outcomes and their normalized chances, in the same order
+	Outcomes []store.BlindBoxOutcome
+	Chances  []float64
+}
+
+// Build the model of a blind box. The advertised chances are normalized to sum up to 1.
+func NewBoxModel(gift *store.Gift) (*BoxModel, error) {
+	if len(gift.BlindBoxOutcomes) == 0 {
+		return nil, fmt.Errorf("%s is not a blind box", gift.Name)
+	}
+	if gift.Price <= 0 {
+		return nil, fmt.Errorf("%s has no price", gift.Name)
+	}
+
+	chances := make([]float64, len(gift.BlindBoxOutcomes))
+	var sum float64
+	for i, outcome := range gift.BlindBoxOutcomes {
+		chance, err := ParseChance(outcome.Chance)
+		if err != nil {
+			return nil, fmt.Errorf("%s -> %s: %w", gift.Name, outcome.Name, err)
+		}
+		chances[i] = chance
+		sum += chance
+	}
+	if sum == 0 {
+		return nil, fmt.Errorf("%s has no chance", gift.Name)
+	}
+
+	var mean, square float64
+	for i, outcome := range gift.BlindBoxOutcomes {
+		chances[i] /= sum
+		mean += chances[i] * float64(outcome.Price)
+		square += chances[i] * float64(outcome.Price) * float64(outcome.Price)
+	}
+
+	return &BoxModel{
+		BoxID:     gift.GiftID,
+		Name:      gift.Name,
+		Price:     gift.Price,
+		Mean:      mean,
+		StdDev:    math.Sqrt(max(square-mean*mean, 0)),
+		ChanceSum: sum,
+		Outcomes:  gift.BlindBoxOutcomes,
+		Chances:   chances,
+	}, nil
+}
+
+// Expected return-to-player, i.e., expected value over price
+func (m *BoxModel) RTP() float64 {
+	return m.Mean / float64(m.Price)
+}
+
+type Verdict string
+
+const (
+	// Too few boxes to tell
+	VerdictInsufficient Verdict = "insufficient"
+	// Within the expected fluctuation
+	VerdictNormal Verdict = "normal"
+	// Significantly above the expected value
+	VerdictAbove Verdict = "above"
+	// Significantly below the expected value
+	VerdictBelow Verdict = "below"
+	// Drawn but not among the advertised outcomes
+	VerdictUnlisted Verdict = "unlisted"
+)
+
+func (v Verdict) Label() string {
+	switch v {
+	case VerdictNormal:
+		return "正常"
+	case VerdictAbove:
+		return "偏高"
+	case VerdictBelow:
+		return "偏低"
+	case VerdictUnlisted:
+		return "未公布"
+	default:
+		return "样本不足"
+	}
+}
+
+// Observed return of a blind box compared to its model.
+type BoxReport struct {
+	Model              *BoxModel `json:"-"`
+	BoxID              int64     `json:"box_id"`
+	Name               string    `json:"name"`
+	Price              int64     `json:"price"`
+	TotalNum           int64     `json:"total_num"`
+	TotalOriginalPrice int64     `json:"total_original_price"`
+	TotalPrice         int64     `json:"total_price"`
+	ExpectedPrice      float64   `json:"expected_price"` // Expected TotalPrice of the boxes drawn
+	ExpectedRTP        float64   `json:"expected_rtp"`
+	ObservedRTP        float64   `json:"observed_rtp"`
+	Z                  float64   `json:"z"` // Deviation of TotalPrice in standard deviations
+	Verdict            Verdict   `json:"verdict"`
+}
+
+// Compare the boxes drawn with the model. The statistics may span price changes of the box,
+// so the expectation is scaled by the original price actually paid.
+func Analyze(model *BoxModel, st store.BoxStatistics) *BoxReport {
+	report := &BoxReport{
+		Model:              model,
+		BoxID:              model.BoxID,
+		Name:               model.Name,
+		Price:              model.Price,
+		TotalNum:           st.TotalNum,
+		TotalOriginalPrice: st.TotalOriginalPrice,
+		TotalPrice:         st.TotalPrice,
+		ExpectedRTP:        model.RTP(),
+		Verdict:            VerdictInsufficient,
+	}
+	if st.TotalNum == 0 || st.TotalOriginalPrice == 0 {
+		return report
+	}
+
+	report.ExpectedPrice = model.RTP() * float64(st.TotalOriginalPrice)
+	report.ObservedRTP = float64(st.TotalPrice) / float64(st.TotalOriginalPrice)
+
+	// Central limit theorem on the sum of TotalNum independent boxes
+	scale := float64(st.TotalOriginalPrice) / (float64(st.TotalNum) * float64(model.Price))
+	stdDev := model.StdDev * scale * math.Sqrt(float64(st.TotalNum))
+	if stdDev > 0 {
+		report.Z = (float64(st.TotalPrice) - report.ExpectedPrice) / stdDev
+	}
+
+	switch {
+	case st.TotalNum < MIN_SAMPLE_SIZE:
+	case report.Z >= SIGNIFICANCE_Z:
+		report.Verdict = VerdictAbove
+	case report.Z <= -SIGNIFICANCE_Z:
+		report.Verdict = VerdictBelow
+	default:
+		report.Verdict = VerdictNormal
+	}
+
+	return report
+}
+
+// Analyze every blind box of a room. boxStatistics holds the statistics of each box summed
+// over all users. Boxes unknown to the room metadata or with malformed chances are skipped.
+func AnalyzeRoom(room *store.Room, boxStatistics map[int64]store.BoxStatistics) []*BoxReport {
+	var reports []*BoxReport
+	for _, gift := range room.Gifts {
+		if len(gift.BlindBoxOutcomes) == 0 {
+			continue
+		}
+
+		model, err := NewBoxModel(gift)
+		if err != nil {
+			log.Warn().Err(err).Int64("room", room.RoomID).Int64("box", gift.GiftID).Msg("无法计算盲盒理论返还率")
+			continue
+		}
+		reports = append(reports, Analyze(model, boxStatistics[gift.GiftID]))
+	}
+
+	return reports
+}
+
+// Sum the statistics of each blind box of a room over all users.
+func RoomBoxStatistics(ctx context.Context, s store.Store, roomID int64) (map[int64]store.BoxStatistics, error) {
+	boxStatistics, err := s.ListAllBoxStatistics(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	sums := make(map[int64]store.BoxStatistics)
+	for key, st := range boxStatistics {
+		_, _, boxID, err := s.ParseBoxStatisticsKey([]byte(key))
+		if err != nil {
+			return nil, err
+		}
+		sum := sums[boxID]
+		sum.Merge(*st)
+		sums[boxID] = sum
+	}
+
+	return sums, nil
+}
@@ -0,0 +1,176 @@
+package analytics_test
+
+import (
+	"math"
+	"testing"
+
+	"github.com/YangchenYe323/boxtroll/internal/analytics"
+	"github.com/YangchenYe323/boxtroll/internal/store"
+)
+
+// A box costing 10 电池 that returns 5 电池 with 90% chance and 50 电池 with 10% chance,
+// i.e., an expected value of 9.5 电池 and a standard deviation of 13.5 电池
+var testBox = &store.Gift{
+	GiftID: 32251,
+	Name:   "心动盲盒",
+	Price:  1000,
+	BlindBoxOutcomes: []store.BlindBoxOutcome{
+		{GiftID: 1, Name: "小花花", Price: 500, Chance: "90%"},
+		{GiftID: 2, Name: "告白气球", Price: 5000, Chance: "10%"},
+	},
+}
+
+func TestParseChance(t *testing.T) {
+	tests := []struct {
+		chance   string
+		expected float64
+	}{
+		{"0.1%", 0.001},
+		{" 12.5% ", 0.125},
+		{"50％", 0.5},
+		{"0.25", 0.25},
+		{"100%", 1},
+	}
+	for _, test := range tests {
+		actual, err := analytics.ParseChance(test.chance)
+		if err != nil {
+			t.Fatalf("failed to parse chance %q: %v", test.chance, err)
+		}
+		if math.Abs(actual-test.expected) > 1e-12 {
+			t.Fatalf("expected chance %v for %q, got %v", test.expected, test.chance, actual)
+		}
+	}
+
+	for _, chance := range []string{"", "abc", "-1%", "120%", "1.5"} {
+		if _, err := analytics.ParseChance(chance); err == nil {
+			t.Fatalf("expected error for chance %q, got nil", chance)
+		}
+	}
+}
+
+func TestBoxModel(t *testing.T) {
+	model, err := analytics.NewBoxModel(testBox)
+	if err != nil {
+		t.Fatalf("failed to build box model: %v", err)
+	}
+	if math.Abs(model.Mean-950) > 1e-9 {
+		t.Fatalf("expected mean 950, got %v", model.Mean)
+	}
+	if math.Abs(model.StdDev-1350) > 1e-9 {
+		t.Fatalf("expected standard deviation 1350, got %v", model.StdDev)
+	}
+	if math.Abs(model.RTP()-0.95) > 1e-12 {
+		t.Fatalf("expected RTP 0.95, got %v", model.RTP())
+	}
+
+	// Rounded chances are normalized
+	rounded := *testBox
+	rounded.BlindBoxOutcomes = []store.BlindBoxOutcome{
+		{GiftID: 1, Name: "小花花", Price: 500, Chance: "45%"},
+		{GiftID: 2, Name: "告白气球", Price: 5000, Chance: "5%"},
+	}
+	model, err = analytics.NewBoxModel(&rounded)
+	if err != nil {
+		t.Fatalf("failed to build box model: %v", err)
+	}
+	if math.Abs(model.Mean-950) > 1e-9 || math.Abs(model.ChanceSum-0.5) > 1e-12 {
+		t.Fatalf("expected normalized mean 950 with chance sum 0.5, got %v with %v", model.Mean, model.ChanceSum)
+	}
+
+	if _, err := analytics.NewBoxModel(&store.Gift{Name: "小花花", Price: 100}); err == nil {
+		t.Fatalf("expected error for a gift that is not a blind box, got nil")
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	model, err := analytics.NewBoxModel(testBox)
+	if err != nil {
+		t.Fatalf("failed to build box model: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		st        store.BoxStatistics
+		expectedZ float64
+		verdict   analytics.Verdict
+	}{
+		{
+			name:      "too few boxes",
+			st:        store.BoxStatistics{TotalNum: 10, TotalOriginalPrice: 10000, TotalPrice: 50000},
+			expectedZ: (50000 - 9500) / (1350 * math.Sqrt(10)),
+			verdict:   analytics.VerdictInsufficient,
+		},
+		{
+			name:      "as expected",
+			st:        store.BoxStatistics{TotalNum: 100, TotalOriginalPrice: 100000, TotalPrice: 95000},
+			expectedZ: 0,
+			verdict:   analytics.VerdictNormal,
+		},
+		{
+			name:      "unlucky room",
+			st:        store.BoxStatistics{TotalNum: 100, TotalOriginalPrice: 100000, TotalPrice: 50000},
+			expectedZ: (50000 - 95000) / 13500.0,
+			verdict:   analytics.VerdictBelow,
+		},
+		{
+			name:      "lucky room",
+			st:        store.BoxStatistics{TotalNum: 100, TotalOriginalPrice: 100000, TotalPrice: 140000},
+			expectedZ: (140000 - 95000) / 13500.0,
+			verdict:   analytics.VerdictAbove,
+		},
+	}
+
+	for _, test := range tests {
+		report := analytics.Analyze(model, test.st)
+		if math.Abs(report.Z-test.expectedZ) > 1e-9 {
+			t.Fatalf("%s: expected z %v, got %v", test.name, test.expectedZ, report.Z)
+		}
+		if report.Verdict != test.verdict {
+			t.Fatalf("%s: expected verdict %s, got %s", test.name, test.verdict, report.Verdict)
+		}
+		expectedRTP := float64(test.st.TotalPrice) / float64(test.st.TotalOriginalPrice)
+		if math.Abs(report.ObservedRTP-expectedRTP) > 1e-12 {
+			t.Fatalf("%s: expected observed RTP %v, got %v", test.name, expectedRTP, report.ObservedRTP)
+		}
+	}
+
+	report := analytics.Analyze(model, store.BoxStatistics{})
+	if report.Verdict != analytics.VerdictInsufficient || report.ExpectedRTP != 0.95 {
+		t.Fatalf("expected insufficient verdict with expected RTP 0.95 for no boxes, got %s with %v", report.Verdict, report.ExpectedRTP)
+	}
+}
+
+func TestAnalyzeOutcomes(t *testing.T) {
+	room := &store.Room{RoomID: 1, Gifts: []*store.Gift{testBox}}
+	counts := []*store.OutcomeCount{
+		{RoomID: 1, UID: 1, BoxID: 32251, GiftID: 1, Num: 60},
+		{RoomID: 1, UID: 2, BoxID: 32251, GiftID: 1, Num: 20},
+		{RoomID: 1, UID: 2, BoxID: 32251, GiftID: 2, Num: 19},
+		{RoomID: 1, UID: 2, BoxID: 32251, GiftID: 99, Num: 1},
+	}
+
+	reports := analytics.AnalyzeOutcomes(room, counts)
+	if len(reports) != 3 {
+		t.Fatalf("expected 2 advertised and 1 unlisted outcome, got %d", len(reports))
+	}
+
+	// 80 of 100 against 90%: z = (80 - 90) / 3
+	if reports[0].GiftID != 1 || reports[0].Num != 80 || reports[0].TotalNum != 100 {
+		t.Fatalf("expected 80 of 100 boxes yielding gift 1, got %+v", reports[0])
+	}
+	if math.Abs(reports[0].Z+10.0/3) > 1e-9 || reports[0].Verdict != analytics.VerdictBelow {
+		t.Fatalf("expected significantly low z -3.33, got %v (%s)", reports[0].Z, reports[0].Verdict)
+	}
+	if reports[1].GiftID != 2 || reports[1].Verdict != analytics.VerdictAbove {
+		t.Fatalf("expected gift 2 drawn significantly often, got %+v", reports[1])
+	}
+	if reports[2].GiftID != 99 || reports[2].Verdict != analytics.VerdictUnlisted {
+		t.Fatalf("expected unlisted gift 99, got %+v", reports[2])
+	}
+
+	// Too few boxes for the rare outcome
+	reports = analytics.AnalyzeOutcomes(room, []*store.OutcomeCount{{RoomID: 1, UID: 1, BoxID: 32251, GiftID: 1, Num: 40}})
+	if reports[1].Verdict != analytics.VerdictInsufficient {
+		t.Fatalf("expected insufficient verdict for 4 expected draws out of 40, got %s", reports[1].Verdict)
+	}
+}
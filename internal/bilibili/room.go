@@ -0,0 +1,71 @@
+package bilibili
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+type LiveStatus int64
+
+const (
+	LiveStatusPreparing LiveStatus = 0 // 未开播
+	LiveStatusLive      LiveStatus = 1 // 直播中
+	LiveStatusRound     LiveStatus = 2 // 轮播中
+)
+
+type RoomInfo struct {
+	UID        int64      `json:"uid"`
+	RoomID     int64      `json:"room_id"`
+	ShortID    int64      `json:"short_id"`
+	Title      string     `json:"title"`
+	LiveStatus LiveStatus `json:"live_status"`
+	LiveTime   string     `json:"live_time"` // e.g., "2024-06-07 20:00:00" in UTC+8, "0000-00-00 00:00:00" if not live
+}
+
+// Parse the start time of the current broadcast. Only meaningful if the room is live.
+func (r *RoomInfo) LiveStartTime() (time.Time, error) {
+	return time.ParseInLocation(time.DateTime, r.LiveTime, time.FixedZone("CST", 8*60*60))
+}
+
+func GetRoomInfo(ctx context.Context, roomID int64) (*RoomInfo, error) {
+	return DefaultClient.GetRoomInfo(ctx, roomID)
+}
+
+func (c *Client) GetRoomInfo(ctx context.Context, roomID int64) (*RoomInfo, error) {
+	req, err := c.NewRequestWithContext(
+		ctx,
+		http.MethodGet,
+		fmt.Sprintf("https://api.live.bilibili.com/room/v1/Room/get_info?room_id=%d", roomID),
+		nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var n response[RoomInfo]
+	if err := json.Unmarshal(body, &n); err != nil {
+		return nil, err
+	}
+
+	data, err := n.DataOrError()
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
@@ -7,21 +7,35 @@ import (
 	"sync"
 	"time"
 
+	"github.com/YangchenYe323/boxtroll/internal/analytics"
 	"github.com/YangchenYe323/boxtroll/internal/bilibili"
 	"github.com/YangchenYe323/boxtroll/internal/live"
+	"github.com/YangchenYe323/boxtroll/internal/overlay"
 	"github.com/YangchenYe323/boxtroll/internal/store"
-	"github.com/YangchenYe323/boxtroll/internal/throttle"
 	"github.com/andreykaipov/goobs"
 	"github.com/rs/zerolog/log"
 )
 
+const (
+	// How long to wait for the queued danmaku to go out on shutdown
+	SHUTDOWN_DANMAKU_TIMEOUT = 15 * time.Second
+	// How often to refresh the gift catalogue of the room during a live stream
+	ROOM_REFRESH_INTERVAL = 30 * time.Minute
+	// Minimum interval between refreshes requested by unknown blind boxes
+	ROOM_REFRESH_MIN_INTERVAL = time.Minute
+	// How long to wait for the profile of a new user, the fetch is waited for on shutdown
+	CREATE_USER_TIMEOUT = 10 * time.Second
+)
+
 // Boxtroll is the driver of the application.
 type Boxtroll struct {
 	db *boxtrollStore
+	// Room being monitored
+	roomID int64
 	// Live Stream for receiving danmaku/gift messages
-	stream *live.Stream
-	// Throttler for sending danmaku to Bilibili to avoid rate limiting
-	throttler *throttle.Throttler
+	stream live.Source
+	// Sends the danmaku reports
+	danmaku DanmakuSender
 
 	// OBS Websocket connection for updating text inputs
 	obsAddr         string
@@ -34,100 +48,315 @@ type Boxtroll struct {
 	reconnect bool
 	reportIdx int64
 
+	// Background danmaku senders, drained on shutdown
+	danmakuWg sync.WaitGroup
+	// Context of the background danmaku senders. It outlives the context of Run,
+	// so that danmaku queued before shutdown can still go out.
+	danmakuCtx context.Context
+	// Background user creators, they write to the store and are drained on shutdown
+	usersWg sync.WaitGroup
+
+	// Log the leaderboards periodically
+	reportLog bool
+
+	// Browser-source overlay server, nil if not enabled
+	overlay *overlay.Server
+
+	// Templates of the danmaku reports
+	template *DanmakuTemplate
+
+	// Interval of the background gift catalogue refresh, 0 to refresh only on request
+	roomRefreshInterval time.Duration
+	// Requests to refresh the gift catalogue, e.g., because an unknown blind box is drawn
+	roomRefresh chan struct{}
+	// Fetch the live status of the room when restoring the current session
+	getRoomInfo func(ctx context.Context, roomID int64) (*bilibili.RoomInfo, error)
+
 	// State of the current live stream
 	cuStreamStMutex sync.RWMutex
 
 	// Local state of the main event loop.
 	// The below fields are owned by the main event loop and should not be accessed by background goroutines.
 
+	// The current live session, nil if it is unknown, e.g., the room has not started broadcasting since boxtroll started.
+	// If the session has ended, statistics are still attributed to it until the next one starts.
+	session *store.Session
 	// Stores the statistics of the current live stream
 	curStreamSt map[int64]map[int64]*store.BoxStatistics
-	// 存储当前直播间用户的电影票数量
-	curTicketNum map[int64]int64
+	// Gift leaderboards and the scores of their current period
+	leaderboards []*leaderboard
+	// Revenue of the current live stream other than gifts, uid -> kind -> total price
+	curRevenue map[int64]map[store.RevenueKind]int64
+	// Latest popularity counter (人气值) of the room, from the heartbeat replies of the message stream
+	popularity int64
 	// Temporary store, stores statistics of the current accumulating batch
 	// uid -> boxID -> statistics
 	// This is NOT the same as the store.BoxStatisticsCache in the store, which stores the accumulation of
 	// all the box statistics.
 	curBatch map[int64]map[int64]*store.BoxStatistics
+	// IDs of the journaled gift events merged into the current batch, uid -> boxID -> event IDs
+	curBatchEvents map[int64]map[int64][]string
+	// Outcomes drawn in the current batch, uid -> boxID -> outcome gift ID -> number
+	curBatchOutcomes map[int64]map[int64]map[int64]int64
 	// A most up-to-date map of boxIDs to box names kept in sync with the ongoing live stream messages.
 	// Box Gift ID -> Box Gift Name, e.g., 心动盲盒.
-	// Even though we do store box information inside theb data store updated on every start-up, it is not guaranteed
-	// to be up-to-date. For example, if a new box is released while the live stream is going on, the new box will not
-	// have been updated in the data store. We keep a cutting-edge-fresh cache here to power live danmaku reporting
-	// and use the persisted metadata for asynchronous reports.
+	// The gift catalogue in the data store is refreshed in the background, and right away when an unknown box is drawn,
+	// but a new box released while the live stream is going on is still missing from it for a while. We keep a
+	// cutting-edge-fresh cache here to power live danmaku reporting and use the persisted metadata for asynchronous reports.
 	boxNames map[int64]string
+	// Last time each user queried their blind-box history in chat
+	queryCooldown map[int64]time.Time
+}
+
+type Option = func(b *Boxtroll)
+
+// Publish leaderboards to the given browser-source overlay server.
+func WithOverlay(server *overlay.Server) Option {
+	return func(b *Boxtroll) {
+		b.overlay = server
+	}
+}
+
+// Send danmaku with the given sender instead of a new BilibiliDanmakuSender.
+func WithDanmakuSender(sender DanmakuSender) Option {
+	return func(b *Boxtroll) {
+		b.danmaku = sender
+	}
 }
 
-func New(ctx context.Context, db store.Store, stream *live.Stream, obsAddr string, obsPassword string, obs *goobs.Client) (*Boxtroll, error) {
-	log.Info().Msg("启动盒子怪，更新直播间和用户信息...")
+// Log the leaderboards periodically, e.g., in place of OBS when replaying a capture.
+func WithReportLog() Option {
+	return func(b *Boxtroll) {
+		b.reportLog = true
+	}
+}
 
-	_, err := refreshRoom(ctx, db, stream.RoomID)
+// Name of the OBS text source to update, defaults to OBS_SOURCE_NAME.
+func WithOBSSourceName(name string) Option {
+	return func(b *Boxtroll) {
+		b.sourceName = name
+	}
+}
+
+// Refresh the gift catalogue of the room at the given interval instead of ROOM_REFRESH_INTERVAL.
+// A non-positive interval disables the periodic refresh, the catalogue is still refreshed when an unknown box is drawn.
+func WithRoomRefreshInterval(interval time.Duration) Option {
+	return func(b *Boxtroll) {
+		b.roomRefreshInterval = interval
+	}
+}
+
+// Show the given gift leaderboards instead of DEFAULT_LEADERBOARDS.
+func WithLeaderboards(specs []*LeaderboardSpec) Option {
+	return func(b *Boxtroll) {
+		b.leaderboards = newLeaderboards(specs)
+	}
+}
+
+// Use the given templates for danmaku reports instead of the default ones.
+func WithDanmakuTemplate(template *DanmakuTemplate) Option {
+	return func(b *Boxtroll) {
+		b.template = template
+	}
+}
+
+func New(ctx context.Context, db store.Store, stream live.Source, obsAddr string, obsPassword string, obs *goobs.Client, options ...Option) (*Boxtroll, error) {
+	log.Info().Int64("room", stream.Room()).Msg("启动盒子怪，更新直播间和用户信息...")
+
+	_, err := refreshRoom(ctx, db, stream.Room())
 	if err != nil {
 		return nil, fmt.Errorf("无法刷新直播间信息: %w", err)
 	}
 
-	if err := refreshAllUsers(ctx, db, stream.RoomID); err != nil {
+	if err := refreshAllUsers(ctx, db, stream.Room()); err != nil {
 		return nil, fmt.Errorf("无法刷新所有用户信息: %w", err)
 	}
 
 	log.Info().Msg("直播间和用户信息更新完成")
 
-	boxtrollStore, err := newBoxtrollStore(ctx, db, stream.RoomID)
+	return newBoxtroll(ctx, db, stream, obsAddr, obsPassword, obs, options...)
+}
+
+// Create the boxtroll from the room and users already in the store, and restore the state of the current stream.
+func newBoxtroll(ctx context.Context, db store.Store, stream live.Source, obsAddr string, obsPassword string, obs *goobs.Client, options ...Option) (*Boxtroll, error) {
+	boxtrollStore, err := newBoxtrollStore(ctx, db, stream.Room())
 	if err != nil {
 		return nil, err
 	}
 
-	return &Boxtroll{
+	b := &Boxtroll{
 		db:          boxtrollStore,
 		stream:      stream,
 		obsAddr:     obsAddr,
 		obsPassword: obsPassword,
 		obs:         obs,
-		// Bilibili has a pretty stringent and not so predictable rate limit for
-		// sending danmaku, we do ((0.8, 1.2) * 2) * seconds throttle
-		throttler: throttle.New(1600*time.Millisecond, 2400*time.Millisecond),
-
-		curBatch:     make(map[int64]map[int64]*store.BoxStatistics),
-		curStreamSt:  make(map[int64]map[int64]*store.BoxStatistics),
-		curTicketNum: make(map[int64]int64),
-		boxNames:     make(map[int64]string),
-	}, nil
+		sourceName:  OBS_SOURCE_NAME,
+		roomID:      stream.Room(),
+		danmaku:     NewBilibiliDanmakuSender(),
+		template:    DefaultDanmakuTemplate(),
+
+		roomRefreshInterval: ROOM_REFRESH_INTERVAL,
+		roomRefresh:         make(chan struct{}, 1),
+		getRoomInfo:         bilibili.GetRoomInfo,
+
+		curBatch:         make(map[int64]map[int64]*store.BoxStatistics),
+		curBatchEvents:   make(map[int64]map[int64][]string),
+		curBatchOutcomes: make(map[int64]map[int64]map[int64]int64),
+		curStreamSt:      make(map[int64]map[int64]*store.BoxStatistics),
+		curRevenue:       make(map[int64]map[store.RevenueKind]int64),
+		boxNames:         make(map[int64]string),
+
+		queryCooldown: make(map[int64]time.Time),
+	}
+
+	specs, err := ParseLeaderboardSpecs(DEFAULT_LEADERBOARDS)
+	if err != nil {
+		// unreachable
+		panic(err)
+	}
+	b.leaderboards = newLeaderboards(specs)
+
+	for _, f := range options {
+		f(b)
+	}
+
+	if err := b.initializeSession(ctx); err != nil {
+		return nil, fmt.Errorf("无法初始化直播场次: %w", err)
+	}
+
+	if err := b.replayJournal(ctx); err != nil {
+		return nil, fmt.Errorf("无法恢复未保存的盲盒数据: %w", err)
+	}
+
+	return b, nil
 }
 
+// Run the event loop until ctx is cancelled or the message source is exhausted, then shut down gracefully.
 func (b *Boxtroll) Run(ctx context.Context) {
 	msgChan := make(chan live.Message, 100)
 
-	go b.stream.Run(ctx, msgChan)
+	// The source may write captures, so it must be gone before Run returns and the owner closes them.
+	// Drain the messages it still sends until it closes the channel.
+	streamCtx, cancelStream := context.WithCancel(ctx)
+	go func() {
+		b.stream.Run(streamCtx, msgChan)
+		close(msgChan)
+	}()
+	defer func() {
+		cancelStream()
+		for range msgChan {
+		}
+	}()
+
+	danmakuCtx, cancelDanmaku := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelDanmaku()
+	b.danmakuCtx = danmakuCtx
+
+	// The refresher writes to the store, so it must be gone before Run returns and the owner closes the store
+	refreshCtx, cancelRefresh := context.WithCancel(ctx)
+	var refreshWg sync.WaitGroup
+	refreshWg.Add(1)
+	go func() {
+		defer refreshWg.Done()
+		b.refreshRoomLoop(refreshCtx)
+	}()
+	defer refreshWg.Wait()
+	defer cancelRefresh()
 
-	var obsTimer *time.Ticker
 	if b.obs != nil {
-		obsTimer = time.NewTicker(5 * time.Second)
 		if err := b.initializeOBS(ctx); err != nil {
 			log.Fatal().Err(err).Msg("无法初始化OBS")
 		}
+	}
+
+	var reportTimer *time.Ticker
+	if b.obs != nil || b.overlay != nil || b.reportLog {
+		reportTimer = time.NewTicker(5 * time.Second)
 	} else {
-		obsTimer = time.NewTicker(time.Hour * 9999)
-		obsTimer.Stop()
+		reportTimer = time.NewTicker(time.Hour * 9999)
+		reportTimer.Stop()
 	}
 
 	for {
-		if err := b.flushBatch(ctx); err != nil {
+		if err := b.flushBatch(ctx, false); err != nil {
 			log.Fatal().Err(err).Msg("无法处理已完成的盲盒数据批次")
 		}
 
 		select {
 		case <-ctx.Done():
+			b.shutdown(ctx)
 			return
-		case msg := <-msgChan:
-			b.handleMessage(msg)
-		case <-obsTimer.C:
-			// If obs is nil, timer will never fire
-			b.updateOBS(ctx)
+		case msg, ok := <-msgChan:
+			if !ok {
+				// The source is exhausted, e.g., a replayed capture
+				b.shutdown(ctx)
+				return
+			}
+			b.handleMessage(ctx, msg)
+		case <-reportTimer.C:
+			// If neither obs, overlay nor report log is enabled, timer will never fire
+			report := b.buildReport(ctx)
+			if b.obs != nil {
+				b.updateOBS(report)
+			}
+			if b.reportLog {
+				log.Info().Int64("room", b.roomID).Int64("popularity", report.Popularity).Msg("排行榜\n" + renderBoards(report.Boards...))
+			}
+			if b.overlay != nil {
+				b.overlay.Publish(report)
+			}
 		case <-time.After(2 * time.Second):
 		}
 	}
 }
 
+// Flush every pending batch, wait for the queued danmaku to go out and disconnect from OBS.
+// The store is shared by all rooms and closed by its owner.
+func (b *Boxtroll) shutdown(ctx context.Context) {
+	// The context of Run is cancelled already
+	ctx = context.WithoutCancel(ctx)
+
+	log.Info().Int64("room", b.roomID).Msg("盒子怪正在退出, 保存未完成的盲盒数据...")
+
+	if err := b.flushBatch(ctx, true); err != nil {
+		// The batches are still in the journal
+		log.Err(err).Int64("room", b.roomID).Msg("无法保存未完成的盲盒数据, 将在下次启动时恢复")
+	}
+
+	// Every user creator is bounded by CREATE_USER_TIMEOUT
+	b.usersWg.Wait()
+
+	drained := make(chan struct{})
+	go func() {
+		b.danmakuWg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-time.After(SHUTDOWN_DANMAKU_TIMEOUT):
+		log.Warn().Int64("room", b.roomID).Msgf("等待弹幕发送超过 %s, 放弃剩余弹幕", SHUTDOWN_DANMAKU_TIMEOUT)
+	}
+
+	if b.obs != nil {
+		if err := b.obs.Disconnect(); err != nil {
+			log.Err(err).Msg("无法断开OBS websocket连接")
+		}
+	}
+
+	b.logSessionSummary()
+}
+
+// Send danmaku in the background so that the sender does not block the event loop.
+// The senders are waited for on shutdown.
+func (b *Boxtroll) sendInBackground(send func(ctx context.Context)) {
+	b.danmakuWg.Add(1)
+	go func() {
+		defer b.danmakuWg.Done()
+		send(b.danmakuCtx)
+	}()
+}
+
 // An entry describing a finished box batch to be flushed
 type finishedBatch struct {
 	key     []byte
@@ -136,6 +365,12 @@ type finishedBatch struct {
 	boxName string
 	st      store.BoxStatistics
 	accumSt store.BoxStatistics
+	// Journaled gift events merged into st
+	eventIDs []string
+	// Outcome gift ID -> number drawn in st
+	outcomes map[int64]int64
+	// Advertised chances of the box, nil if unknown
+	model *analytics.BoxModel
 }
 
 // Implement store.BoxStatisticsTransfer interface
@@ -149,40 +384,42 @@ func (f *finishedBatch) GetBoxStatistics() *store.BoxStatistics {
 }
 
 // Flush finished batches to database and send danmaku report to Bilibili.
+// A batch is finished if it has not been updated for a second, or unconditionally if force is set.
 //
 // It only fails if we cannot finish the database transactions, in which case something
 // is probably wrong with local disk. It does NOT fail if we cannot send danmaku, which is
 // more or less out of our control and might recover by itself.
-func (b *Boxtroll) flushBatch(ctx context.Context) error {
+func (b *Boxtroll) flushBatch(ctx context.Context, force bool) error {
 	var entries []*finishedBatch
 	for uid, boxIDMap := range b.curBatch {
-		go func(uid int64) {
-			if err := b.createUserIfNotExists(ctx, uid); err != nil {
-				log.Err(err).Int64("uid", uid).Msg("无法创建用户")
-			}
-		}(uid)
+		b.createUserInBackground(ctx, uid)
 
 		for boxID, st := range boxIDMap {
 			// Since we populate the box names upon seeing a SEND_GIFT msg, and populate
-			// current batch in the same place, it is impossible for boxName to be nil
+			// current batch in the same place, it is impossible for boxName to be nil.
+			// The only exception is a replayed box unknown to the room metadata.
 			boxName := b.boxNames[boxID]
 
 			if st.LastUpdateTime.IsZero() {
 				continue
 			}
-			if time.Since(st.LastUpdateTime) < time.Second {
+			if !force && time.Since(st.LastUpdateTime) < time.Second {
 				continue
 			}
 
 			entries = append(entries, &finishedBatch{
-				key:     b.db.BoxStatisticsKey(b.stream.RoomID, uid, boxID),
-				uid:     uid,
-				boxID:   boxID,
-				boxName: boxName,
-				st:      *st,
+				key:      b.db.BoxStatisticsKey(b.roomID, uid, boxID),
+				uid:      uid,
+				boxID:    boxID,
+				boxName:  boxName,
+				st:       *st,
+				eventIDs: b.curBatchEvents[uid][boxID],
+				outcomes: b.curBatchOutcomes[uid][boxID],
 			})
 
 			st.Reset()
+			delete(b.curBatchEvents[uid], boxID)
+			delete(b.curBatchOutcomes[uid], boxID)
 		}
 	}
 
@@ -200,15 +437,98 @@ func (b *Boxtroll) flushBatch(ctx context.Context) error {
 		entry.accumSt.Merge(entry.st)
 	}
 
-	if err := b.db.SetBoxStatistics(ctx, transfers); err != nil {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	models := b.boxModels(ctx)
+	for _, entry := range entries {
+		entry.model = models[entry.boxID]
+	}
+
+	batch := &store.Batch{
+		RoomID:        b.roomID,
+		BoxStatistics: transfers,
+	}
+	for _, entry := range entries {
+		batch.EventIDs = append(batch.EventIDs, entry.eventIDs...)
+		for giftID, num := range entry.outcomes {
+			batch.OutcomeCounts = append(batch.OutcomeCounts, &store.OutcomeCount{
+				RoomID: b.roomID,
+				UID:    entry.uid,
+				BoxID:  entry.boxID,
+				GiftID: giftID,
+				Num:    num,
+			})
+		}
+	}
+
+	if b.session != nil {
+		batch.Session = b.session
+		batch.SessionBoxStatistics = make(map[int64]map[int64]*store.BoxStatistics)
+		for _, entry := range entries {
+			// The batch may have started before the current session did
+			curSt, ok := b.curStreamSt[entry.uid][entry.boxID]
+			if !ok {
+				continue
+			}
+			if _, ok := batch.SessionBoxStatistics[entry.uid]; !ok {
+				batch.SessionBoxStatistics[entry.uid] = make(map[int64]*store.BoxStatistics)
+			}
+			st := *curSt
+			batch.SessionBoxStatistics[entry.uid][entry.boxID] = &st
+		}
+	}
+
+	// Statistics, session statistics and the journal are updated atomically,
+	// so that replaying the journal never counts an event twice
+	if err := b.db.CommitBatch(ctx, batch); err != nil {
 		return err
 	}
 
-	go b.sendDanmakuReport(ctx, entries)
+	b.sendInBackground(func(ctx context.Context) {
+		b.sendDanmakuReport(ctx, entries)
+	})
 
 	return nil
 }
 
+// Models of the blind boxes of the room with known chances, boxID -> model
+func (b *Boxtroll) boxModels(ctx context.Context) map[int64]*analytics.BoxModel {
+	models := make(map[int64]*analytics.BoxModel)
+
+	room, err := b.db.GetRoom(ctx, b.roomID)
+	if err != nil {
+		log.Warn().Err(err).Msg("无法获取直播间礼物信息")
+		return models
+	}
+	for _, gift := range room.Gifts {
+		if len(gift.BlindBoxOutcomes) == 0 {
+			continue
+		}
+		if model, err := analytics.NewBoxModel(gift); err == nil {
+			models[gift.GiftID] = model
+		}
+	}
+
+	return models
+}
+
+// Create the user in the background so that fetching the profile does not block the event loop.
+// The creators are waited for on shutdown.
+func (b *Boxtroll) createUserInBackground(ctx context.Context, uid int64) {
+	b.usersWg.Add(1)
+	go func() {
+		defer b.usersWg.Done()
+
+		ctx, cancel := context.WithTimeout(ctx, CREATE_USER_TIMEOUT)
+		defer cancel()
+		if err := b.createUserIfNotExists(ctx, uid); err != nil {
+			log.Err(err).Int64("uid", uid).Msg("无法创建用户")
+		}
+	}()
+}
+
 func (b *Boxtroll) createUserIfNotExists(ctx context.Context, uid int64) error {
 	_, err := b.db.GetUser(ctx, uid)
 
@@ -236,94 +556,134 @@ func (b *Boxtroll) sendDanmakuReport(
 	entries []*finishedBatch,
 ) {
 	for _, entry := range entries {
-		// 当前batch盈亏
-		curDiff := entry.st.TotalPrice - entry.st.TotalOriginalPrice
-		// 历史总盈亏
-		accumDiff := entry.accumSt.TotalPrice - entry.accumSt.TotalOriginalPrice
-
-		curDiffBattery := curDiff / 100
-		accumDiffBattery := accumDiff / 100
-
-		msgs := []string{
-			danmaku(entry.boxName, curDiffBattery, false),
-			danmaku(entry.boxName, accumDiffBattery, true),
+		msgs, err := b.template.render(entry)
+		if err != nil {
+			log.Err(err).Int64("uid", entry.uid).Str("box", entry.boxName).Msg("无法渲染弹幕模板")
+			continue
 		}
 
 		for _, msg := range msgs {
-			if err := b.throttler.Run(func() error {
-				return bilibili.SendDanmaku(
-					ctx,
-					b.stream.RoomID,
-					bilibili.WithMsg(msg),
-					bilibili.WithReplyMID(entry.uid),
-				)
-			}); err != nil {
-				log.Err(err).Str("danmaku", msg).Msg("发送弹幕失败")
+			if err := b.danmaku.Send(ctx, b.roomID, msg, entry.uid); err != nil {
+				log.Err(err).Int64("room", b.roomID).Str("danmaku", msg).Msg("发送弹幕失败")
 			}
 		}
 
 	}
 }
 
-func (b *Boxtroll) handleMessage(msg live.Message) {
+func (b *Boxtroll) handleMessage(ctx context.Context, msg live.Message) {
 	switch msg.Cmd {
 	case "SEND_GIFT":
-		b.handleSendGift(msg.SendGift)
+		b.handleSendGift(ctx, msg.SendGift)
+	case "DANMU_MSG":
+		b.handleDanmaku(ctx, msg.Danmaku)
+	case "LIVE":
+		b.handleLive(ctx, msg.Live)
+	case "PREPARING":
+		b.handlePreparing(ctx, msg.Preparing)
+	case "COMBO_SEND":
+		// The gifts of the combo are counted by their own SEND_GIFT messages
+		combo := msg.ComboSend
+		log.Debug().Int64("uid", combo.UID).Str("gift", combo.GiftName).Int64("num", combo.TotalNum).Msg("礼物连击结束")
+	case "GUARD_BUY":
+		b.handleGuardBuy(ctx, msg.GuardBuy)
+	case "SUPER_CHAT_MESSAGE":
+		b.handleSuperChat(ctx, msg.SuperChat)
+	case live.CmdPopularity:
+		b.popularity = msg.Popularity.Popularity
+		log.Debug().Int64("room", b.roomID).Int64("popularity", b.popularity).Msg("直播间人气值")
 	}
 }
 
-func (b *Boxtroll) handleSendGift(sendGift *live.SendGiftMessage) {
+func (b *Boxtroll) handleSendGift(ctx context.Context, sendGift *live.SendGiftMessage) {
 	if sendGift.BlindGift == nil {
+		b.scoreLeaderboards(ctx, sendGift)
 		return
 	}
 
-	if _, ok := b.curBatch[sendGift.UID]; !ok {
-		b.curBatch[sendGift.UID] = make(map[int64]*store.BoxStatistics)
-	}
-	if _, ok := b.curBatch[sendGift.UID][sendGift.BlindGift.OriginalGiftID]; !ok {
-		b.curBatch[sendGift.UID][sendGift.BlindGift.OriginalGiftID] = &store.BoxStatistics{}
-	}
-	if _, ok := b.curStreamSt[sendGift.UID]; !ok {
-		b.curStreamSt[sendGift.UID] = make(map[int64]*store.BoxStatistics)
-	}
-	if _, ok := b.curStreamSt[sendGift.UID][sendGift.BlindGift.OriginalGiftID]; !ok {
-		b.curStreamSt[sendGift.UID][sendGift.BlindGift.OriginalGiftID] = &store.BoxStatistics{}
+	event := &store.GiftEvent{
+		ID:            sendGift.ID(),
+		Timestamp:     sentAt(sendGift.Timestamp),
+		RoomID:        b.roomID,
+		UID:           sendGift.UID,
+		BoxID:         sendGift.BlindGift.OriginalGiftID,
+		GiftID:        sendGift.GiftID,
+		Num:           sendGift.Num,
+		Price:         sendGift.Price,
+		OriginalPrice: sendGift.BlindGift.OriginalGiftPrice,
 	}
 
-	// Update current unsent batch
-	st := b.curBatch[sendGift.UID][sendGift.BlindGift.OriginalGiftID]
-	st.TotalNum += sendGift.Num
-	st.TotalOriginalPrice += sendGift.BlindGift.OriginalGiftPrice * sendGift.Num
-	st.TotalPrice += sendGift.Price * sendGift.Num
-	st.LastUpdateTime = time.Now()
-
-	// Update current stream statistics
-	curSt := b.curStreamSt[sendGift.UID][sendGift.BlindGift.OriginalGiftID]
-	curSt.TotalNum += sendGift.Num
-	curSt.TotalOriginalPrice += sendGift.BlindGift.OriginalGiftPrice * sendGift.Num
-	curSt.TotalPrice += sendGift.Price * sendGift.Num
-	curSt.LastUpdateTime = time.Now()
+	// Journal the raw result before aggregating it, so that it survives a crash before the batch is flushed
+	journaled := true
+	accepted, err := b.db.AcceptGiftEvent(ctx, event)
+	if err != nil {
+		log.Err(err).Int64("uid", sendGift.UID).Str("gift", sendGift.GiftName).Msg("无法保存盲盒礼物记录")
+		journaled = false
+	} else if !accepted {
+		log.Debug().Str("id", event.ID).Int64("uid", sendGift.UID).Str("gift", sendGift.GiftName).Msg("忽略重复的盲盒礼物消息")
+		return
+	}
 
 	// Populate the box names lazily
 	if _, ok := b.boxNames[sendGift.BlindGift.OriginalGiftID]; !ok {
 		b.boxNames[sendGift.BlindGift.OriginalGiftID] = sendGift.BlindGift.OriginalGiftName
+		if !b.isKnownBox(ctx, sendGift.BlindGift.OriginalGiftID) {
+			log.Info().Int64("id", sendGift.BlindGift.OriginalGiftID).Str("name", sendGift.BlindGift.OriginalGiftName).Msg("发现未知盲盒, 刷新直播间礼物配置")
+			b.requestRoomRefresh()
+		}
 	}
 
-	// Update current ticket number
-	if sendGift.GiftName == "电影票" {
-		b.curTicketNum[sendGift.UID] += sendGift.Num
+	b.scoreLeaderboards(ctx, sendGift)
+	b.aggregate(event, journaled)
+}
+
+// Time a message is sent at, given in Unix seconds. Messages missing it are timestamped on arrival.
+func sentAt(unix int64) time.Time {
+	if unix == 0 {
+		return time.Now()
 	}
+	return time.Unix(unix, 0)
 }
 
-func danmaku(boxName string, diffBattery int64, accum bool) string {
-	var prefix string
-	if accum {
-		prefix = "历史"
+// Add an accepted gift event to the current batch and the current stream statistics.
+// Journaled events are removed from the journal when their batch is flushed.
+func (b *Boxtroll) aggregate(event *store.GiftEvent, journaled bool) {
+	if _, ok := b.curBatch[event.UID]; !ok {
+		b.curBatch[event.UID] = make(map[int64]*store.BoxStatistics)
+	}
+	if _, ok := b.curBatch[event.UID][event.BoxID]; !ok {
+		b.curBatch[event.UID][event.BoxID] = &store.BoxStatistics{}
+	}
+	// Update current unsent batch. The batch is finished a second after the last box arrives,
+	// whenever the boxes are sent.
+	b.curBatch[event.UID][event.BoxID].Merge(event.BoxStatistics())
+	b.curBatch[event.UID][event.BoxID].LastUpdateTime = time.Now()
+	if journaled {
+		if _, ok := b.curBatchEvents[event.UID]; !ok {
+			b.curBatchEvents[event.UID] = make(map[int64][]string)
+		}
+		b.curBatchEvents[event.UID][event.BoxID] = append(b.curBatchEvents[event.UID][event.BoxID], event.ID)
+	}
+	if _, ok := b.curBatchOutcomes[event.UID]; !ok {
+		b.curBatchOutcomes[event.UID] = make(map[int64]map[int64]int64)
+	}
+	if _, ok := b.curBatchOutcomes[event.UID][event.BoxID]; !ok {
+		b.curBatchOutcomes[event.UID][event.BoxID] = make(map[int64]int64)
 	}
+	b.curBatchOutcomes[event.UID][event.BoxID][event.GiftID] += event.Num
 
-	if diffBattery >= 0 {
-		return fmt.Sprintf("%s投喂 %s: +%d 电池", prefix, boxName, diffBattery)
-	} else {
-		return fmt.Sprintf("%s投喂 %s: %d 电池", prefix, boxName, diffBattery)
+	// A replayed event may belong to an earlier stream
+	if b.session != nil && event.Timestamp.Before(b.session.StartTime) {
+		return
 	}
+
+	// Update current stream statistics
+	if _, ok := b.curStreamSt[event.UID]; !ok {
+		b.curStreamSt[event.UID] = make(map[int64]*store.BoxStatistics)
+	}
+	if _, ok := b.curStreamSt[event.UID][event.BoxID]; !ok {
+		b.curStreamSt[event.UID][event.BoxID] = &store.BoxStatistics{}
+	}
+	b.curStreamSt[event.UID][event.BoxID].Merge(event.BoxStatistics())
+
 }
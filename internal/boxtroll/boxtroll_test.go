@@ -0,0 +1,282 @@
+package boxtroll
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/YangchenYe323/boxtroll/internal/bilibili"
+	"github.com/YangchenYe323/boxtroll/internal/live"
+	"github.com/YangchenYe323/boxtroll/internal/store"
+)
+
+const testRoomID = 7706705
+
+// A blind box costing 15 电池 that yields 告白气球 or 小蛋糕
+var testBox = &store.Gift{
+	GiftID: 32251,
+	Name:   "心动盲盒",
+	Price:  1500,
+	BlindBoxOutcomes: []store.BlindBoxOutcome{
+		{GiftID: 32356, Name: "告白气球", Price: 5000, Chance: "10%"},
+		{GiftID: 31039, Name: "小蛋糕", Price: 500, Chance: "90%"},
+	},
+}
+
+var testUsers = []*store.User{
+	{MID: 12345678, Name: "盒子怪的粉丝"},
+	{MID: 87654321, Name: "路过的观众"},
+}
+
+// A source that never sends, the tests call the handlers directly
+type testSource struct{}
+
+func (testSource) Room() int64 { return testRoomID }
+
+func (testSource) Run(ctx context.Context, msgChan chan<- live.Message) { <-ctx.Done() }
+
+// Records the danmaku instead of sending them
+type recordingSender struct {
+	// How long sending a danmaku takes
+	delay time.Duration
+
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (s *recordingSender) Send(ctx context.Context, roomID int64, msg string, replyMID int64) error {
+	time.Sleep(s.delay)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.msgs = append(s.msgs, msg)
+	return nil
+}
+
+func (s *recordingSender) sent() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.msgs...)
+}
+
+// Create a boxtroll of testRoomID on a fresh badger store with testBox and testUsers, without
+// touching the network. The room is not live, so there is no current session.
+func newTestBoxtroll(t *testing.T, options ...Option) (*Boxtroll, store.Store, *recordingSender) {
+	t.Helper()
+
+	db, err := store.NewBadger(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create badger store: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	ctx := context.Background()
+	if err := db.SetRoom(ctx, testRoomID, &store.Room{RoomID: testRoomID, Gifts: []*store.Gift{testBox}}); err != nil {
+		t.Fatalf("failed to set room: %v", err)
+	}
+	for _, user := range testUsers {
+		if err := db.SetUser(ctx, user.MID, user); err != nil {
+			t.Fatalf("failed to set user: %v", err)
+		}
+	}
+
+	sender := &recordingSender{}
+	options = append([]Option{
+		WithDanmakuSender(sender),
+		func(b *Boxtroll) {
+			b.getRoomInfo = func(ctx context.Context, roomID int64) (*bilibili.RoomInfo, error) {
+				return nil, errors.New("offline")
+			}
+		},
+	}, options...)
+
+	b, err := newBoxtroll(ctx, db, testSource{}, "", "", nil, options...)
+	if err != nil {
+		t.Fatalf("failed to create boxtroll: %v", err)
+	}
+	b.danmakuCtx = ctx
+
+	return b, db, sender
+}
+
+// A single blind box opened by uid, yielding the given outcome
+func testBoxGift(id string, uid int64, outcome store.BlindBoxOutcome) *live.SendGiftMessage {
+	return &live.SendGiftMessage{
+		GiftID:   outcome.GiftID,
+		GiftName: outcome.Name,
+		Num:      1,
+		Price:    outcome.Price,
+		UID:      uid,
+		TID:      live.FlexString(id),
+		BlindGift: &live.BlindGift{
+			OriginalGiftID:    testBox.GiftID,
+			OriginalGiftName:  testBox.Name,
+			OriginalGiftPrice: testBox.Price,
+		},
+	}
+}
+
+// A source that sends the given messages, then fills the channel of Run so that the messages
+// are known to be handled once handled is closed
+type scriptedSource struct {
+	msgs    []live.Message
+	handled chan struct{}
+}
+
+func (s *scriptedSource) Room() int64 { return testRoomID }
+
+func (s *scriptedSource) Run(ctx context.Context, msgChan chan<- live.Message) {
+	for _, msg := range s.msgs {
+		msgChan <- msg
+	}
+	// Run takes the messages one at a time, and handles each before taking the next
+	for range cap(msgChan) + 1 {
+		select {
+		case msgChan <- live.Message{Cmd: live.CmdPopularity, Popularity: &live.PopularityMessage{Popularity: 1}}:
+		case <-ctx.Done():
+			return
+		}
+	}
+	close(s.handled)
+	<-ctx.Done()
+}
+
+// Cancelling Run commits the open batch and sends its danmaku before Run returns.
+func TestRunShutdown(t *testing.T) {
+	source := &scriptedSource{
+		msgs: []live.Message{
+			{Cmd: "SEND_GIFT", SendGift: testBoxGift("1", 12345678, testBox.BlindBoxOutcomes[0])},
+			{Cmd: "SEND_GIFT", SendGift: testBoxGift("2", 12345678, testBox.BlindBoxOutcomes[1])},
+		},
+		handled: make(chan struct{}),
+	}
+	b, db, sender := newTestBoxtroll(t, func(b *Boxtroll) { b.stream = source })
+	sender.delay = 100 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		b.Run(ctx)
+		close(done)
+	}()
+
+	select {
+	case <-source.handled:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the messages to be handled")
+	}
+	// The batch is still open, it is finished a second after its last box
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(SHUTDOWN_DANMAKU_TIMEOUT):
+		t.Fatalf("timed out waiting for Run to return")
+	}
+
+	flushed := &finishedBatch{key: db.BoxStatisticsKey(testRoomID, 12345678, testBox.GiftID)}
+	if err := db.GetBoxStatistics(context.Background(), []store.BoxStatisticsTransfer{flushed}, store.NotFoundBehaviorError); err != nil {
+		t.Fatalf("failed to get box statistics: %v", err)
+	}
+	if st := flushed.accumSt; st.TotalNum != 2 || st.TotalOriginalPrice != 3000 || st.TotalPrice != 5500 {
+		t.Fatalf("expected 2 boxes for 3000 worth 5500, got %+v", st)
+	}
+	expected := []string{"投喂 心动盲盒: +25 电池", "历史投喂 心动盲盒: +25 电池"}
+	if replies := sender.sent(); !slices.Equal(replies, expected) {
+		t.Fatalf("expected %q sent before Run returns, got %q", expected, replies)
+	}
+}
+
+// Read the recorded messages of the live package, one JSON body per line
+func readTestMessages(t *testing.T, name string) []*live.Message {
+	t.Helper()
+
+	body, err := os.ReadFile(filepath.Join("..", "live", "testdata", name))
+	if err != nil {
+		t.Fatalf("failed to read fixture: %v", err)
+	}
+
+	var messages []*live.Message
+	for line := range bytes.Lines(bytes.TrimSpace(body)) {
+		line = bytes.TrimSpace(line)
+		header := live.MessageHeader{
+			TotalLength:  uint32(len(line)) + 16,
+			HeaderLength: 16,
+			Type:         live.MessageTypeUncompressedNormal,
+			OpCode:       live.OpNormal,
+		}
+		var buf bytes.Buffer
+		if err := header.Write(&buf); err != nil {
+			t.Fatalf("failed to write header: %v", err)
+		}
+		buf.Write(line)
+
+		parsed, err := live.ReadMessages(&buf)
+		if err != nil {
+			t.Fatalf("failed to read messages: %v", err)
+		}
+		messages = append(messages, parsed...)
+	}
+	return messages
+}
+
+// The combos of the recorded sequence are counted once per gift, even when the sequence is delivered again.
+func TestComboSequence(t *testing.T) {
+	specs, err := ParseLeaderboardSpecs("gift=小花花,metric=count,scope=all; gift=小花花,metric=value,scope=all; gift=32251,metric=count,scope=all")
+	if err != nil {
+		t.Fatalf("failed to parse leaderboards: %v", err)
+	}
+	b, db, sender := newTestBoxtroll(t, WithLeaderboards(specs))
+	ctx := context.Background()
+
+	messages := readTestMessages(t, "combo_sequence.jsonl")
+	for range 2 {
+		for _, msg := range messages {
+			b.handleMessage(ctx, *msg)
+		}
+		if err := b.flushBatch(ctx, true); err != nil {
+			t.Fatalf("failed to flush batch: %v", err)
+		}
+	}
+	b.danmakuWg.Wait()
+	b.usersWg.Wait()
+
+	// 1 告白气球 and 4 小蛋糕 from 5 心动盲盒
+	flushed := &finishedBatch{key: db.BoxStatisticsKey(testRoomID, 12345678, testBox.GiftID)}
+	if err := db.GetBoxStatistics(ctx, []store.BoxStatisticsTransfer{flushed}, store.NotFoundBehaviorError); err != nil {
+		t.Fatalf("failed to get box statistics: %v", err)
+	}
+	if st := flushed.accumSt; st.TotalNum != 5 || st.TotalOriginalPrice != 7500 || st.TotalPrice != 7000 {
+		t.Fatalf("expected 5 boxes for 7500 worth 7000, got %+v", st)
+	}
+	if replies := sender.sent(); len(replies) != 2 {
+		t.Fatalf("expected the batch and its history to be reported once, got %v", replies)
+	}
+
+	// 3 single 小花花 and 2 batches of 10, the redelivered messages aside
+	expected := map[string]map[int64]int64{
+		"小花花/count":   {12345678: 3, 87654321: 20},
+		"小花花/value":   {12345678: 300, 87654321: 2000},
+		"32251/count": {12345678: 5},
+	}
+	for board, scores := range expected {
+		stored, err := db.ListLeaderboardScores(ctx, testRoomID, board, "all")
+		if err != nil {
+			t.Fatalf("failed to list leaderboard scores: %v", err)
+		}
+		actual := make(map[int64]int64, len(stored))
+		for _, score := range stored {
+			actual[score.UID] = score.Value
+		}
+		if !maps.Equal(actual, scores) {
+			t.Fatalf("expected scores %v on %s, got %v", scores, board, actual)
+		}
+	}
+}
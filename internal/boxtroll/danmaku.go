@@ -0,0 +1,107 @@
+package boxtroll
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/YangchenYe323/boxtroll/internal/bilibili"
+	"github.com/YangchenYe323/boxtroll/internal/throttle"
+	"github.com/rs/zerolog/log"
+)
+
+// DanmakuSink selects where the danmaku of a run go, e.g., nowhere near the streamer's chat
+// when trying out a new template.
+type DanmakuSink string
+
+const (
+	// Send to the live room as the logged in user
+	DanmakuSinkBilibili DanmakuSink = "bilibili"
+	// Only log the danmaku
+	DanmakuSinkLog DanmakuSink = "log"
+	// Print the danmaku to stdout, e.g., to watch them in a terminal pane
+	DanmakuSinkStdout DanmakuSink = "stdout"
+	// Append the danmaku to a local file, e.g., to tail -f it in a terminal pane
+	DanmakuSinkFile DanmakuSink = "file"
+)
+
+func ParseDanmakuSink(s string) (DanmakuSink, error) {
+	switch sink := DanmakuSink(s); sink {
+	case DanmakuSinkBilibili, DanmakuSinkLog, DanmakuSinkStdout, DanmakuSinkFile:
+		return sink, nil
+	default:
+		return "", fmt.Errorf("未知的弹幕输出方式: %s (可选 bilibili, log, stdout, file)", s)
+	}
+}
+
+// Sends danmaku to a live room. Implementations must be safe for concurrent use.
+type DanmakuSender interface {
+	// Send msg to the given room, replying to (@) replyMID if it is not 0
+	Send(ctx context.Context, roomID int64, msg string, replyMID int64) error
+}
+
+// Sends danmaku to Bilibili as the logged in user.
+type BilibiliDanmakuSender struct {
+	// Throttler for sending danmaku to Bilibili to avoid rate limiting
+	throttler *throttle.Throttler
+}
+
+var _ DanmakuSender = &BilibiliDanmakuSender{}
+
+// Boxtrolls of different rooms sending danmaku with the same account should share one sender,
+// as the rate limit is per account.
+func NewBilibiliDanmakuSender() *BilibiliDanmakuSender {
+	return &BilibiliDanmakuSender{
+		// Bilibili has a pretty stringent and not so predictable rate limit for
+		// sending danmaku, we do ((0.8, 1.2) * 2) * seconds throttle
+		throttler: throttle.New(1600*time.Millisecond, 2400*time.Millisecond),
+	}
+}
+
+func (s *BilibiliDanmakuSender) Send(ctx context.Context, roomID int64, msg string, replyMID int64) error {
+	options := []bilibili.DanmakuOption{bilibili.WithMsg(msg)}
+	if replyMID != 0 {
+		options = append(options, bilibili.WithReplyMID(replyMID))
+	}
+
+	return s.throttler.Run(func() error {
+		return bilibili.SendDanmaku(ctx, roomID, options...)
+	})
+}
+
+// Logs danmaku instead of sending them, e.g., when replaying a capture.
+type LogDanmakuSender struct{}
+
+var _ DanmakuSender = LogDanmakuSender{}
+
+func (LogDanmakuSender) Send(ctx context.Context, roomID int64, msg string, replyMID int64) error {
+	log.Info().Int64("room", roomID).Int64("reply_mid", replyMID).Str("danmaku", msg).Msg("弹幕")
+	return nil
+}
+
+// Writes danmaku as lines to w instead of sending them, one line per danmaku.
+type WriterDanmakuSender struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+var _ DanmakuSender = &WriterDanmakuSender{}
+
+func NewWriterDanmakuSender(w io.Writer) *WriterDanmakuSender {
+	return &WriterDanmakuSender{w: w}
+}
+
+func (s *WriterDanmakuSender) Send(ctx context.Context, roomID int64, msg string, replyMID int64) error {
+	reply := ""
+	if replyMID != 0 {
+		reply = fmt.Sprintf("@%d ", replyMID)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := fmt.Fprintf(s.w, "%s [%d] %s%s\n", time.Now().Format(time.DateTime), roomID, reply, msg)
+	return err
+}
@@ -0,0 +1,42 @@
+package boxtroll
+
+import (
+	"context"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Re-aggregate the gift events accepted but not flushed before the last shutdown, e.g., because
+// boxtroll was killed or failed to write the statistics. They are flushed with the next batch.
+func (b *Boxtroll) replayJournal(ctx context.Context) error {
+	events, err := b.db.ListJournal(ctx, b.roomID)
+	if err != nil {
+		return err
+	}
+	if len(events) == 0 {
+		return nil
+	}
+
+	room, err := b.db.GetRoom(ctx, b.roomID)
+	if err != nil {
+		return err
+	}
+
+	// The gift messages are gone, recover the names from the room metadata
+	boxNames := make(map[int64]string)
+	for _, gift := range room.Gifts {
+		boxNames[gift.GiftID] = gift.Name
+	}
+
+	for _, event := range events {
+		// A box unknown to the room metadata is named by the next gift message
+		if name, ok := boxNames[event.BoxID]; ok {
+			b.boxNames[event.BoxID] = name
+		}
+		b.aggregate(event, true)
+	}
+
+	log.Info().Int64("room", b.roomID).Int("events", len(events)).Msg("恢复上次未保存的盲盒数据")
+
+	return nil
+}
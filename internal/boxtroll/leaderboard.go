@@ -0,0 +1,364 @@
+package boxtroll
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/YangchenYe323/boxtroll/internal/live"
+	"github.com/YangchenYe323/boxtroll/internal/overlay"
+	"github.com/YangchenYe323/boxtroll/internal/store"
+	"github.com/rs/zerolog/log"
+)
+
+// The leaderboards shown by default: every 电影票 received in the current live session, sent directly or drawn from blind boxes
+const DEFAULT_LEADERBOARDS = "gift=电影票,metric=count,scope=session,top=5,unit=张"
+
+// What a gift leaderboard ranks users by
+type LeaderboardMetric string
+
+const (
+	// Number of gifts
+	LeaderboardMetricCount LeaderboardMetric = "count"
+	// Total price of the gifts, in 电池
+	LeaderboardMetricValue LeaderboardMetric = "value"
+	// Total price of the blind box outcomes minus the price of the boxes, in 电池. Gifts not sent
+	// through blind boxes score nothing.
+	LeaderboardMetricProfit LeaderboardMetric = "profit"
+)
+
+// Period a gift leaderboard accumulates over
+type LeaderboardScope string
+
+const (
+	// The current live session
+	LeaderboardScopeSession LeaderboardScope = "session"
+	// The current day in local time
+	LeaderboardScopeDay LeaderboardScope = "day"
+	// Since the leaderboard is defined
+	LeaderboardScopeAll LeaderboardScope = "all"
+)
+
+// Definition of a gift leaderboard, e.g., gift=小花花,metric=count,scope=day,top=10.
+type LeaderboardSpec struct {
+	// Gift ID or name. A gift matches if either the gift sent or the blind box it is drawn from matches,
+	// so a blind box ranks users by the boxes they opened and an outcome by the times they drew it.
+	Gift   string
+	Metric LeaderboardMetric
+	Scope  LeaderboardScope
+	TopN   int
+	// Title of the board, derived from the above if empty
+	Title string
+	// Unit of the displayed value, e.g., 张. Defaults to 个 for counts and 电池 otherwise.
+	Unit string
+}
+
+// Identity of the leaderboard in the store. Boards differing in scope share it, their scores are
+// kept apart by period.
+func (s *LeaderboardSpec) ID() string {
+	return fmt.Sprintf("%s/%s", s.Gift, s.Metric)
+}
+
+func (s *LeaderboardSpec) title() string {
+	if s.Title != "" {
+		return s.Title
+	}
+
+	var scope string
+	switch s.Scope {
+	case LeaderboardScopeSession:
+		scope = "本场"
+	case LeaderboardScopeDay:
+		scope = "今日"
+	case LeaderboardScopeAll:
+		scope = "历史"
+	}
+
+	var metric string
+	switch s.Metric {
+	case LeaderboardMetricValue:
+		metric = "价值"
+	case LeaderboardMetricProfit:
+		metric = "盈亏"
+	}
+
+	return fmt.Sprintf("%s%s%s排行榜", scope, s.Gift, metric)
+}
+
+func (s *LeaderboardSpec) unit() string {
+	if s.Unit != "" {
+		return s.Unit
+	}
+	if s.Metric == LeaderboardMetricCount {
+		return "个"
+	}
+	return "电池"
+}
+
+// Whether the gift sent, or the blind box it is drawn from, is the gift of the leaderboard
+func (s *LeaderboardSpec) matches(sendGift *live.SendGiftMessage) bool {
+	if s.Gift == sendGift.GiftName || s.Gift == strconv.FormatInt(sendGift.GiftID, 10) {
+		return true
+	}
+	if box := sendGift.BlindGift; box != nil {
+		return s.Gift == box.OriginalGiftName || s.Gift == strconv.FormatInt(box.OriginalGiftID, 10)
+	}
+	return false
+}
+
+// Score of a gift message on the leaderboard. Prices are kept in the unit of gift prices.
+func (s *LeaderboardSpec) score(sendGift *live.SendGiftMessage) int64 {
+	switch s.Metric {
+	case LeaderboardMetricValue:
+		return sendGift.Price * sendGift.Num
+	case LeaderboardMetricProfit:
+		if sendGift.BlindGift == nil {
+			return 0
+		}
+		return (sendGift.Price - sendGift.BlindGift.OriginalGiftPrice) * sendGift.Num
+	default:
+		return sendGift.Num
+	}
+}
+
+// Parse leaderboard definitions separated by semicolons, each a comma separated list of key=value, e.g.,
+// "gift=电影票,metric=count,scope=session,top=5,unit=张; gift=小花花,scope=day". Only gift is mandatory,
+// metric defaults to count, scope to session and top to REPORT_TOP_N.
+func ParseLeaderboardSpecs(value string) ([]*LeaderboardSpec, error) {
+	var specs []*LeaderboardSpec
+	// Boards of the same gift, metric and scope would share their scores in the store
+	defined := make(map[string]bool)
+	for def := range strings.SplitSeq(value, ";") {
+		def = strings.TrimSpace(def)
+		if def == "" {
+			continue
+		}
+
+		spec := &LeaderboardSpec{
+			Metric: LeaderboardMetricCount,
+			Scope:  LeaderboardScopeSession,
+			TopN:   REPORT_TOP_N,
+		}
+		for field := range strings.SplitSeq(def, ",") {
+			key, val, ok := strings.Cut(field, "=")
+			key, val = strings.TrimSpace(key), strings.TrimSpace(val)
+			if !ok || val == "" {
+				return nil, fmt.Errorf("排行榜配置 %q 格式错误, 应为 key=value", field)
+			}
+
+			switch key {
+			case "gift":
+				spec.Gift = val
+			case "metric":
+				spec.Metric = LeaderboardMetric(val)
+				if !slices.Contains([]LeaderboardMetric{LeaderboardMetricCount, LeaderboardMetricValue, LeaderboardMetricProfit}, spec.Metric) {
+					return nil, fmt.Errorf("未知的排行榜指标 %s, 可选 count, value, profit", val)
+				}
+			case "scope":
+				spec.Scope = LeaderboardScope(val)
+				if !slices.Contains([]LeaderboardScope{LeaderboardScopeSession, LeaderboardScopeDay, LeaderboardScopeAll}, spec.Scope) {
+					return nil, fmt.Errorf("未知的排行榜范围 %s, 可选 session, day, all", val)
+				}
+			case "top":
+				n, err := strconv.Atoi(val)
+				if err != nil || n <= 0 {
+					return nil, fmt.Errorf("排行榜人数 %s 必须是正整数", val)
+				}
+				spec.TopN = n
+			case "title":
+				spec.Title = val
+			case "unit":
+				spec.Unit = val
+			default:
+				return nil, fmt.Errorf("未知的排行榜配置项 %s, 可选 gift, metric, scope, top, title, unit", key)
+			}
+		}
+
+		if spec.Gift == "" {
+			return nil, fmt.Errorf("排行榜配置 %q 缺少 gift", def)
+		}
+		if strings.Contains(spec.Gift, "/") {
+			return nil, fmt.Errorf("礼物名 %s 不能包含 /", spec.Gift)
+		}
+		key := spec.ID() + "/" + string(spec.Scope)
+		if defined[key] {
+			return nil, fmt.Errorf("排行榜配置 %q 与之前的排行榜重复, 礼物, 指标和范围相同", def)
+		}
+		defined[key] = true
+		specs = append(specs, spec)
+	}
+
+	return specs, nil
+}
+
+// A gift leaderboard and the scores of its current period, owned by the event loop
+type leaderboard struct {
+	spec   *LeaderboardSpec
+	period string
+	scores map[int64]int64
+}
+
+// Period the scores of the leaderboard accumulate in at the given time
+func (b *Boxtroll) leaderboardPeriod(spec *LeaderboardSpec, now time.Time) string {
+	switch spec.Scope {
+	case LeaderboardScopeSession:
+		if b.session == nil {
+			return "session/0"
+		}
+		return fmt.Sprintf("session/%d", b.session.ID)
+	case LeaderboardScopeDay:
+		return "day/" + now.Format(time.DateOnly)
+	default:
+		return "all"
+	}
+}
+
+// Move the leaderboard to the current period, loading its scores from the store if the period changed,
+// e.g., a new live session started or the day is over.
+func (b *Boxtroll) syncLeaderboard(ctx context.Context, board *leaderboard, now time.Time) {
+	period := b.leaderboardPeriod(board.spec, now)
+	if board.scores != nil && board.period == period {
+		return
+	}
+
+	scores, err := b.db.ListLeaderboardScores(ctx, b.roomID, board.spec.ID(), period)
+	if err != nil {
+		// Retried on the next gift or report, the scores of the previous period must not be added to
+		log.Err(err).Str("board", board.spec.ID()).Str("period", period).Msg("无法读取排行榜")
+		board.scores = nil
+		return
+	}
+
+	board.period = period
+	board.scores = make(map[int64]int64, len(scores))
+	for _, score := range scores {
+		board.scores[score.UID] = score.Value
+	}
+}
+
+// Score a gift message on every matching leaderboard. The scores are persisted at once, and
+// messages delivered more than once are scored only once.
+func (b *Boxtroll) scoreLeaderboards(ctx context.Context, sendGift *live.SendGiftMessage) {
+	now := time.Now()
+
+	var matched []*leaderboard
+	var scores []*store.LeaderboardScore
+	for _, board := range b.leaderboards {
+		if !board.spec.matches(sendGift) {
+			continue
+		}
+		b.syncLeaderboard(ctx, board, now)
+		if board.scores == nil {
+			continue
+		}
+		matched = append(matched, board)
+		scores = append(scores, &store.LeaderboardScore{
+			RoomID: b.roomID,
+			Board:  board.spec.ID(),
+			Period: board.period,
+			UID:    sendGift.UID,
+			Value:  board.spec.score(sendGift),
+		})
+	}
+	if len(scores) == 0 {
+		return
+	}
+
+	accepted, err := b.db.AddLeaderboardScores(ctx, sendGift.ID(), scores)
+	if err != nil {
+		// Still shown on the leaderboards until the period changes
+		log.Err(err).Int64("uid", sendGift.UID).Str("gift", sendGift.GiftName).Msg("无法保存排行榜")
+	} else if !accepted {
+		return
+	}
+
+	for i, board := range matched {
+		board.scores[sendGift.UID] += scores[i].Value
+	}
+
+	// Senders of blind boxes are created when their batch is flushed
+	if _, err := b.db.GetUser(ctx, sendGift.UID); errors.Is(err, store.ErrNotFound) && sendGift.BlindGift == nil {
+		b.createUserInBackground(ctx, sendGift.UID)
+	}
+}
+
+// Render the gift leaderboards of their current period
+func (b *Boxtroll) leaderboardBoards(ctx context.Context, gifts map[int64]*store.Gift) []*overlay.Board {
+	now := time.Now()
+
+	boards := make([]*overlay.Board, 0, len(b.leaderboards))
+	for _, board := range b.leaderboards {
+		b.syncLeaderboard(ctx, board, now)
+		boards = append(boards, b.leaderboardBoard(ctx, board, gifts))
+	}
+	return boards
+}
+
+func (b *Boxtroll) leaderboardBoard(ctx context.Context, board *leaderboard, gifts map[int64]*store.Gift) *overlay.Board {
+	spec := board.spec
+
+	var boardGifts []*overlay.Gift
+	for _, gift := range gifts {
+		if gift.Name == spec.Gift || strconv.FormatInt(gift.GiftID, 10) == spec.Gift {
+			boardGifts = append(boardGifts, &overlay.Gift{GiftID: gift.GiftID, Name: gift.Name, ImgURL: gift.ImgURL})
+			break
+		}
+	}
+
+	var entries []*overlay.Entry
+	for uid, value := range board.scores {
+		user, err := b.db.GetUser(ctx, uid)
+		if err != nil {
+			// The user is created in the background, try again in the next report
+			log.Debug().Err(err).Int64("uid", uid).Msg("未知的用户")
+			continue
+		}
+
+		display := fmt.Sprintf("%d %s", value, spec.unit())
+		if spec.Metric != LeaderboardMetricCount {
+			// Prices are in the unit of gift prices
+			value /= 100
+			display = fmt.Sprintf("%d %s", value, spec.unit())
+			if spec.Metric == LeaderboardMetricProfit {
+				display = fmt.Sprintf("%s %s", signed(value), spec.unit())
+			}
+		}
+		entries = append(entries, &overlay.Entry{
+			UID:     uid,
+			Name:    user.Name,
+			Face:    user.Face,
+			Value:   value,
+			Display: display,
+			Gifts:   boardGifts,
+		})
+	}
+
+	// Sort descending, ties by UID to keep the board stable
+	slices.SortFunc(entries, func(a *overlay.Entry, b *overlay.Entry) int {
+		if a.Value != b.Value {
+			return int(b.Value - a.Value)
+		}
+		return int(a.UID - b.UID)
+	})
+	if len(entries) > spec.TopN {
+		entries = entries[:spec.TopN]
+	}
+
+	return &overlay.Board{
+		Title:   spec.title(),
+		Entries: entries,
+		Size:    spec.TopN,
+	}
+}
+
+func newLeaderboards(specs []*LeaderboardSpec) []*leaderboard {
+	leaderboards := make([]*leaderboard, 0, len(specs))
+	for _, spec := range specs {
+		leaderboards = append(leaderboards, &leaderboard{spec: spec})
+	}
+	return leaderboards
+}
@@ -0,0 +1,93 @@
+package boxtroll
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLeaderboardSpecs(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		expected []*LeaderboardSpec
+	}{
+		{
+			name:  "default",
+			value: DEFAULT_LEADERBOARDS,
+			expected: []*LeaderboardSpec{
+				{Gift: "电影票", Metric: LeaderboardMetricCount, Scope: LeaderboardScopeSession, TopN: 5, Unit: "张"},
+			},
+		},
+		{
+			name:  "only gift",
+			value: "gift=小花花",
+			expected: []*LeaderboardSpec{
+				{Gift: "小花花", Metric: LeaderboardMetricCount, Scope: LeaderboardScopeSession, TopN: REPORT_TOP_N},
+			},
+		},
+		{
+			name:  "every field",
+			value: " gift = 32251 , metric=profit, scope=all, top=10, title=盲盒赢家, unit=元 ",
+			expected: []*LeaderboardSpec{
+				{Gift: "32251", Metric: LeaderboardMetricProfit, Scope: LeaderboardScopeAll, TopN: 10, Title: "盲盒赢家", Unit: "元"},
+			},
+		},
+		{
+			name:  "several boards",
+			value: "gift=电影票,metric=value; ; gift=小花花,scope=day;",
+			expected: []*LeaderboardSpec{
+				{Gift: "电影票", Metric: LeaderboardMetricValue, Scope: LeaderboardScopeSession, TopN: REPORT_TOP_N},
+				{Gift: "小花花", Metric: LeaderboardMetricCount, Scope: LeaderboardScopeDay, TopN: REPORT_TOP_N},
+			},
+		},
+		{
+			name:  "same gift and metric in another scope",
+			value: "gift=电影票; gift=电影票,scope=day",
+			expected: []*LeaderboardSpec{
+				{Gift: "电影票", Metric: LeaderboardMetricCount, Scope: LeaderboardScopeSession, TopN: REPORT_TOP_N},
+				{Gift: "电影票", Metric: LeaderboardMetricCount, Scope: LeaderboardScopeDay, TopN: REPORT_TOP_N},
+			},
+		},
+		{
+			name:     "empty",
+			value:    " ; ",
+			expected: nil,
+		},
+	}
+
+	for _, test := range tests {
+		specs, err := ParseLeaderboardSpecs(test.value)
+		if err != nil {
+			t.Fatalf("%s: failed to parse %q: %v", test.name, test.value, err)
+		}
+		if !reflect.DeepEqual(specs, test.expected) {
+			t.Fatalf("%s: expected %+v, got %+v", test.name, test.expected, specs)
+		}
+	}
+
+	errorTests := []struct {
+		name  string
+		value string
+	}{
+		{"missing gift", "metric=count"},
+		{"missing value", "gift=电影票,top="},
+		{"missing equals", "gift=电影票,top"},
+		{"unknown metric", "gift=电影票,metric=sum"},
+		{"unknown scope", "gift=电影票,scope=week"},
+		{"zero top", "gift=电影票,top=0"},
+		{"negative top", "gift=电影票,top=-1"},
+		{"non-numeric top", "gift=电影票,top=five"},
+		{"unknown key", "gift=电影票,color=red"},
+		{"slash in gift", "gift=电影/票"},
+		{"error in a later board", "gift=电影票; gift=小花花,scope=month"},
+		// Both would add to the same scores in the store
+		{"duplicated board", "gift=电影票; gift=电影票"},
+		{"same board with another title", "gift=电影票,metric=count; gift=电影票,title=电影票之王"},
+	}
+
+	for _, test := range errorTests {
+		if _, err := ParseLeaderboardSpecs(test.value); err == nil {
+			t.Fatalf("%s: expected error for %q, got nil", test.name, test.value)
+		}
+	}
+}
@@ -3,9 +3,9 @@ package boxtroll
 import (
 	"context"
 	"fmt"
-	"slices"
 	"strings"
 
+	"github.com/YangchenYe323/boxtroll/internal/overlay"
 	"github.com/andreykaipov/goobs"
 	"github.com/andreykaipov/goobs/api/requests/inputs"
 	"github.com/rs/zerolog/log"
@@ -57,8 +57,6 @@ func (b *Boxtroll) initializeOBS(ctx context.Context) error {
 	// Create a text source for showing:
 	// - 本场直播盲盒盈亏排行榜
 	// - to be added
-	b.sourceName = OBS_SOURCE_NAME
-
 	sceneItemEnabled := true
 	createReq := &inputs.CreateInputParams{
 		SceneName: &b.sceneName,
@@ -83,7 +81,7 @@ func (b *Boxtroll) initializeOBS(ctx context.Context) error {
 	if err != nil {
 		// 601 - Resource already exists
 		if strings.Contains(err.Error(), "601") {
-			log.Info().Msg("文本输入源已存在，跳过创建")
+			log.Info().Str("source.name", b.sourceName).Msg("文本输入源已存在，跳过创建")
 		} else {
 			return fmt.Errorf("无法创建文本输入源: %w", err)
 		}
@@ -93,7 +91,8 @@ func (b *Boxtroll) initializeOBS(ctx context.Context) error {
 	return nil
 }
 
-func (b *Boxtroll) updateOBS(ctx context.Context) {
+// Show the next page of the report in the OBS text source.
+func (b *Boxtroll) updateOBS(report *overlay.Report) {
 	var err error
 
 	if b.reconnect {
@@ -106,22 +105,21 @@ func (b *Boxtroll) updateOBS(ctx context.Context) {
 		b.reconnect = false
 	}
 
-	var report string
-	if b.reportIdx%2 == 0 {
-		report = b.boxRankReport(ctx)
-	} else {
-		report = b.ticketRankReport(ctx)
-	}
+	// Rotate through the leaderboards two at a time: the box leaderboards, the gift leaderboards,
+	// the return-to-player and the revenue leaderboards
+	pages := (len(report.Boards) + 1) / 2
+	start := int(b.reportIdx%int64(pages)) * 2
+	text := renderBoards(report.Boards[start:min(start+2, len(report.Boards))]...)
 	b.reportIdx++
 
-	if report == "" {
+	if text == "" {
 		return
 	}
 
 	updateReq := &inputs.SetInputSettingsParams{
 		InputName: &b.sourceName,
 		InputSettings: map[string]interface{}{
-			"text": report,
+			"text": text,
 		},
 	}
 
@@ -135,133 +133,3 @@ func (b *Boxtroll) updateOBS(ctx context.Context) {
 		log.Err(err).Msg("无法更新OBS文本输入源")
 	}
 }
-
-func (b *Boxtroll) ticketRankReport(ctx context.Context) string {
-	type userTicketReport struct {
-		uid       int64
-		name      string
-		ticketNum int64
-	}
-
-	var topFiveTicketUsers []*userTicketReport
-	for uid, ticketNum := range b.curTicketNum {
-		user, err := b.db.GetUser(ctx, uid)
-		if err != nil {
-			// Should not happen but don't panic
-			log.Warn().Err(err).Int64("uid", uid).Msg("未知的盲盒用户")
-			continue
-		}
-		topFiveTicketUsers = append(topFiveTicketUsers, &userTicketReport{
-			uid:       uid,
-			name:      user.Name,
-			ticketNum: ticketNum,
-		})
-	}
-
-	// Sort descending
-	slices.SortFunc(topFiveTicketUsers, func(a *userTicketReport, b *userTicketReport) int {
-		return int(b.ticketNum - a.ticketNum)
-	})
-	if len(topFiveTicketUsers) > 5 {
-		topFiveTicketUsers = topFiveTicketUsers[:5]
-	}
-
-	var sb strings.Builder
-
-	sb.WriteString("本场电影票排行榜: \n")
-	for i := range 5 {
-		sb.WriteString(fmt.Sprintf("%d. ", i+1))
-		if i < len(topFiveTicketUsers) {
-			sb.WriteString(fmt.Sprintf("%s: %d 张\n", topFiveTicketUsers[i].name, topFiveTicketUsers[i].ticketNum))
-		} else {
-			sb.WriteString("暂无~\n")
-		}
-	}
-
-	return sb.String()
-}
-
-func (b *Boxtroll) boxRankReport(ctx context.Context) string {
-	type userAggregateReport struct {
-		uid         int64
-		name        string
-		diffBattery int64
-	}
-
-	type report struct {
-		topFiveLuckyUsers   []*userAggregateReport
-		topFiveUnluckyUsers []*userAggregateReport
-	}
-
-	var reports report
-
-	for uid, boxIDMap := range b.curStreamSt {
-		user, err := b.db.GetUser(ctx, uid)
-		if err != nil {
-			// Should not happen but don't panic
-			log.Warn().Err(err).Int64("uid", uid).Msg("未知的盲盒用户")
-			continue
-		}
-
-		diff := int64(0)
-		for _, st := range boxIDMap {
-			diff += st.TotalPrice - st.TotalOriginalPrice
-		}
-
-		diffBattery := diff / 100
-
-		if diffBattery > 0 {
-			reports.topFiveLuckyUsers = append(reports.topFiveLuckyUsers, &userAggregateReport{
-				uid:         uid,
-				name:        user.Name,
-				diffBattery: diffBattery,
-			})
-		} else if diffBattery < 0 {
-			reports.topFiveUnluckyUsers = append(reports.topFiveUnluckyUsers, &userAggregateReport{
-				uid:         uid,
-				name:        user.Name,
-				diffBattery: diffBattery,
-			})
-		}
-	}
-
-	// Sort in descending
-	slices.SortFunc(reports.topFiveLuckyUsers, func(a *userAggregateReport, b *userAggregateReport) int {
-		return int(b.diffBattery - a.diffBattery)
-	})
-	// Sort in ascending
-	slices.SortFunc(reports.topFiveUnluckyUsers, func(a *userAggregateReport, b *userAggregateReport) int {
-		return int(a.diffBattery - b.diffBattery)
-	})
-
-	if len(reports.topFiveLuckyUsers) > 5 {
-		reports.topFiveLuckyUsers = reports.topFiveLuckyUsers[:5]
-	}
-	if len(reports.topFiveUnluckyUsers) > 5 {
-		reports.topFiveUnluckyUsers = reports.topFiveUnluckyUsers[:5]
-	}
-
-	var sb strings.Builder
-
-	sb.WriteString("本场盲盒幸运儿排行榜: \n")
-	for i := range 5 {
-		sb.WriteString(fmt.Sprintf("%d. ", i+1))
-		if i < len(reports.topFiveLuckyUsers) {
-			sb.WriteString(fmt.Sprintf("%s: +%d 电池\n", reports.topFiveLuckyUsers[i].name, reports.topFiveLuckyUsers[i].diffBattery))
-		} else {
-			sb.WriteString("暂无~\n")
-		}
-	}
-
-	sb.WriteString("本场盲盒倒霉蛋排行榜: \n")
-	for i := range 5 {
-		sb.WriteString(fmt.Sprintf("%d. ", i+1))
-		if i < len(reports.topFiveUnluckyUsers) {
-			sb.WriteString(fmt.Sprintf("%s: %d 电池\n", reports.topFiveUnluckyUsers[i].name, reports.topFiveUnluckyUsers[i].diffBattery))
-		} else {
-			sb.WriteString("暂无~\n")
-		}
-	}
-
-	return sb.String()
-}
@@ -0,0 +1,142 @@
+package boxtroll
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/YangchenYe323/boxtroll/internal/live"
+	"github.com/YangchenYe323/boxtroll/internal/store"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// Minimal interval between two queries of the same user
+	QUERY_COOLDOWN = time.Minute
+)
+
+// Chat commands that trigger a blind-box history query
+var queryCommands = []string{"盲盒查询", "!box", "！box"}
+
+func isQueryCommand(text string) bool {
+	return slices.Contains(queryCommands, strings.ToLower(strings.TrimSpace(text)))
+}
+
+// Statistics of a single box type for a query reply
+type boxQuery struct {
+	boxID     int64
+	boxName   string
+	streamSt  store.BoxStatistics // This stream
+	pendingSt store.BoxStatistics // Not yet flushed to the store
+}
+
+func (b *Boxtroll) handleDanmaku(ctx context.Context, danmaku *live.DanmakuMessage) {
+	if danmaku.Emoticon || !isQueryCommand(danmaku.Text) {
+		return
+	}
+
+	if last, ok := b.queryCooldown[danmaku.UID]; ok && time.Since(last) < QUERY_COOLDOWN {
+		log.Debug().Int64("uid", danmaku.UID).Str("uname", danmaku.UName).Msg("盲盒查询冷却中, 忽略")
+		return
+	}
+	b.queryCooldown[danmaku.UID] = time.Now()
+
+	log.Info().Int64("uid", danmaku.UID).Str("uname", danmaku.UName).Msg("收到盲盒查询")
+
+	// Reads are served from the boxtrollStore cache, so it is fine to build the reply on the
+	// event loop. This also guarantees the pending batch is not flushed in between.
+	msgs, err := b.queryReply(ctx, danmaku.UID)
+	if err != nil {
+		log.Err(err).Int64("uid", danmaku.UID).Msg("无法获取用户盲盒统计")
+		return
+	}
+
+	b.sendInBackground(func(ctx context.Context) {
+		b.sendQueryReply(ctx, danmaku.UID, msgs)
+	})
+}
+
+// Build the reply to a blind-box history query of the given user, one message per box type.
+func (b *Boxtroll) queryReply(ctx context.Context, uid int64) ([]string, error) {
+	queries := make(map[int64]*boxQuery)
+	query := func(boxID int64, boxName string) *boxQuery {
+		if _, ok := queries[boxID]; !ok {
+			queries[boxID] = &boxQuery{boxID: boxID}
+		}
+		if queries[boxID].boxName == "" {
+			queries[boxID].boxName = boxName
+		}
+		return queries[boxID]
+	}
+	for boxID, st := range b.curStreamSt[uid] {
+		query(boxID, b.boxNames[boxID]).streamSt = *st
+	}
+	for boxID, st := range b.curBatch[uid] {
+		query(boxID, b.boxNames[boxID]).pendingSt = *st
+	}
+
+	// Blind boxes this user has sent in earlier streams are only known to the store
+	room, err := b.db.GetRoom(ctx, b.roomID)
+	if err != nil {
+		return nil, err
+	}
+	for _, gift := range room.Gifts {
+		if len(gift.BlindBoxOutcomes) > 0 {
+			query(gift.GiftID, gift.Name)
+		}
+	}
+
+	var entries []*finishedBatch
+	var transfers []store.BoxStatisticsTransfer
+	for _, query := range queries {
+		entry := &finishedBatch{
+			key:     b.db.BoxStatisticsKey(b.roomID, uid, query.boxID),
+			uid:     uid,
+			boxID:   query.boxID,
+			boxName: query.boxName,
+			st:      query.streamSt,
+		}
+		entries = append(entries, entry)
+		transfers = append(transfers, entry)
+	}
+
+	if err := b.db.GetBoxStatistics(ctx, transfers, store.NotFoundBehaviorSkip); err != nil {
+		return nil, err
+	}
+
+	var msgs []string
+	for _, entry := range entries {
+		entry.accumSt.Merge(queries[entry.boxID].pendingSt)
+		if entry.accumSt.TotalNum == 0 {
+			continue
+		}
+
+		streamDiff := (entry.st.TotalPrice - entry.st.TotalOriginalPrice) / 100
+		accumDiff := (entry.accumSt.TotalPrice - entry.accumSt.TotalOriginalPrice) / 100
+		msgs = append(msgs, fmt.Sprintf("%s 本场%s 历史%s电池", entry.boxName, signed(streamDiff), signed(accumDiff)))
+	}
+
+	if len(msgs) == 0 {
+		msgs = append(msgs, "还没有投喂过盲盒哦~")
+	}
+	slices.Sort(msgs)
+
+	return msgs, nil
+}
+
+func (b *Boxtroll) sendQueryReply(ctx context.Context, uid int64, msgs []string) {
+	for _, msg := range msgs {
+		if err := b.danmaku.Send(ctx, b.roomID, msg, uid); err != nil {
+			log.Err(err).Str("danmaku", msg).Msg("发送弹幕失败")
+		}
+	}
+}
+
+func signed(n int64) string {
+	if n >= 0 {
+		return fmt.Sprintf("+%d", n)
+	}
+	return fmt.Sprintf("%d", n)
+}
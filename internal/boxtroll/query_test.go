@@ -0,0 +1,110 @@
+package boxtroll
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/YangchenYe323/boxtroll/internal/live"
+	"github.com/YangchenYe323/boxtroll/internal/store"
+)
+
+func TestIsQueryCommand(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected bool
+	}{
+		{"盲盒查询", true},
+		{"!box", true},
+		{"！box", true},
+		{" !BOX ", true},
+		{"！Box", true},
+		{"盲盒", false},
+		{"!boxes", false},
+		{"查询 盲盒查询", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if actual := isQueryCommand(test.text); actual != test.expected {
+			t.Fatalf("expected %v for %q, got %v", test.expected, test.text, actual)
+		}
+	}
+}
+
+func TestQueryCooldown(t *testing.T) {
+	b, _, sender := newTestBoxtroll(t)
+	ctx := context.Background()
+
+	query := func(uid int64, text string, emoticon bool) []string {
+		t.Helper()
+		before := len(sender.sent())
+		b.handleDanmaku(ctx, &live.DanmakuMessage{UID: uid, Text: text, Emoticon: emoticon})
+		b.danmakuWg.Wait()
+		return sender.sent()[before:]
+	}
+
+	if replies := query(12345678, "!box", true); len(replies) != 0 {
+		t.Fatalf("expected no reply to an emoticon, got %v", replies)
+	}
+	if replies := query(12345678, "你好", false); len(replies) != 0 {
+		t.Fatalf("expected no reply to plain chat, got %v", replies)
+	}
+	if replies := query(12345678, "盲盒查询", false); !slices.Equal(replies, []string{"还没有投喂过盲盒哦~"}) {
+		t.Fatalf("expected a reply to the first query, got %v", replies)
+	}
+	if replies := query(12345678, "！box", false); len(replies) != 0 {
+		t.Fatalf("expected the second query within the cooldown to be ignored, got %v", replies)
+	}
+	if replies := query(87654321, "!box", false); len(replies) != 1 {
+		t.Fatalf("expected the cooldown to be per user, got %v", replies)
+	}
+
+	b.queryCooldown[12345678] = time.Now().Add(-QUERY_COOLDOWN)
+	if replies := query(12345678, "!box", false); len(replies) != 1 {
+		t.Fatalf("expected a reply once the cooldown is over, got %v", replies)
+	}
+}
+
+// The reply adds up the statistics in the store, the pending batch and this stream.
+func TestQueryReply(t *testing.T) {
+	b, db, _ := newTestBoxtroll(t)
+	ctx := context.Background()
+
+	// Flushed earlier: 10 boxes for 120 电池 worth 150 电池, i.e., -30 电池
+	earlier := &finishedBatch{
+		key:     db.BoxStatisticsKey(testRoomID, 12345678, testBox.GiftID),
+		accumSt: store.BoxStatistics{TotalNum: 10, TotalOriginalPrice: 15000, TotalPrice: 12000, LastUpdateTime: time.Now()},
+	}
+	if err := b.db.SetBoxStatistics(ctx, []store.BoxStatisticsTransfer{earlier}); err != nil {
+		t.Fatalf("failed to set box statistics: %v", err)
+	}
+
+	// This stream: one box flushed and one pending, both 告白气球, i.e., +35 电池 each
+	b.handleSendGift(ctx, testBoxGift("1", 12345678, testBox.BlindBoxOutcomes[0]))
+	if err := b.flushBatch(ctx, true); err != nil {
+		t.Fatalf("failed to flush batch: %v", err)
+	}
+	b.handleSendGift(ctx, testBoxGift("2", 12345678, testBox.BlindBoxOutcomes[0]))
+	if b.curBatch[12345678][testBox.GiftID].TotalNum != 1 {
+		t.Fatalf("expected 1 pending box, got %+v", b.curBatch[12345678][testBox.GiftID])
+	}
+
+	msgs, err := b.queryReply(ctx, 12345678)
+	if err != nil {
+		t.Fatalf("failed to build query reply: %v", err)
+	}
+	expected := []string{"心动盲盒 本场+70 历史+40电池"}
+	if !slices.Equal(msgs, expected) {
+		t.Fatalf("expected %v, got %v", expected, msgs)
+	}
+
+	// Only the store knows the history of the other user
+	msgs, err = b.queryReply(ctx, 87654321)
+	if err != nil {
+		t.Fatalf("failed to build query reply: %v", err)
+	}
+	if !slices.Equal(msgs, []string{"还没有投喂过盲盒哦~"}) {
+		t.Fatalf("expected no boxes for 87654321, got %v", msgs)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/YangchenYe323/boxtroll/internal/bilibili"
 	"github.com/YangchenYe323/boxtroll/internal/store"
@@ -57,6 +58,21 @@ func refreshAllUsers(ctx context.Context, s store.Store, roomID int64) error {
 
 func refreshRoom(ctx context.Context, s store.Store, roomID int64) (*store.Room, error) {
 	log.Info().Str("room_id", strconv.FormatInt(roomID, 10)).Msg("获取最新直播间信息...")
+
+	room, err := fetchRoom(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.SetRoom(ctx, roomID, room); err != nil {
+		return nil, fmt.Errorf("无法保存直播间信息: %w", err)
+	}
+
+	return room, nil
+}
+
+// Fetch the gift catalogue of the room, including the outcomes of every blind box.
+func fetchRoom(ctx context.Context, roomID int64) (*store.Room, error) {
 	log.Info().Str("room_id", strconv.FormatInt(roomID, 10)).Msg("获取最新直播间礼物配置...")
 
 	var room = store.Room{
@@ -99,9 +115,170 @@ func refreshRoom(ctx context.Context, s store.Store, roomID int64) (*store.Room,
 		room.Gifts = append(room.Gifts, g)
 	}
 
-	if err := s.SetRoom(ctx, roomID, &room); err != nil {
-		return nil, fmt.Errorf("无法保存直播间信息: %w", err)
+	return &room, nil
+}
+
+// Request a refresh of the gift catalogue from the event loop, e.g., when an unknown blind box is drawn.
+// Requests made while one is pending are coalesced.
+func (b *Boxtroll) requestRoomRefresh() {
+	select {
+	case b.roomRefresh <- struct{}{}:
+	default:
 	}
+}
 
-	return &room, nil
+// Refresh the gift catalogue periodically and on request until ctx is cancelled. Requests are
+// served at most once every ROOM_REFRESH_MIN_INTERVAL so that a burst of unknown boxes does
+// not flood the API.
+func (b *Boxtroll) refreshRoomLoop(ctx context.Context) {
+	var ticker *time.Ticker
+	if b.roomRefreshInterval > 0 {
+		ticker = time.NewTicker(b.roomRefreshInterval)
+	} else {
+		ticker = time.NewTicker(time.Hour * 9999)
+		ticker.Stop()
+	}
+	defer ticker.Stop()
+
+	var lastRefresh time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-b.roomRefresh:
+			if wait := ROOM_REFRESH_MIN_INTERVAL - time.Since(lastRefresh); wait > 0 {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(wait):
+				}
+			}
+		}
+
+		lastRefresh = time.Now()
+		if err := b.refreshRoomCatalogue(ctx); err != nil && ctx.Err() == nil {
+			log.Err(err).Int64("room", b.roomID).Msg("无法刷新直播间礼物配置, 稍后重试")
+		}
+	}
+}
+
+// Fetch the gift catalogue and replace the cached room if anything changed.
+func (b *Boxtroll) refreshRoomCatalogue(ctx context.Context) error {
+	room, err := fetchRoom(ctx, b.roomID)
+	if err != nil {
+		return err
+	}
+
+	old, err := b.db.GetRoom(ctx, b.roomID)
+	if err != nil {
+		return fmt.Errorf("无法读取直播间信息: %w", err)
+	}
+
+	if !logRoomDiff(old, room) {
+		log.Debug().Int64("room", b.roomID).Msg("直播间礼物配置没有变化")
+		return nil
+	}
+
+	if err := b.db.SetRoom(ctx, b.roomID, room); err != nil {
+		return fmt.Errorf("无法保存直播间信息: %w", err)
+	}
+
+	log.Info().Int64("room", b.roomID).Int("gifts", len(room.Gifts)).Msg("直播间礼物配置已更新")
+	return nil
+}
+
+// Log the differences between two gift catalogues of a room. Returns whether there is any.
+func logRoomDiff(old *store.Room, room *store.Room) bool {
+	oldGifts := make(map[int64]*store.Gift, len(old.Gifts))
+	for _, gift := range old.Gifts {
+		oldGifts[gift.GiftID] = gift
+	}
+	newGifts := make(map[int64]*store.Gift, len(room.Gifts))
+	for _, gift := range room.Gifts {
+		newGifts[gift.GiftID] = gift
+	}
+
+	changed := false
+	for _, gift := range room.Gifts {
+		oldGift, ok := oldGifts[gift.GiftID]
+		if !ok {
+			log.Info().Int64("room", room.RoomID).Int64("id", gift.GiftID).Str("name", gift.Name).Int64("price", gift.Price).
+				Int("outcomes", len(gift.BlindBoxOutcomes)).Msg("新增礼物")
+			changed = true
+			continue
+		}
+
+		if oldGift.Name != gift.Name || oldGift.Price != gift.Price || oldGift.CoinType != gift.CoinType || oldGift.ImgURL != gift.ImgURL {
+			log.Info().Int64("room", room.RoomID).Int64("id", gift.GiftID).
+				Str("old_name", oldGift.Name).Str("name", gift.Name).
+				Int64("old_price", oldGift.Price).Int64("price", gift.Price).Msg("礼物信息变化")
+			changed = true
+		}
+		if logOutcomesDiff(room.RoomID, gift, oldGift.BlindBoxOutcomes, gift.BlindBoxOutcomes) {
+			changed = true
+		}
+	}
+
+	for _, gift := range old.Gifts {
+		if _, ok := newGifts[gift.GiftID]; !ok {
+			log.Info().Int64("room", room.RoomID).Int64("id", gift.GiftID).Str("name", gift.Name).Msg("礼物已下架")
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+// Log the differences between two outcome lists of a blind box. Returns whether there is any.
+func logOutcomesDiff(roomID int64, box *store.Gift, old []store.BlindBoxOutcome, outcomes []store.BlindBoxOutcome) bool {
+	oldOutcomes := make(map[int64]store.BlindBoxOutcome, len(old))
+	for _, outcome := range old {
+		oldOutcomes[outcome.GiftID] = outcome
+	}
+	newOutcomes := make(map[int64]struct{}, len(outcomes))
+
+	changed := len(old) != len(outcomes)
+	for i, outcome := range outcomes {
+		newOutcomes[outcome.GiftID] = struct{}{}
+
+		oldOutcome, ok := oldOutcomes[outcome.GiftID]
+		switch {
+		case !ok:
+			log.Info().Int64("room", roomID).Str("box", box.Name).Int64("id", outcome.GiftID).Str("name", outcome.Name).
+				Int64("price", outcome.Price).Str("chance", outcome.Chance).Msg("盲盒新增爆出礼物")
+			changed = true
+		case oldOutcome != outcome:
+			log.Info().Int64("room", roomID).Str("box", box.Name).Int64("id", outcome.GiftID).Str("name", outcome.Name).
+				Int64("old_price", oldOutcome.Price).Int64("price", outcome.Price).
+				Str("old_chance", oldOutcome.Chance).Str("chance", outcome.Chance).Msg("盲盒爆出礼物变化")
+			changed = true
+		case i < len(old) && old[i].GiftID != outcome.GiftID:
+			// Reordered only
+			changed = true
+		}
+	}
+
+	for _, outcome := range old {
+		if _, ok := newOutcomes[outcome.GiftID]; !ok {
+			log.Info().Int64("room", roomID).Str("box", box.Name).Int64("id", outcome.GiftID).Str("name", outcome.Name).Msg("盲盒移除爆出礼物")
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+// Whether the box is in the gift catalogue of the room with its outcomes.
+func (b *Boxtroll) isKnownBox(ctx context.Context, boxID int64) bool {
+	room, err := b.db.GetRoom(ctx, b.roomID)
+	if err != nil {
+		return false
+	}
+	for _, gift := range room.Gifts {
+		if gift.GiftID == boxID {
+			return len(gift.BlindBoxOutcomes) > 0
+		}
+	}
+	return false
 }
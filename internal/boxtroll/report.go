@@ -0,0 +1,202 @@
+package boxtroll
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/YangchenYe323/boxtroll/internal/analytics"
+	"github.com/YangchenYe323/boxtroll/internal/overlay"
+	"github.com/YangchenYe323/boxtroll/internal/store"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// Number of users shown on each leaderboard
+	REPORT_TOP_N = 5
+)
+
+// Build the leaderboards of the current live stream. The same report powers both the OBS
+// text source and the browser-source overlay.
+func (b *Boxtroll) buildReport(ctx context.Context) *overlay.Report {
+	gifts := make(map[int64]*store.Gift)
+	room, err := b.db.GetRoom(ctx, b.roomID)
+	if err != nil {
+		log.Warn().Err(err).Msg("无法获取直播间礼物信息")
+		room = &store.Room{RoomID: b.roomID}
+	} else {
+		for _, gift := range room.Gifts {
+			gifts[gift.GiftID] = gift
+		}
+	}
+
+	lucky, unlucky := b.boxRankBoards(ctx, gifts, b.boxModels(ctx))
+
+	boards := []*overlay.Board{lucky, unlucky}
+	boards = append(boards, b.leaderboardBoards(ctx, gifts)...)
+	boards = append(boards,
+		b.rtpBoard(ctx, room),
+		b.revenueRankBoard(ctx, store.RevenueKindGuard),
+		b.revenueRankBoard(ctx, store.RevenueKindSuperChat),
+	)
+
+	return &overlay.Report{
+		RoomID:     b.roomID,
+		UpdatedAt:  time.Now(),
+		Popularity: b.popularity,
+		Boards:     boards,
+	}
+}
+
+// Return-to-player of each blind box drawn in the room, across all streams and users
+func (b *Boxtroll) rtpBoard(ctx context.Context, room *store.Room) *overlay.Board {
+	board := &overlay.Board{Title: "盲盒返还率"}
+
+	boxStatistics, err := analytics.RoomBoxStatistics(ctx, b.db, b.roomID)
+	if err != nil {
+		log.Warn().Err(err).Msg("无法获取直播间盲盒统计")
+		return board
+	}
+	// Not yet flushed to the store
+	for _, boxIDMap := range b.curBatch {
+		for boxID, st := range boxIDMap {
+			sum := boxStatistics[boxID]
+			sum.Merge(*st)
+			boxStatistics[boxID] = sum
+		}
+	}
+
+	for _, report := range analytics.AnalyzeRoom(room, boxStatistics) {
+		if report.TotalNum == 0 {
+			continue
+		}
+
+		var gifts []*overlay.Gift
+		for _, gift := range room.Gifts {
+			if gift.GiftID == report.BoxID {
+				gifts = append(gifts, &overlay.Gift{GiftID: gift.GiftID, Name: gift.Name, ImgURL: gift.ImgURL})
+			}
+		}
+
+		board.Entries = append(board.Entries, &overlay.Entry{
+			Name: report.Name,
+			// Colors the entry by the deviation from the expected value, in 电池
+			Value:   int64(float64(report.TotalPrice)-report.ExpectedPrice) / 100,
+			Display: fmt.Sprintf("%.1f%% (理论 %.1f%%, %s)", report.ObservedRTP*100, report.ExpectedRTP*100, report.Verdict.Label()),
+			Gifts:   gifts,
+		})
+	}
+
+	slices.SortFunc(board.Entries, func(a *overlay.Entry, b *overlay.Entry) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return board
+}
+
+// Return the lucky and unlucky leaderboards of the current live stream
+func (b *Boxtroll) boxRankBoards(ctx context.Context, gifts map[int64]*store.Gift, models map[int64]*analytics.BoxModel) (*overlay.Board, *overlay.Board) {
+	var luckyEntries, unluckyEntries []*overlay.Entry
+
+	for uid, boxIDMap := range b.curStreamSt {
+		user, err := b.db.GetUser(ctx, uid)
+		if err != nil {
+			// Should not happen but don't panic
+			log.Warn().Err(err).Int64("uid", uid).Msg("未知的盲盒用户")
+			continue
+		}
+
+		diff := int64(0)
+		var boxGifts []*overlay.Gift
+		// Luck is only known if the chances of every box are
+		var draws []analytics.Draw
+		var value int64
+		knownChances := true
+		for boxID, st := range boxIDMap {
+			diff += st.TotalPrice - st.TotalOriginalPrice
+			if gift, ok := gifts[boxID]; ok {
+				boxGifts = append(boxGifts, &overlay.Gift{GiftID: gift.GiftID, Name: gift.Name, ImgURL: gift.ImgURL})
+			}
+			if model, ok := models[boxID]; ok {
+				draws = append(draws, analytics.Draw{Model: model, Num: st.TotalNum})
+				value += st.TotalPrice
+			} else {
+				knownChances = false
+			}
+		}
+		slices.SortFunc(boxGifts, func(a *overlay.Gift, b *overlay.Gift) int {
+			return int(a.GiftID - b.GiftID)
+		})
+
+		diffBattery := diff / 100
+		entry := &overlay.Entry{
+			UID:     uid,
+			Name:    user.Name,
+			Face:    user.Face,
+			Value:   diffBattery,
+			Display: fmt.Sprintf("%s 电池", signed(diffBattery)),
+			Gifts:   boxGifts,
+		}
+		if knownChances {
+			if luck, ok := analytics.LuckOf(draws, value); ok {
+				entry.Luck = luck.String()
+			}
+		}
+
+		if diffBattery > 0 {
+			luckyEntries = append(luckyEntries, entry)
+		} else if diffBattery < 0 {
+			unluckyEntries = append(unluckyEntries, entry)
+		}
+	}
+
+	// Sort in descending
+	slices.SortFunc(luckyEntries, func(a *overlay.Entry, b *overlay.Entry) int {
+		return int(b.Value - a.Value)
+	})
+	// Sort in ascending
+	slices.SortFunc(unluckyEntries, func(a *overlay.Entry, b *overlay.Entry) int {
+		return int(a.Value - b.Value)
+	})
+
+	if len(luckyEntries) > REPORT_TOP_N {
+		luckyEntries = luckyEntries[:REPORT_TOP_N]
+	}
+	if len(unluckyEntries) > REPORT_TOP_N {
+		unluckyEntries = unluckyEntries[:REPORT_TOP_N]
+	}
+
+	lucky := &overlay.Board{
+		Title:   "本场盲盒幸运儿排行榜",
+		Entries: luckyEntries,
+		Size:    REPORT_TOP_N,
+	}
+	unlucky := &overlay.Board{
+		Title:   "本场盲盒倒霉蛋排行榜",
+		Entries: unluckyEntries,
+		Size:    REPORT_TOP_N,
+	}
+
+	return lucky, unlucky
+}
+
+// Render leaderboards as plain text for the OBS text source
+func renderBoards(boards ...*overlay.Board) string {
+	var sb strings.Builder
+
+	for _, board := range boards {
+		sb.WriteString(fmt.Sprintf("%s: \n", board.Title))
+		for i := range max(board.Size, len(board.Entries)) {
+			sb.WriteString(fmt.Sprintf("%d. ", i+1))
+			if i < len(board.Entries) {
+				sb.WriteString(fmt.Sprintf("%s: %s\n", board.Entries[i].Name, board.Entries[i].Display))
+			} else {
+				sb.WriteString("暂无~\n")
+			}
+		}
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,140 @@
+package boxtroll
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/YangchenYe323/boxtroll/internal/live"
+	"github.com/YangchenYe323/boxtroll/internal/overlay"
+	"github.com/YangchenYe323/boxtroll/internal/store"
+	"github.com/rs/zerolog/log"
+)
+
+func (b *Boxtroll) handleGuardBuy(ctx context.Context, guardBuy *live.GuardBuyMessage) {
+	b.acceptRevenue(ctx, &store.RevenueEvent{
+		ID:        guardBuy.ID(),
+		Timestamp: sentAt(guardBuy.StartTime),
+		RoomID:    b.roomID,
+		UID:       guardBuy.UID,
+		Kind:      store.RevenueKindGuard,
+		Name:      guardBuy.GiftName,
+		Num:       guardBuy.Num,
+		Price:     guardBuy.Price,
+	})
+}
+
+func (b *Boxtroll) handleSuperChat(ctx context.Context, superChat *live.SuperChatMessage) {
+	b.acceptRevenue(ctx, &store.RevenueEvent{
+		ID:        fmt.Sprintf("sc-%d", superChat.ID),
+		Timestamp: sentAt(superChat.StartTime),
+		RoomID:    b.roomID,
+		UID:       int64(superChat.UID),
+		Kind:      store.RevenueKindSuperChat,
+		Name:      "醒目留言",
+		Num:       1,
+		Price:     superChat.GoldPrice(),
+		Message:   superChat.Message,
+	})
+}
+
+// Persist a revenue event and add it to the current stream, unless it is a duplicate.
+func (b *Boxtroll) acceptRevenue(ctx context.Context, event *store.RevenueEvent) {
+	// A replayed event may belong to an earlier stream
+	earlier := b.session != nil && event.Timestamp.Before(b.session.StartTime)
+	if b.session != nil && !earlier {
+		event.SessionID = b.session.ID
+	}
+
+	accepted, err := b.db.AcceptRevenueEvent(ctx, event)
+	if err != nil {
+		// Still counted for the current stream
+		log.Err(err).Int64("uid", event.UID).Str("kind", string(event.Kind)).Msg("无法保存营收记录")
+	} else if !accepted {
+		log.Debug().Str("id", event.ID).Int64("uid", event.UID).Str("kind", string(event.Kind)).Msg("忽略重复的营收消息")
+		return
+	}
+
+	log.Info().Int64("uid", event.UID).Str("name", event.Name).Int64("num", event.Num).
+		Int64("price", event.TotalPrice()/100).Msgf("收到%s", event.Kind.Label())
+
+	b.createUserInBackground(ctx, event.UID)
+
+	if !earlier {
+		b.addRevenue(event)
+	}
+}
+
+func (b *Boxtroll) addRevenue(event *store.RevenueEvent) {
+	if _, ok := b.curRevenue[event.UID]; !ok {
+		b.curRevenue[event.UID] = make(map[store.RevenueKind]int64)
+	}
+	b.curRevenue[event.UID][event.Kind] += event.TotalPrice()
+}
+
+// Restore the revenue of the current session, e.g., after restarting mid-stream.
+func (b *Boxtroll) restoreRevenue(ctx context.Context) error {
+	events, err := b.db.ListRevenueEventsByTime(ctx, b.roomID, b.session.StartTime, time.Time{})
+	if err != nil {
+		return err
+	}
+
+	b.curRevenue = make(map[int64]map[store.RevenueKind]int64)
+	for _, event := range events {
+		if event.SessionID == b.session.ID {
+			b.addRevenue(event)
+		}
+	}
+
+	return nil
+}
+
+// Total revenue of the current stream by kind
+func (b *Boxtroll) revenueTotals() map[store.RevenueKind]int64 {
+	totals := make(map[store.RevenueKind]int64)
+	for _, kinds := range b.curRevenue {
+		for kind, total := range kinds {
+			totals[kind] += total
+		}
+	}
+	return totals
+}
+
+// Users ranked by their revenue of the given kind in the current live stream, in 电池
+func (b *Boxtroll) revenueRankBoard(ctx context.Context, kind store.RevenueKind) *overlay.Board {
+	var entries []*overlay.Entry
+	for uid, kinds := range b.curRevenue {
+		total, ok := kinds[kind]
+		if !ok {
+			continue
+		}
+		user, err := b.db.GetUser(ctx, uid)
+		if err != nil {
+			// The user is created in the background, try again in the next report
+			log.Debug().Err(err).Int64("uid", uid).Msg("未知的用户")
+			continue
+		}
+		entries = append(entries, &overlay.Entry{
+			UID:     uid,
+			Name:    user.Name,
+			Face:    user.Face,
+			Value:   total / 100,
+			Display: fmt.Sprintf("%d 电池", total/100),
+		})
+	}
+
+	// Sort descending
+	slices.SortFunc(entries, func(a *overlay.Entry, b *overlay.Entry) int {
+		return int(b.Value - a.Value)
+	})
+	if len(entries) > REPORT_TOP_N {
+		entries = entries[:REPORT_TOP_N]
+	}
+
+	return &overlay.Board{
+		Title:   fmt.Sprintf("本场%s排行榜", kind.Label()),
+		Entries: entries,
+		Size:    REPORT_TOP_N,
+	}
+}
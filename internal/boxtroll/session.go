@@ -0,0 +1,145 @@
+package boxtroll
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/YangchenYe323/boxtroll/internal/bilibili"
+	"github.com/YangchenYe323/boxtroll/internal/live"
+	"github.com/YangchenYe323/boxtroll/internal/store"
+	"github.com/rs/zerolog/log"
+)
+
+// Determine the current live session from the room status and restore its leaderboard,
+// so that restarting boxtroll mid-stream does not wipe the statistics of the stream.
+func (b *Boxtroll) initializeSession(ctx context.Context) error {
+	latest, err := b.db.GetLatestSession(ctx, b.roomID)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return err
+	}
+
+	roomInfo, err := b.getRoomInfo(ctx, b.roomID)
+	if err != nil {
+		// Not fatal, we will pick up the session from the LIVE command
+		log.Warn().Err(err).Msg("无法获取直播间状态, 等待开播消息")
+		return nil
+	}
+
+	if roomInfo.LiveStatus != bilibili.LiveStatusLive {
+		log.Info().Msg("直播间未开播")
+		if latest != nil && latest.Ongoing() {
+			// We missed the PREPARING command of the last session
+			return b.endSession(ctx, latest, time.Now())
+		}
+		return nil
+	}
+
+	startTime, err := roomInfo.LiveStartTime()
+	if err != nil {
+		log.Warn().Err(err).Str("live_time", roomInfo.LiveTime).Msg("无法解析开播时间, 使用当前时间")
+		startTime = time.Now()
+	}
+
+	if latest != nil && latest.ID == startTime.Unix() {
+		st, err := b.db.ListSessionBoxStatistics(ctx, latest)
+		if err != nil {
+			return err
+		}
+		b.session = latest
+		b.curStreamSt = st
+		if err := b.restoreRevenue(ctx); err != nil {
+			return err
+		}
+		log.Info().Time("start_time", latest.StartTime).Int("users", len(st)).Msg("恢复本场直播统计")
+		return nil
+	}
+
+	if latest != nil && latest.Ongoing() {
+		if err := b.endSession(ctx, latest, startTime); err != nil {
+			return err
+		}
+	}
+
+	return b.startSession(ctx, startTime)
+}
+
+func (b *Boxtroll) handleLive(ctx context.Context, msg *live.LiveMessage) {
+	// LIVE is usually delivered more than once per broadcast
+	if b.session != nil && b.session.Ongoing() {
+		return
+	}
+
+	startTime := time.Now()
+	if msg.LiveTime > 0 {
+		startTime = time.Unix(msg.LiveTime, 0)
+	}
+
+	if err := b.startSession(ctx, startTime); err != nil {
+		log.Err(err).Msg("无法保存直播场次")
+	}
+}
+
+func (b *Boxtroll) handlePreparing(ctx context.Context, msg *live.PreparingMessage) {
+	if b.session == nil || !b.session.Ongoing() {
+		return
+	}
+
+	// Keep the leaderboard of the finished session on display until the next broadcast starts
+	if err := b.endSession(ctx, b.session, time.Now()); err != nil {
+		log.Err(err).Msg("无法保存直播场次")
+	}
+}
+
+func (b *Boxtroll) startSession(ctx context.Context, startTime time.Time) error {
+	session := &store.Session{
+		RoomID:    b.roomID,
+		ID:        startTime.Unix(),
+		StartTime: startTime,
+	}
+	if err := b.db.SetSession(ctx, session); err != nil {
+		return err
+	}
+
+	b.session = session
+	b.curStreamSt = make(map[int64]map[int64]*store.BoxStatistics)
+	b.curRevenue = make(map[int64]map[store.RevenueKind]int64)
+
+	log.Info().Time("start_time", startTime).Msg("直播开始, 开始新的场次统计")
+	return nil
+}
+
+func (b *Boxtroll) endSession(ctx context.Context, session *store.Session, endTime time.Time) error {
+	session.EndTime = endTime
+	if err := b.db.SetSession(ctx, session); err != nil {
+		return err
+	}
+
+	log.Info().Time("start_time", session.StartTime).Time("end_time", endTime).Msg("直播结束")
+	return nil
+}
+
+// Log the statistics of the current stream, e.g., on shutdown.
+func (b *Boxtroll) logSessionSummary() {
+	var total store.BoxStatistics
+	for _, boxIDMap := range b.curStreamSt {
+		for _, st := range boxIDMap {
+			total.Merge(*st)
+		}
+	}
+
+	event := log.Info().
+		Int64("room", b.roomID).
+		Int("users", len(b.curStreamSt)).
+		Int64("boxes", total.TotalNum).
+		Int64("original_price", total.TotalOriginalPrice/100).
+		Int64("price", total.TotalPrice/100).
+		Int64("diff", (total.TotalPrice-total.TotalOriginalPrice)/100)
+	for kind, total := range b.revenueTotals() {
+		event = event.Int64(string(kind), total/100)
+	}
+	if b.session != nil {
+		event = event.Time("start_time", b.session.StartTime)
+	}
+	event.Msg("本场直播盲盒统计 (电池)")
+}
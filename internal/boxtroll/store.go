@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/YangchenYe323/boxtroll/internal/store"
 )
@@ -11,7 +12,8 @@ import (
 // A boxtroll store implementation. It is built on top of a persistency layer and provide
 // aggressive read caching of all the data used by boxtroll.
 //
-// It only operates on a single live room at a time, and fetches all the data from the persister upon initialization.
+// It only caches a single live room, and fetches all the data from the persister upon initialization. Several boxtroll
+// stores for different rooms may share the same persister, reads of other rooms are passed through to it.
 // During its lifetime, it serves all the read data from in-memory caches and persists write to persister and update in memory caches.
 //
 // We cannot directly use badger's memtable, e.g., for cache because memtable caches recent write but not read.
@@ -104,9 +106,14 @@ func (s *boxtrollStore) SetUser(ctx context.Context, uid int64, user *store.User
 	return nil
 }
 
+func (s *boxtrollStore) ListAllRoomIDs(ctx context.Context) ([]int64, error) {
+	return s.persister.ListAllRoomIDs(ctx)
+}
+
 func (s *boxtrollStore) GetRoom(ctx context.Context, roomID int64) (*store.Room, error) {
 	if roomID != s.roomID {
-		panic("boxtrollStore.GetRoom: roomID mismatch")
+		// Other rooms are served by their own boxtroll sharing the same persister
+		return s.persister.GetRoom(ctx, roomID)
 	}
 
 	s.roomCacheMu.RLock()
@@ -115,15 +122,32 @@ func (s *boxtrollStore) GetRoom(ctx context.Context, roomID int64) (*store.Room,
 	return s.roomCache, nil
 }
 
+// Persist the room and swap the cached room as a whole, so that readers see either the old
+// or the new gift catalogue, never a mix of both. Callers must not modify room afterwards.
 func (s *boxtrollStore) SetRoom(ctx context.Context, roomID int64, room *store.Room) error {
-	// Not implemented, do not use
-	panic("boxtrollStore.SetRoom is NOT implemented")
+	if err := s.persister.SetRoom(ctx, roomID, room); err != nil {
+		return err
+	}
+
+	if roomID != s.roomID {
+		return nil
+	}
+
+	s.roomCacheMu.Lock()
+	defer s.roomCacheMu.Unlock()
+	s.roomCache = room
+
+	return nil
 }
 
 func (s *boxtrollStore) BoxStatisticsKey(roomID int64, uid int64, boxID int64) []byte {
 	return s.persister.BoxStatisticsKey(roomID, uid, boxID)
 }
 
+func (s *boxtrollStore) ParseBoxStatisticsKey(key []byte) (int64, int64, int64, error) {
+	return s.persister.ParseBoxStatisticsKey(key)
+}
+
 func (s *boxtrollStore) GetBoxStatistics(ctx context.Context, transfers []store.BoxStatisticsTransfer, notFoundBehavior store.NotFoundBehavior) error {
 	s.boxStatisticsCacheMu.RLock()
 	defer s.boxStatisticsCacheMu.RUnlock()
@@ -166,7 +190,7 @@ func (s *boxtrollStore) ListAllBoxSenderUserIDs(ctx context.Context, roomID int6
 
 func (s *boxtrollStore) ListAllBoxStatistics(ctx context.Context, roomID int64) (map[string]*store.BoxStatistics, error) {
 	if roomID != s.roomID {
-		panic("boxtrollStore.ListAllBoxStatistics: roomID mismatch")
+		return s.persister.ListAllBoxStatistics(ctx, roomID)
 	}
 
 	s.boxStatisticsCacheMu.RLock()
@@ -181,3 +205,86 @@ func (s *boxtrollStore) ListAllBoxStatistics(ctx context.Context, roomID int64)
 
 	return boxStatistics, nil
 }
+
+// Outcome counts are only read for reports and not cached
+func (s *boxtrollStore) ListOutcomeCounts(ctx context.Context, roomID int64, uid int64) ([]*store.OutcomeCount, error) {
+	return s.persister.ListOutcomeCounts(ctx, roomID, uid)
+}
+
+func (s *boxtrollStore) SetOutcomeCounts(ctx context.Context, counts []*store.OutcomeCount) error {
+	return s.persister.SetOutcomeCounts(ctx, counts)
+}
+
+func (s *boxtrollStore) AddOutcomeCounts(ctx context.Context, counts []*store.OutcomeCount) error {
+	return s.persister.AddOutcomeCounts(ctx, counts)
+}
+
+func (s *boxtrollStore) AppendGiftEvents(ctx context.Context, events []*store.GiftEvent) error {
+	return s.persister.AppendGiftEvents(ctx, events)
+}
+
+func (s *boxtrollStore) AcceptGiftEvent(ctx context.Context, event *store.GiftEvent) (bool, error) {
+	return s.persister.AcceptGiftEvent(ctx, event)
+}
+
+func (s *boxtrollStore) ListJournal(ctx context.Context, roomID int64) ([]*store.GiftEvent, error) {
+	return s.persister.ListJournal(ctx, roomID)
+}
+
+func (s *boxtrollStore) CommitBatch(ctx context.Context, batch *store.Batch) error {
+	if err := s.persister.CommitBatch(ctx, batch); err != nil {
+		return err
+	}
+
+	s.boxStatisticsCacheMu.Lock()
+	defer s.boxStatisticsCacheMu.Unlock()
+	for _, transfer := range batch.BoxStatistics {
+		s.boxStatisticsCache[string(transfer.Key())] = transfer.GetBoxStatistics()
+	}
+
+	return nil
+}
+
+func (s *boxtrollStore) AddLeaderboardScores(ctx context.Context, eventID string, scores []*store.LeaderboardScore) (bool, error) {
+	return s.persister.AddLeaderboardScores(ctx, eventID, scores)
+}
+
+func (s *boxtrollStore) ListLeaderboardScores(ctx context.Context, roomID int64, board string, period string) ([]*store.LeaderboardScore, error) {
+	return s.persister.ListLeaderboardScores(ctx, roomID, board, period)
+}
+
+func (s *boxtrollStore) AcceptRevenueEvent(ctx context.Context, event *store.RevenueEvent) (bool, error) {
+	return s.persister.AcceptRevenueEvent(ctx, event)
+}
+
+func (s *boxtrollStore) ListRevenueEventsByTime(ctx context.Context, roomID int64, start, end time.Time) ([]*store.RevenueEvent, error) {
+	return s.persister.ListRevenueEventsByTime(ctx, roomID, start, end)
+}
+
+func (s *boxtrollStore) ListRevenueEventsByUser(ctx context.Context, roomID int64, uid int64, start, end time.Time) ([]*store.RevenueEvent, error) {
+	return s.persister.ListRevenueEventsByUser(ctx, roomID, uid, start, end)
+}
+
+func (s *boxtrollStore) ListGiftEventsByTime(ctx context.Context, roomID int64, start, end time.Time) ([]*store.GiftEvent, error) {
+	return s.persister.ListGiftEventsByTime(ctx, roomID, start, end)
+}
+
+func (s *boxtrollStore) ListGiftEventsByUser(ctx context.Context, roomID int64, uid int64, start, end time.Time) ([]*store.GiftEvent, error) {
+	return s.persister.ListGiftEventsByUser(ctx, roomID, uid, start, end)
+}
+
+func (s *boxtrollStore) GetLatestSession(ctx context.Context, roomID int64) (*store.Session, error) {
+	return s.persister.GetLatestSession(ctx, roomID)
+}
+
+func (s *boxtrollStore) SetSession(ctx context.Context, session *store.Session) error {
+	return s.persister.SetSession(ctx, session)
+}
+
+func (s *boxtrollStore) SetSessionBoxStatistics(ctx context.Context, session *store.Session, st map[int64]map[int64]*store.BoxStatistics) error {
+	return s.persister.SetSessionBoxStatistics(ctx, session, st)
+}
+
+func (s *boxtrollStore) ListSessionBoxStatistics(ctx context.Context, session *store.Session) (map[int64]map[int64]*store.BoxStatistics, error) {
+	return s.persister.ListSessionBoxStatistics(ctx, session)
+}
@@ -0,0 +1,240 @@
+package boxtroll
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+	"unicode/utf8"
+
+	"github.com/YangchenYe323/boxtroll/internal/analytics"
+	"github.com/YangchenYe323/boxtroll/internal/bilibili"
+	"github.com/YangchenYe323/boxtroll/internal/store"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// Default template reporting the profit of a finished batch
+	DEFAULT_BATCH_TEMPLATE = "投喂 {{.BoxName}}: {{signed .Diff}} 电池"
+	// Default template reporting the historical profit of the user
+	DEFAULT_HISTORY_TEMPLATE = "历史投喂 {{.BoxName}}: {{signed .AccumDiff}} 电池"
+
+	// A rendered message longer than MAX_DANMAKU_MSG_LEN is split into multiple danmaku.
+	// Reject templates that would flood the chat.
+	MAX_DANMAKU_CHUNKS = 3
+)
+
+// Variables available to danmaku templates, derived from a finished batch.
+// All prices are in 电池 (100 金瓜子).
+//
+//	.BoxName             Blind box name, e.g., 心动盲盒
+//	.UID                 Sender UID
+//	.Num                 Number of boxes in this batch
+//	.OriginalPrice       Price of the boxes in this batch
+//	.Price               Value of the gifts opened in this batch
+//	.Diff                Price - OriginalPrice of this batch
+//	.ReturnRate          Price / OriginalPrice of this batch in percent
+//	.AccumNum            Number of boxes the user has ever sent
+//	.AccumOriginalPrice  Price of all boxes the user has ever sent
+//	.AccumPrice          Value of all gifts the user has ever opened
+//	.AccumDiff           AccumPrice - AccumOriginalPrice
+//	.AccumReturnRate     AccumPrice / AccumOriginalPrice in percent
+//	.Luck                How this batch ranks among everyone opening as many boxes, e.g., 比92%的人倒霉
+//	.LuckPercentile      Percent of people this batch is luckier than
+//	.AccumLuck           How the user's history ranks, like .Luck
+//	.AccumLuckPercentile Percent of people the user's history is luckier than
+//
+// The luck variables are computed from the advertised chances of the box, and are empty (0)
+// if the chances are unknown, e.g., {{with .Luck}} ({{.}}){{end}}.
+//
+// Functions:
+//
+//	signed    Format an integer with explicit sign, e.g., +12, -3
+//	percent   Format a float as percent with one decimal, e.g., 87.5%
+type DanmakuData struct {
+	BoxName            string
+	UID                int64
+	Num                int64
+	OriginalPrice      int64
+	Price              int64
+	Diff               int64
+	ReturnRate         float64
+	AccumNum           int64
+	AccumOriginalPrice int64
+	AccumPrice         int64
+	AccumDiff          int64
+	AccumReturnRate    float64
+
+	Luck                string
+	LuckPercentile      float64
+	AccumLuck           string
+	AccumLuckPercentile float64
+}
+
+func newDanmakuData(entry *finishedBatch) *DanmakuData {
+	data := &DanmakuData{
+		BoxName:            entry.boxName,
+		UID:                entry.uid,
+		Num:                entry.st.TotalNum,
+		OriginalPrice:      entry.st.TotalOriginalPrice / 100,
+		Price:              entry.st.TotalPrice / 100,
+		Diff:               (entry.st.TotalPrice - entry.st.TotalOriginalPrice) / 100,
+		ReturnRate:         returnRate(&entry.st),
+		AccumNum:           entry.accumSt.TotalNum,
+		AccumOriginalPrice: entry.accumSt.TotalOriginalPrice / 100,
+		AccumPrice:         entry.accumSt.TotalPrice / 100,
+		AccumDiff:          (entry.accumSt.TotalPrice - entry.accumSt.TotalOriginalPrice) / 100,
+		AccumReturnRate:    returnRate(&entry.accumSt),
+	}
+
+	if entry.model != nil {
+		if luck, ok := analytics.LuckOfStatistics(entry.model, entry.st); ok {
+			data.Luck, data.LuckPercentile = luck.String(), luck.Unluckier*100
+		}
+		if luck, ok := analytics.LuckOfStatistics(entry.model, entry.accumSt); ok {
+			data.AccumLuck, data.AccumLuckPercentile = luck.String(), luck.Unluckier*100
+		}
+	}
+
+	return data
+}
+
+func returnRate(st *store.BoxStatistics) float64 {
+	if st.TotalOriginalPrice == 0 {
+		return 0
+	}
+	return float64(st.TotalPrice) / float64(st.TotalOriginalPrice) * 100
+}
+
+var templateFuncs = template.FuncMap{
+	"signed": signed,
+	"percent": func(f float64) string {
+		return fmt.Sprintf("%.1f%%", f)
+	},
+}
+
+// Templates of the danmaku sent for each finished batch.
+type DanmakuTemplate struct {
+	batch   *template.Template
+	history *template.Template // nil if the historical report is suppressed
+	minLoss int64              // Only report batches losing at least minLoss 电池, 0 reports every batch
+}
+
+// Parse and validate danmaku templates. An empty history template suppresses the historical report.
+func NewDanmakuTemplate(batch string, history string, minLoss int64) (*DanmakuTemplate, error) {
+	if strings.TrimSpace(batch) == "" {
+		return nil, fmt.Errorf("批次弹幕模板不能为空")
+	}
+	if minLoss < 0 {
+		return nil, fmt.Errorf("最小亏损阈值不能为负数: %d", minLoss)
+	}
+
+	t := &DanmakuTemplate{minLoss: minLoss}
+
+	var err error
+	t.batch, err = template.New("batch").Funcs(templateFuncs).Option("missingkey=error").Parse(batch)
+	if err != nil {
+		return nil, fmt.Errorf("无法解析批次弹幕模板: %w", err)
+	}
+
+	if strings.TrimSpace(history) != "" {
+		t.history, err = template.New("history").Funcs(templateFuncs).Option("missingkey=error").Parse(history)
+		if err != nil {
+			return nil, fmt.Errorf("无法解析历史弹幕模板: %w", err)
+		}
+	}
+
+	if err := t.validate(); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func DefaultDanmakuTemplate() *DanmakuTemplate {
+	t, err := NewDanmakuTemplate(DEFAULT_BATCH_TEMPLATE, DEFAULT_HISTORY_TEMPLATE, 0)
+	if err != nil {
+		// unreachable
+		panic(err)
+	}
+	return t
+}
+
+// Render the templates against a worst case batch, to catch execution errors and
+// messages that would be split into too many danmaku before going live.
+func (t *DanmakuTemplate) validate() error {
+	sample := &DanmakuData{
+		BoxName:            "至尊心动盲盒",
+		UID:                1234567890,
+		Num:                99999,
+		OriginalPrice:      999999,
+		Price:              0,
+		Diff:               -999999,
+		ReturnRate:         0,
+		AccumNum:           999999,
+		AccumOriginalPrice: 9999999,
+		AccumPrice:         0,
+		AccumDiff:          -9999999,
+		AccumReturnRate:    0,
+
+		Luck:                "比100%的人倒霉",
+		LuckPercentile:      0,
+		AccumLuck:           "比100%的人倒霉",
+		AccumLuckPercentile: 0,
+	}
+
+	for _, tmpl := range []*template.Template{t.batch, t.history} {
+		if tmpl == nil {
+			continue
+		}
+
+		msg, err := execute(tmpl, sample)
+		if err != nil {
+			return fmt.Errorf("弹幕模板 %s 无法渲染: %w", tmpl.Name(), err)
+		}
+
+		numRunes := utf8.RuneCountInString(msg)
+		chunks := (numRunes + bilibili.MAX_DANMAKU_MSG_LEN - 1) / bilibili.MAX_DANMAKU_MSG_LEN
+		if chunks > MAX_DANMAKU_CHUNKS {
+			return fmt.Errorf("弹幕模板 %s 过长: %q 需要拆分为 %d 条弹幕, 最多允许 %d 条 (每条 %d 字)", tmpl.Name(), msg, chunks, MAX_DANMAKU_CHUNKS, bilibili.MAX_DANMAKU_MSG_LEN)
+		}
+		if chunks > 1 {
+			log.Debug().Str("template", tmpl.Name()).Str("sample", msg).Int("chunks", chunks).Msgf("弹幕超过 %d 字时会被拆分为多条发送", bilibili.MAX_DANMAKU_MSG_LEN)
+		}
+	}
+
+	return nil
+}
+
+// Render the danmaku messages for a finished batch. Messages rendered empty are dropped,
+// so templates can suppress themselves with {{if}}.
+func (t *DanmakuTemplate) render(entry *finishedBatch) ([]string, error) {
+	data := newDanmakuData(entry)
+	if t.minLoss > 0 && -data.Diff < t.minLoss {
+		return nil, nil
+	}
+
+	var msgs []string
+	for _, tmpl := range []*template.Template{t.batch, t.history} {
+		if tmpl == nil {
+			continue
+		}
+
+		msg, err := execute(tmpl, data)
+		if err != nil {
+			return nil, err
+		}
+		if msg != "" {
+			msgs = append(msgs, msg)
+		}
+	}
+
+	return msgs, nil
+}
+
+func execute(tmpl *template.Template, data *DanmakuData) (string, error) {
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(sb.String()), nil
+}
@@ -0,0 +1,92 @@
+package boxtroll
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/YangchenYe323/boxtroll/internal/store"
+)
+
+func TestNewDanmakuTemplate(t *testing.T) {
+	tests := []struct {
+		name    string
+		batch   string
+		history string
+		minLoss int64
+		ok      bool
+	}{
+		{"default", DEFAULT_BATCH_TEMPLATE, DEFAULT_HISTORY_TEMPLATE, 0, true},
+		{"no history", "{{.BoxName}} {{signed .Diff}}", "", 10, true},
+		{"functions and luck", "{{.BoxName}} {{percent .ReturnRate}}{{with .Luck}} {{.}}{{end}}", "", 0, true},
+		{"empty batch", "  ", DEFAULT_HISTORY_TEMPLATE, 0, false},
+		{"negative min loss", DEFAULT_BATCH_TEMPLATE, "", -1, false},
+		{"unclosed action", "{{.BoxName", "", 0, false},
+		{"unknown function", "{{unknown .Diff}}", "", 0, false},
+		{"unknown field", DEFAULT_BATCH_TEMPLATE, "{{.Missing}}", 0, false},
+		// 3 chunks of 20 runes is the limit
+		{"longest", strings.Repeat("盒", 3*20), "", 0, true},
+		{"too many chunks", strings.Repeat("盒", 3*20+1), "", 0, false},
+		// Short, but rendered against the longest box name
+		{"too many chunks rendered", strings.Repeat("{{.BoxName}}", 11), "", 0, false},
+	}
+
+	for _, test := range tests {
+		_, err := NewDanmakuTemplate(test.batch, test.history, test.minLoss)
+		if test.ok && err != nil {
+			t.Fatalf("%s: expected template to be valid, got %v", test.name, err)
+		}
+		if !test.ok && err == nil {
+			t.Fatalf("%s: expected error, got nil", test.name)
+		}
+	}
+}
+
+func TestDanmakuTemplateRender(t *testing.T) {
+	// 10 boxes for 150 电池 worth 100 电池, after 100 boxes for 1500 电池 worth 1600 电池
+	entry := &finishedBatch{
+		boxName: "心动盲盒",
+		uid:     12345678,
+		st:      store.BoxStatistics{TotalNum: 10, TotalOriginalPrice: 15000, TotalPrice: 10000},
+		accumSt: store.BoxStatistics{TotalNum: 100, TotalOriginalPrice: 150000, TotalPrice: 160000},
+	}
+
+	tests := []struct {
+		name     string
+		batch    string
+		history  string
+		minLoss  int64
+		expected []string
+	}{
+		{"default", DEFAULT_BATCH_TEMPLATE, DEFAULT_HISTORY_TEMPLATE, 0, []string{"投喂 心动盲盒: -50 电池", "历史投喂 心动盲盒: +100 电池"}},
+		{"no history", DEFAULT_BATCH_TEMPLATE, "", 0, []string{"投喂 心动盲盒: -50 电池"}},
+		{"rendered empty", "{{if gt .Diff 0}}赚了{{end}}", "{{percent .AccumReturnRate}}", 0, []string{"106.7%"}},
+		{"loss above min loss", DEFAULT_BATCH_TEMPLATE, "", 50, []string{"投喂 心动盲盒: -50 电池"}},
+		{"loss below min loss", DEFAULT_BATCH_TEMPLATE, DEFAULT_HISTORY_TEMPLATE, 51, nil},
+	}
+
+	for _, test := range tests {
+		tmpl, err := NewDanmakuTemplate(test.batch, test.history, test.minLoss)
+		if err != nil {
+			t.Fatalf("%s: failed to create template: %v", test.name, err)
+		}
+		msgs, err := tmpl.render(entry)
+		if err != nil {
+			t.Fatalf("%s: failed to render: %v", test.name, err)
+		}
+		if !slices.Equal(msgs, test.expected) {
+			t.Fatalf("%s: expected %q, got %q", test.name, test.expected, msgs)
+		}
+	}
+
+	// Profitable batches are never reported with a min loss
+	profit := *entry
+	profit.st = store.BoxStatistics{TotalNum: 1, TotalOriginalPrice: 1500, TotalPrice: 5000}
+	tmpl, err := NewDanmakuTemplate(DEFAULT_BATCH_TEMPLATE, "", 1)
+	if err != nil {
+		t.Fatalf("failed to create template: %v", err)
+	}
+	if msgs, err := tmpl.render(&profit); err != nil || len(msgs) != 0 {
+		t.Fatalf("expected no messages for a profitable batch, got %q and %v", msgs, err)
+	}
+}
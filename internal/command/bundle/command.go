@@ -0,0 +1,127 @@
+package bundle
+
+import (
+	"io"
+	"os"
+
+	"github.com/YangchenYe323/boxtroll/internal/store"
+	"github.com/spf13/cobra"
+)
+
+var (
+	exportRoomIDs []int64
+	importMode    string
+)
+
+var importModes = map[string]store.ImportMode{
+	"merge":     store.ImportModeMerge,
+	"overwrite": store.ImportModeOverwrite,
+}
+
+var ExportCmd = &cobra.Command{
+	Use:   "export [文件]",
+	Short: "导出用户、直播间和盲盒统计到便携的 JSON lines 文件 (默认输出到标准输出)",
+	Long: `导出用户、直播间和盲盒统计到便携的 JSON lines 文件, 可在其他电脑上用 boxtroll import 导入。
+数据库以只读方式打开, 盒子怪运行时无法导出, 请先关闭盒子怪。`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		s, err := store.NewBadger(dbDir(cmd), store.WithReadOnly())
+		if err != nil {
+			cmd.PrintErrf("无法打开数据库, 请确认盒子怪没有在运行: %s\n", err.Error())
+			os.Exit(1)
+		}
+		defer s.Close()
+
+		var w io.Writer = cmd.OutOrStdout()
+		var f *os.File
+		if len(args) == 1 && args[0] != "-" {
+			f, err = os.OpenFile(args[0], os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+			if err != nil {
+				cmd.PrintErrf("无法创建导出文件: %s\n", err.Error())
+				s.Close()
+				os.Exit(1)
+			}
+			defer f.Close()
+			w = f
+		}
+
+		summary, err := store.ExportBundle(cmd.Context(), s, w, exportRoomIDs)
+		if err != nil {
+			cmd.PrintErrf("导出失败: %s\n", err.Error())
+			// Deferred calls do not run. Close the database, and remove the truncated export file
+			// so that it is not mistaken for a complete one.
+			s.Close()
+			if f != nil {
+				f.Close()
+				if err := os.Remove(f.Name()); err != nil {
+					cmd.PrintErrf("无法删除不完整的导出文件 %s: %s\n", f.Name(), err.Error())
+				}
+			}
+			os.Exit(1)
+		}
+
+		cmd.PrintErrf("导出完成: %d 个用户, %d 个直播间, %d 条盲盒统计, %d 条盲盒爆出统计\n", summary.Users, summary.Rooms, summary.BoxStatistics, summary.OutcomeCounts)
+	},
+}
+
+var ImportCmd = &cobra.Command{
+	Use:   "import <文件>",
+	Short: "从 boxtroll export 导出的文件导入用户、直播间和盲盒统计 (- 表示标准输入)",
+	Long: `从 boxtroll export 导出的文件导入用户、直播间和盲盒统计。
+
+导入方式:
+  merge      将导入的盲盒统计累加到已有统计上, 保留已有的用户和直播间信息。
+             注意: 同一个文件导入两次会重复累加。
+  overwrite  用导入的用户、直播间和盲盒统计覆盖已有的记录, 文件中没有的记录保持不变。
+
+盒子怪运行时无法导入, 请先关闭盒子怪。`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		mode, ok := importModes[importMode]
+		if !ok {
+			cmd.PrintErrf("不支持的 --mode %s, 可选 merge, overwrite\n", importMode)
+			os.Exit(1)
+		}
+
+		var r io.Reader = cmd.InOrStdin()
+		if args[0] != "-" {
+			f, err := os.Open(args[0])
+			if err != nil {
+				cmd.PrintErrf("无法打开导入文件: %s\n", err.Error())
+				os.Exit(1)
+			}
+			defer f.Close()
+			r = f
+		}
+
+		s, err := store.NewBadger(dbDir(cmd))
+		if err != nil {
+			cmd.PrintErrf("无法打开数据库, 请确认盒子怪没有在运行: %s\n", err.Error())
+			os.Exit(1)
+		}
+		defer s.Close()
+
+		summary, err := store.ImportBundle(cmd.Context(), s, r, mode)
+		if err != nil {
+			cmd.PrintErrf("导入失败, 已导入的记录不会回滚: %s\n", err.Error())
+			// Close the database properly before exiting, deferred calls do not run
+			s.Close()
+			os.Exit(1)
+		}
+
+		cmd.Printf("导入完成: %d 个用户, %d 个直播间, %d 条盲盒统计, %d 条盲盒爆出统计\n", summary.Users, summary.Rooms, summary.BoxStatistics, summary.OutcomeCounts)
+	},
+}
+
+func dbDir(cmd *cobra.Command) string {
+	dbDir, err := cmd.Flags().GetString("db-dir")
+	if err != nil {
+		panic("db-dir flag is not defined")
+	}
+	return dbDir
+}
+
+func init() {
+	ExportCmd.Flags().Int64SliceVar(&exportRoomIDs, "room", nil, "只导出指定的直播间 (默认导出所有直播间)")
+	ImportCmd.Flags().StringVarP(&importMode, "mode", "m", "merge", "导入方式: merge (累加盲盒统计), overwrite (覆盖已有记录)")
+}
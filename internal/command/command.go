@@ -5,15 +5,22 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"os/signal"
 	"path"
 	"runtime"
-	"strconv"
+	"slices"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/YangchenYe323/boxtroll/internal/bilibili"
 	"github.com/YangchenYe323/boxtroll/internal/boxtroll"
+	"github.com/YangchenYe323/boxtroll/internal/command/bundle"
 	"github.com/YangchenYe323/boxtroll/internal/command/login"
+	"github.com/YangchenYe323/boxtroll/internal/command/stats"
 	"github.com/YangchenYe323/boxtroll/internal/live"
+	"github.com/YangchenYe323/boxtroll/internal/overlay"
 	"github.com/YangchenYe323/boxtroll/internal/store"
 	"github.com/andreykaipov/goobs"
 	"github.com/c-bata/go-prompt"
@@ -30,10 +37,23 @@ var (
 	LOG_MAX_SIZE       int
 	LOG_MAX_BACKUPS    int
 	LOG_MAX_AGE        int
-	ROOM_ID            int64
+	ROOM_IDS           []int64
 	SHOW_VERSION       bool
 	OBS_WEBSOCKET_ADDR string // OBS websocket connection address
 	OBS_PASSWORD       string // OBS websocket password
+	LIVE_TRANSPORT     string // Transport to connect to the danmaku servers
+	OVERLAY_ADDR       string // Listen address of the browser-source overlay server
+	LIVE_CAPTURE_DIR   string // Directory to record the raw frames of the live streams in
+
+	DANMAKU_TEMPLATE_BATCH   string // Template of the danmaku reporting a finished batch
+	DANMAKU_TEMPLATE_HISTORY string // Template of the danmaku reporting the historical profit
+	DANMAKU_MIN_LOSS         int64  // Only report batches losing at least this many 电池
+	DANMAKU_SINK             string // Where the danmaku go, see boxtroll.DanmakuSink
+	DANMAKU_SINK_FILE        string // File the danmaku are appended to with the file sink
+
+	LEADERBOARDS string // Gift leaderboards separated by semicolons, see boxtroll.ParseLeaderboardSpecs
+
+	STORAGE_DIR string // Overrides the database directory
 )
 
 // Derived global flags
@@ -50,13 +70,15 @@ const (
 	LOG_SUBDIR = "log"
 	// Cached credentials subdirectory
 	CREDS_SUBDIR = "creds"
+	// Default file of the file danmaku sink
+	DANMAKU_FILE = "danmaku.txt"
 )
 
 var BoxtrollCmd = &cobra.Command{
 	Use:   "boxtroll",
 	Short: "统计直播间盲盒盈亏",
 	PersistentPreRun: func(cmd *cobra.Command, args []string) {
-		initializeGlobalFlags()
+		unknownKeys := initializeGlobalFlags(cmd)
 		cmd.Println("boxtroll - 统计直播间盲盒盈亏程序...")
 
 		// Logging and working directories are initialized in PersistentPreRun hook
@@ -64,6 +86,9 @@ var BoxtrollCmd = &cobra.Command{
 
 		// Initialize logging
 		initializeLogging()
+		for _, key := range unknownKeys {
+			log.Warn().Str("key", key).Msg("配置文件中存在未知配置项")
+		}
 		// Make sure all the working directories exist
 		cmd.Printf("工作目录: %s ...\n", ROOT_DIR)
 		if err := ensureDirs(); err != nil {
@@ -80,10 +105,20 @@ func init() {
 	BoxtrollCmd.PersistentFlags().IntVar(&LOG_MAX_BACKUPS, "log.max.backups", 10, "日志文件的最大备份数量")
 	BoxtrollCmd.PersistentFlags().IntVar(&LOG_MAX_AGE, "log.max.age", 30, "日志文件的最大保存时间(天)")
 	BoxtrollCmd.PersistentFlags().BoolVarP(&SHOW_VERSION, "version", "V", false, "显示版本信息")
+	BoxtrollCmd.PersistentFlags().StringVar(&STORAGE_DIR, "storage.dir", "", fmt.Sprintf("数据库目录 (默认 <工作目录>/%s)", DB_SUBDIR))
 
-	BoxtrollCmd.PersistentFlags().Int64VarP(&ROOM_ID, "room.id", "r", 0, "要监控的直播间ID")
+	BoxtrollCmd.PersistentFlags().Int64SliceVarP(&ROOM_IDS, "room.id", "r", nil, "要监控的直播间ID, 可以重复指定或用逗号分隔以同时监控多个直播间")
 	BoxtrollCmd.PersistentFlags().StringVarP(&OBS_WEBSOCKET_ADDR, "obs.websocket.addr", "U", "localhost:4455", "OBS websocket连接URL")
 	BoxtrollCmd.PersistentFlags().StringVarP(&OBS_PASSWORD, "obs.password", "P", "", "OBS websocket密码")
+	BoxtrollCmd.PersistentFlags().StringVar(&DANMAKU_TEMPLATE_BATCH, "danmaku.template.batch", boxtroll.DEFAULT_BATCH_TEMPLATE, "批次盈亏弹幕模板 (Go text/template, 可用变量见 boxtroll.DanmakuData)")
+	BoxtrollCmd.PersistentFlags().StringVar(&DANMAKU_TEMPLATE_HISTORY, "danmaku.template.history", boxtroll.DEFAULT_HISTORY_TEMPLATE, "历史盈亏弹幕模板 (留空则不发送)")
+	BoxtrollCmd.PersistentFlags().Int64Var(&DANMAKU_MIN_LOSS, "danmaku.min-loss", 0, "只播报亏损不少于该数量电池的批次 (0 播报所有批次)")
+	BoxtrollCmd.PersistentFlags().StringVar(&DANMAKU_SINK, "danmaku.sink", string(boxtroll.DanmakuSinkBilibili), "弹幕输出方式 (bilibili: 发送到直播间, log: 只输出到日志, stdout: 输出到终端, file: 追加到 --danmaku.sink.file)")
+	BoxtrollCmd.PersistentFlags().StringVar(&DANMAKU_SINK_FILE, "danmaku.sink.file", "", fmt.Sprintf("弹幕输出文件 (默认 <工作目录>/%s)", DANMAKU_FILE))
+	BoxtrollCmd.PersistentFlags().StringVar(&LEADERBOARDS, "leaderboard.boards", boxtroll.DEFAULT_LEADERBOARDS, "礼物排行榜, 多个排行榜用分号分隔, 例如 \"gift=小花花,metric=value,scope=day,top=10\" (metric: count, value, profit; scope: session, day, all; 可选 title, unit)")
+	BoxtrollCmd.PersistentFlags().StringVar(&OVERLAY_ADDR, "overlay.addr", "", "浏览器源叠加层监听地址, 例如 127.0.0.1:8787 (留空则不启用)")
+	BoxtrollCmd.Flags().StringVar(&LIVE_CAPTURE_DIR, "live.capture-dir", "", "将弹幕服务器的原始消息记录到该目录, 可用 boxtroll replay 回放 (留空则不记录)")
+	BoxtrollCmd.PersistentFlags().StringVar(&LIVE_TRANSPORT, "live.transport", string(live.TransportAuto), "连接弹幕服务器的方式 (tcp, wss, auto: TCP连续失败时改用WSS)")
 
 	// These flags are needed so sub-commands located in different packages can access them
 	// but we don't want the user to be able to set them, as they will be overridden anyway.
@@ -97,6 +132,15 @@ func init() {
 
 	// Add sub-commands
 	BoxtrollCmd.AddCommand(login.Cmd)
+	BoxtrollCmd.AddCommand(configCmd)
+	BoxtrollCmd.AddCommand(stats.Cmd)
+	BoxtrollCmd.AddCommand(bundle.ExportCmd)
+	BoxtrollCmd.AddCommand(bundle.ImportCmd)
+	BoxtrollCmd.AddCommand(migrateCmd)
+	BoxtrollCmd.AddCommand(replayCmd)
+	BoxtrollCmd.AddCommand(rtpCmd)
+	BoxtrollCmd.AddCommand(outcomesCmd)
+	BoxtrollCmd.AddCommand(revenueCmd)
 }
 
 func RunBoxtroll(cmd *cobra.Command, args []string) {
@@ -105,7 +149,30 @@ func RunBoxtroll(cmd *cobra.Command, args []string) {
 		return
 	}
 
-	ctx := cmd.Context()
+	// Cancelled on Ctrl-C or termination, after which every room shuts down gracefully
+	ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	transport, err := live.ParseTransport(LIVE_TRANSPORT)
+	if err != nil {
+		log.Fatal().Err(err).Msg("无法解析 --live.transport")
+	}
+
+	sink, err := boxtroll.ParseDanmakuSink(DANMAKU_SINK)
+	if err != nil {
+		log.Fatal().Err(err).Msg("无法解析 --danmaku.sink")
+	}
+
+	// Validate templates before going live
+	template, err := boxtroll.NewDanmakuTemplate(DANMAKU_TEMPLATE_BATCH, DANMAKU_TEMPLATE_HISTORY, DANMAKU_MIN_LOSS)
+	if err != nil {
+		log.Fatal().Err(err).Msg("弹幕模板不合法")
+	}
+
+	leaderboards, err := boxtroll.ParseLeaderboardSpecs(LEADERBOARDS)
+	if err != nil {
+		log.Fatal().Err(err).Msg("无法解析 --leaderboard.boards")
+	}
 
 	// Initialize User
 	uid, err := initializeUser(ctx, cmd)
@@ -114,16 +181,21 @@ func RunBoxtroll(cmd *cobra.Command, args []string) {
 	}
 	log.Info().Int64("uid", uid).Msg("用户初始化成功")
 
-	// Ininitialize Room ID
-	if ROOM_ID == 0 {
-		// Prompt user to input room ID
-		line := prompt.Input("请输入直播间号: ", func(d prompt.Document) []prompt.Suggest { return nil })
-		ROOM_ID, err = strconv.ParseInt(line, 10, 64)
+	// Ininitialize Room IDs
+	if len(ROOM_IDS) == 0 {
+		// Prompt user to input room IDs
+		line := prompt.Input("请输入直播间号 (多个直播间用逗号分隔): ", func(d prompt.Document) []prompt.Suggest { return nil })
+		ROOM_IDS, err = parseRoomIDs(line)
 		if err != nil {
 			log.Fatal().Err(err).Msgf("无法解析直播间号 %s", line)
 		}
+		if len(ROOM_IDS) == 0 {
+			log.Fatal().Msg("没有输入直播间号")
+		}
 	}
+	ROOM_IDS = slices.Compact(slices.Sorted(slices.Values(ROOM_IDS)))
 
+	// All rooms share the same database
 	s, err := store.NewBadger(DB_DIR)
 	if err != nil {
 		log.Fatal().Err(err).Msg("无法初始化数据库")
@@ -133,7 +205,8 @@ func RunBoxtroll(cmd *cobra.Command, args []string) {
 		log.Fatal().Msg("OBS websocket URL is not set, please set --obs.websocket.url")
 	}
 
-	if OBS_PASSWORD == "" {
+	// The overlay replaces the OBS text source, don't bother asking for the password
+	if OBS_PASSWORD == "" && OVERLAY_ADDR == "" {
 		// Prompt user to input password
 		cmd.Println("盒子怪可以与OBS联动，更新OBS文本源的内容。")
 		cmd.Println("若想要使用，请打开OBS，工具 - WebSocket服务器设置 - 启用WebSocket服务器，不要更改其他设置并设置密码。")
@@ -141,30 +214,154 @@ func RunBoxtroll(cmd *cobra.Command, args []string) {
 		OBS_PASSWORD = strings.TrimSpace(line)
 	}
 
+	if OBS_PASSWORD == "" {
+		log.Info().Msg("不使用OBS联动")
+	}
+
+	// Shared by all rooms, each room publishes to its own ?room= page
+	var server *overlay.Server
+	if OVERLAY_ADDR != "" {
+		server = overlay.New(OVERLAY_ADDR)
+		go func() {
+			if err := server.Run(ctx); err != nil {
+				log.Err(err).Str("addr", OVERLAY_ADDR).Msg("浏览器源叠加层异常退出")
+			}
+		}()
+	}
+
+	// All danmaku are sent by the same account, and so share the rate limit
+	sender, closeSender, err := newDanmakuSender(sink)
+	if err != nil {
+		log.Fatal().Err(err).Msg("无法创建弹幕输出")
+	}
+	defer closeSender()
+
+	var boxtrolls []*boxtroll.Boxtroll
+	var captures []*os.File
+	for _, roomID := range ROOM_IDS {
+		streamOptions := []live.StreamOption{live.WithTransport(transport)}
+		if LIVE_CAPTURE_DIR != "" {
+			f, capture, err := createCapture(LIVE_CAPTURE_DIR, roomID)
+			if err != nil {
+				log.Fatal().Err(err).Int64("room", roomID).Msg("无法创建抓包文件")
+			}
+			log.Info().Int64("room", roomID).Str("file", f.Name()).Msg("记录弹幕服务器消息")
+			captures = append(captures, f)
+			streamOptions = append(streamOptions, live.WithCapture(capture))
+		}
+
+		options := []boxtroll.Option{
+			boxtroll.WithDanmakuTemplate(template),
+			boxtroll.WithDanmakuSender(sender),
+			boxtroll.WithLeaderboards(leaderboards),
+		}
+		if server != nil {
+			options = append(options, boxtroll.WithOverlay(server))
+		}
+		if len(ROOM_IDS) > 1 {
+			options = append(options, boxtroll.WithOBSSourceName(fmt.Sprintf("%s-%d", boxtroll.OBS_SOURCE_NAME, roomID)))
+		}
+
+		b, err := newRoomBoxtroll(ctx, s, uid, roomID, streamOptions, options...)
+		if err != nil {
+			log.Fatal().Err(err).Int64("room", roomID).Msg("无法启动盒子怪")
+		}
+		boxtrolls = append(boxtrolls, b)
+	}
+
+	var wg sync.WaitGroup
+	for _, b := range boxtrolls {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.Run(ctx)
+		}()
+	}
+
+	<-ctx.Done()
+	// A second signal kills the process right away
+	stop()
+	log.Info().Msg("收到退出信号, 正在退出...")
+
+	wg.Wait()
+
+	for _, f := range captures {
+		f.Close()
+	}
+	if err := s.Close(); err != nil {
+		log.Err(err).Msg("无法关闭数据库")
+	}
+	log.Info().Msg("盒子怪已退出")
+}
+
+// Create the boxtroll monitoring a single live room, with its own message stream and OBS connection.
+func newRoomBoxtroll(ctx context.Context, s store.Store, uid int64, roomID int64, streamOptions []live.StreamOption, options ...boxtroll.Option) (*boxtroll.Boxtroll, error) {
+	// Each room updates its own text source, and reconnects on its own
 	var obs *goobs.Client
 	if OBS_PASSWORD != "" {
+		var err error
 		obs, err = goobs.New(OBS_WEBSOCKET_ADDR, goobs.WithPassword(OBS_PASSWORD))
 		if err != nil {
-			log.Fatal().Err(err).Str("url", OBS_WEBSOCKET_ADDR).Str("password", OBS_PASSWORD).Msg("无法连接到OBS, 请先打开OBS再启动盒子怪, 并确认密码是否正确")
+			return nil, fmt.Errorf("无法连接到OBS %s, 请先打开OBS再启动盒子怪, 并确认密码是否正确: %w", OBS_WEBSOCKET_ADDR, err)
 		}
-		log.Info().Msg("成功连接到OBS websocket")
-	} else {
-		log.Info().Msg("不使用OBS联动")
+		log.Info().Int64("room", roomID).Msg("成功连接到OBS websocket")
 	}
 
 	// Fetch message stream info for the given live room
-	streamInfo, err := bilibili.GetMessageStreamInfo(ctx, ROOM_ID)
+	streamInfo, err := bilibili.GetMessageStreamInfo(ctx, roomID)
 	if err != nil {
-		log.Fatal().Err(err).Msg("无法获取直播间弹幕流信息")
+		return nil, fmt.Errorf("无法获取直播间弹幕流信息: %w", err)
 	}
-	stream := live.NewStream(ROOM_ID, uid, streamInfo.Token, streamInfo.HostList)
+	stream := live.NewStream(roomID, uid, streamInfo.Token, streamInfo.HostList, streamOptions...)
+
+	return boxtroll.New(ctx, s, stream, OBS_WEBSOCKET_ADDR, OBS_PASSWORD, obs, options...)
+}
 
-	boxtroll, err := boxtroll.New(ctx, s, stream, OBS_WEBSOCKET_ADDR, OBS_PASSWORD, obs)
+// Create the danmaku sender of the given sink, shared by all rooms. The returned function
+// releases the sender once all rooms have shut down.
+func newDanmakuSender(sink boxtroll.DanmakuSink) (boxtroll.DanmakuSender, func(), error) {
+	switch sink {
+	case boxtroll.DanmakuSinkLog:
+		log.Info().Msg("弹幕只输出到日志, 不会发送到直播间")
+		return boxtroll.LogDanmakuSender{}, func() {}, nil
+	case boxtroll.DanmakuSinkStdout:
+		log.Info().Msg("弹幕输出到终端, 不会发送到直播间")
+		return boxtroll.NewWriterDanmakuSender(os.Stdout), func() {}, nil
+	case boxtroll.DanmakuSinkFile:
+		name := DANMAKU_SINK_FILE
+		if name == "" {
+			name = path.Join(ROOT_DIR, DANMAKU_FILE)
+		}
+		f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, nil, err
+		}
+		log.Info().Str("file", name).Msg("弹幕输出到文件, 不会发送到直播间")
+		return boxtroll.NewWriterDanmakuSender(f), func() { f.Close() }, nil
+	default:
+		return boxtroll.NewBilibiliDanmakuSender(), func() {}, nil
+	}
+}
+
+// Create a capture file of the given room under dir, e.g., <dir>/22637261-20250101T120000.btcap
+func createCapture(dir string, roomID int64) (*os.File, *live.CaptureWriter, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, nil, err
+	}
+
+	name := path.Join(dir, fmt.Sprintf("%d-%s.btcap", roomID, time.Now().Format("20060102T150405")))
+	f, err := os.Create(name)
 	if err != nil {
-		log.Fatal().Err(err).Msg("无法启动盒子怪")
+		return nil, nil, err
 	}
 
-	boxtroll.Run(ctx)
+	capture, err := live.NewCaptureWriter(f, roomID)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	return f, capture, nil
 }
 
 // Initialize verified user credential and return the UID of the credential holder.
@@ -269,7 +466,8 @@ func ensureDirs() error {
 	return nil
 }
 
-func initializeGlobalFlags() {
+// Resolve the global flags and the working directories. Returns the unknown keys in the config file.
+func initializeGlobalFlags(cmd *cobra.Command) []string {
 	if ROOT_DIR == "" {
 		rootDir, err := getDefaultRootDir()
 		if err != nil {
@@ -278,9 +476,20 @@ func initializeGlobalFlags() {
 		ROOT_DIR = path.Join(rootDir, ".boxtroll")
 	}
 
+	// The config file lives under ROOT_DIR, so ROOT_DIR itself can only come from flags or env
+	unknownKeys, err := applyConfig(cmd.Flags(), path.Join(ROOT_DIR, CONFIG_FILE))
+	if err != nil {
+		log.Fatal().Err(err).Msg("无法加载配置")
+	}
+
 	LOG_DIR = path.Join(ROOT_DIR, LOG_SUBDIR)
 	DB_DIR = path.Join(ROOT_DIR, DB_SUBDIR)
+	if STORAGE_DIR != "" {
+		DB_DIR = STORAGE_DIR
+	}
 	CREDS_DIR = path.Join(ROOT_DIR, CREDS_SUBDIR)
+
+	return unknownKeys
 }
 
 func getDefaultRootDir() (string, error) {
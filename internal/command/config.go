@@ -0,0 +1,349 @@
+package command
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/BurntSushi/toml"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+const (
+	// Config file under ROOT_DIR
+	CONFIG_FILE = "config.toml"
+	// Prefix of the environment variables overriding config values, e.g., BOXTROLL_ROOM_ID
+	ENV_PREFIX = "BOXTROLL_"
+)
+
+// Content of the config file. Every field is bound to a persistent flag, and the effective
+// value is resolved with precedence flags > env > file > defaults.
+type Config struct {
+	Room    RoomConfig    `toml:"room"`
+	OBS     OBSConfig     `toml:"obs"`
+	Overlay OverlayConfig `toml:"overlay"`
+	Live    LiveConfig    `toml:"live"`
+	Danmaku DanmakuConfig `toml:"danmaku"`
+	Log     LogConfig     `toml:"log"`
+	Storage StorageConfig `toml:"storage"`
+
+	Leaderboard LeaderboardConfig `toml:"leaderboard"`
+}
+
+type RoomConfig struct {
+	IDs RoomIDs `toml:"id"`
+}
+
+// Live rooms to monitor. Accepts a single room, e.g., id = 123, or several rooms, e.g., id = [123, 456].
+type RoomIDs []int64
+
+func (r *RoomIDs) UnmarshalTOML(value any) error {
+	switch v := value.(type) {
+	case int64:
+		*r = RoomIDs{v}
+	case []any:
+		ids := make(RoomIDs, 0, len(v))
+		for _, elem := range v {
+			id, ok := elem.(int64)
+			if !ok {
+				return fmt.Errorf("直播间号必须是整数: %v", elem)
+			}
+			ids = append(ids, id)
+		}
+		*r = ids
+	default:
+		return fmt.Errorf("直播间号必须是整数或整数数组: %v", value)
+	}
+	return nil
+}
+
+type OBSConfig struct {
+	WebsocketAddr string `toml:"websocket_addr"`
+	Password      string `toml:"password"`
+}
+
+type OverlayConfig struct {
+	Addr string `toml:"addr"`
+}
+
+type LiveConfig struct {
+	Transport string `toml:"transport"`
+}
+
+type DanmakuConfig struct {
+	BatchTemplate   string `toml:"batch_template"`
+	HistoryTemplate string `toml:"history_template"`
+	MinLoss         int64  `toml:"min_loss"`
+	Sink            string `toml:"sink"`
+	SinkFile        string `toml:"sink_file"`
+}
+
+type LeaderboardConfig struct {
+	Boards LeaderboardDefs `toml:"boards"`
+}
+
+// Gift leaderboards, see boxtroll.ParseLeaderboardSpecs. Accepts a single string with boards separated
+// by semicolons, or an array with a board per element, e.g., boards = ["gift=电影票", "gift=小花花,scope=day"].
+type LeaderboardDefs []string
+
+func (l *LeaderboardDefs) UnmarshalTOML(value any) error {
+	switch v := value.(type) {
+	case string:
+		*l = splitLeaderboardDefs(v)
+	case []any:
+		defs := make(LeaderboardDefs, 0, len(v))
+		for _, elem := range v {
+			def, ok := elem.(string)
+			if !ok {
+				return fmt.Errorf("排行榜配置必须是字符串: %v", elem)
+			}
+			defs = append(defs, def)
+		}
+		*l = defs
+	default:
+		return fmt.Errorf("排行榜配置必须是字符串或字符串数组: %v", value)
+	}
+	return nil
+}
+
+func splitLeaderboardDefs(value string) LeaderboardDefs {
+	var defs LeaderboardDefs
+	for def := range strings.SplitSeq(value, ";") {
+		if def = strings.TrimSpace(def); def != "" {
+			defs = append(defs, def)
+		}
+	}
+	return defs
+}
+
+type LogConfig struct {
+	Verbose    int `toml:"verbose"`
+	MaxSize    int `toml:"max_size"`
+	MaxBackups int `toml:"max_backups"`
+	MaxAge     int `toml:"max_age"`
+}
+
+type StorageConfig struct {
+	Dir string `toml:"dir"`
+}
+
+// Binding between a config file key and a persistent flag
+type configBinding struct {
+	key   []string          // Key path in the config file
+	flag  string            // Name of the bound flag
+	field func(*Config) any // Pointer to the bound field
+}
+
+var configBindings = []configBinding{
+	{[]string{"room", "id"}, "room.id", func(c *Config) any { return &c.Room.IDs }},
+	{[]string{"obs", "websocket_addr"}, "obs.websocket.addr", func(c *Config) any { return &c.OBS.WebsocketAddr }},
+	{[]string{"obs", "password"}, "obs.password", func(c *Config) any { return &c.OBS.Password }},
+	{[]string{"overlay", "addr"}, "overlay.addr", func(c *Config) any { return &c.Overlay.Addr }},
+	{[]string{"live", "transport"}, "live.transport", func(c *Config) any { return &c.Live.Transport }},
+	{[]string{"danmaku", "batch_template"}, "danmaku.template.batch", func(c *Config) any { return &c.Danmaku.BatchTemplate }},
+	{[]string{"danmaku", "history_template"}, "danmaku.template.history", func(c *Config) any { return &c.Danmaku.HistoryTemplate }},
+	{[]string{"danmaku", "min_loss"}, "danmaku.min-loss", func(c *Config) any { return &c.Danmaku.MinLoss }},
+	{[]string{"danmaku", "sink"}, "danmaku.sink", func(c *Config) any { return &c.Danmaku.Sink }},
+	{[]string{"danmaku", "sink_file"}, "danmaku.sink.file", func(c *Config) any { return &c.Danmaku.SinkFile }},
+	{[]string{"leaderboard", "boards"}, "leaderboard.boards", func(c *Config) any { return &c.Leaderboard.Boards }},
+	{[]string{"log", "verbose"}, "verbose", func(c *Config) any { return &c.Log.Verbose }},
+	{[]string{"log", "max_size"}, "log.max.size", func(c *Config) any { return &c.Log.MaxSize }},
+	{[]string{"log", "max_backups"}, "log.max.backups", func(c *Config) any { return &c.Log.MaxBackups }},
+	{[]string{"log", "max_age"}, "log.max.age", func(c *Config) any { return &c.Log.MaxAge }},
+	{[]string{"storage", "dir"}, "storage.dir", func(c *Config) any { return &c.Storage.Dir }},
+}
+
+// Environment variable overriding the given flag, e.g., room.id -> BOXTROLL_ROOM_ID
+func envName(flag string) string {
+	return ENV_PREFIX + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(flag))
+}
+
+// Apply the config file and environment variables to flags not set on the command line.
+// Returns the keys in the config file that are not bound to any flag, to be reported once
+// logging is initialized.
+func applyConfig(flags *pflag.FlagSet, configPath string) ([]string, error) {
+	var config Config
+	var meta toml.MetaData
+	var unknownKeys []string
+
+	if _, err := os.Stat(configPath); err == nil {
+		meta, err = toml.DecodeFile(configPath, &config)
+		if err != nil {
+			return nil, fmt.Errorf("无法解析配置文件 %s: %w", configPath, err)
+		}
+		for _, key := range meta.Undecoded() {
+			unknownKeys = append(unknownKeys, key.String())
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	for _, binding := range configBindings {
+		if flags.Changed(binding.flag) {
+			continue
+		}
+
+		if value, ok := os.LookupEnv(envName(binding.flag)); ok {
+			if err := flags.Set(binding.flag, value); err != nil {
+				return nil, fmt.Errorf("环境变量 %s 不合法: %w", envName(binding.flag), err)
+			}
+			continue
+		}
+
+		if meta.IsDefined(binding.key...) {
+			value := fmt.Sprint(deref(binding.field(&config)))
+			if err := flags.Set(binding.flag, value); err != nil {
+				return nil, fmt.Errorf("配置项 %s 不合法: %w", strings.Join(binding.key, "."), err)
+			}
+		}
+	}
+
+	return unknownKeys, nil
+}
+
+// The effective config resolved from flags, env, the config file and defaults.
+func effectiveConfig(flags *pflag.FlagSet) (*Config, error) {
+	var config Config
+	for _, binding := range configBindings {
+		flag := flags.Lookup(binding.flag)
+		if flag == nil {
+			// unreachable
+			panic("config bound to unknown flag: " + binding.flag)
+		}
+
+		if err := setField(binding.field(&config), flag.Value.String()); err != nil {
+			return nil, fmt.Errorf("无法读取配置项 %s: %w", binding.flag, err)
+		}
+	}
+
+	return &config, nil
+}
+
+func deref(ptr any) any {
+	switch v := ptr.(type) {
+	case *string:
+		return *v
+	case *int:
+		return *v
+	case *int64:
+		return *v
+	case *RoomIDs:
+		// In the format accepted by int64 slice flags
+		ids := make([]string, 0, len(*v))
+		for _, id := range *v {
+			ids = append(ids, strconv.FormatInt(id, 10))
+		}
+		return strings.Join(ids, ",")
+	case *LeaderboardDefs:
+		// In the format accepted by the leaderboard flag
+		return strings.Join(*v, "; ")
+	default:
+		panic(fmt.Sprintf("unsupported config field type %T", ptr))
+	}
+}
+
+func setField(ptr any, value string) error {
+	var err error
+	switch v := ptr.(type) {
+	case *string:
+		*v = value
+	case *int:
+		*v, err = strconv.Atoi(value)
+	case *int64:
+		*v, err = strconv.ParseInt(value, 10, 64)
+	case *RoomIDs:
+		*v, err = parseRoomIDs(strings.Trim(value, "[]"))
+	case *LeaderboardDefs:
+		*v = splitLeaderboardDefs(value)
+	default:
+		panic(fmt.Sprintf("unsupported config field type %T", ptr))
+	}
+	return err
+}
+
+// Parse room IDs separated by commas or whitespaces, e.g., "123, 456"
+func parseRoomIDs(value string) (RoomIDs, error) {
+	var ids RoomIDs
+	for _, field := range strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == '，' || unicode.IsSpace(r)
+	}) {
+		id, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("无法解析直播间号 %s: %w", field, err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "管理配置文件",
+}
+
+var configInitForce bool
+
+var configInitCmd = &cobra.Command{
+	Use:   "init",
+	Short: fmt.Sprintf("将当前生效的配置写入 <工作目录>/%s", CONFIG_FILE),
+	Run: func(cmd *cobra.Command, args []string) {
+		configPath := path.Join(ROOT_DIR, CONFIG_FILE)
+		if _, err := os.Stat(configPath); err == nil && !configInitForce {
+			cmd.PrintErrf("配置文件 %s 已存在, 使用 --force 覆盖\n", configPath)
+			os.Exit(1)
+		}
+
+		config, err := effectiveConfig(cmd.Flags())
+		if err != nil {
+			cmd.PrintErrf("无法生成配置: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		f, err := os.OpenFile(configPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			cmd.PrintErrf("无法写入配置文件: %s\n", err.Error())
+			os.Exit(1)
+		}
+		defer f.Close()
+
+		if err := toml.NewEncoder(f).Encode(config); err != nil {
+			cmd.PrintErrf("无法写入配置文件: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		cmd.Printf("配置文件已写入 %s\n", configPath)
+	},
+}
+
+var configShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "显示当前生效的配置 (命令行参数 > 环境变量 > 配置文件 > 默认值)",
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := effectiveConfig(cmd.Flags())
+		if err != nil {
+			cmd.PrintErrf("无法生成配置: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		if config.OBS.Password != "" {
+			config.OBS.Password = "******"
+		}
+
+		if err := toml.NewEncoder(cmd.OutOrStdout()).Encode(config); err != nil {
+			cmd.PrintErrf("无法输出配置: %s\n", err.Error())
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	configInitCmd.Flags().BoolVarP(&configInitForce, "force", "f", false, "覆盖已存在的配置文件")
+
+	configCmd.AddCommand(configInitCmd)
+	configCmd.AddCommand(configShowCmd)
+}
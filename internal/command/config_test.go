@@ -0,0 +1,190 @@
+package command
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+// A flag set with every flag bound to the config and the same defaults as BoxtrollCmd
+func newConfigFlags() *pflag.FlagSet {
+	flags := pflag.NewFlagSet("boxtroll", pflag.ContinueOnError)
+	flags.Int64SliceP("room.id", "r", nil, "")
+	flags.String("obs.websocket.addr", "localhost:4455", "")
+	flags.String("obs.password", "", "")
+	flags.String("overlay.addr", "", "")
+	flags.String("live.transport", "auto", "")
+	flags.String("danmaku.template.batch", "", "")
+	flags.String("danmaku.template.history", "", "")
+	flags.Int64("danmaku.min-loss", 0, "")
+	flags.String("danmaku.sink", "bilibili", "")
+	flags.String("danmaku.sink.file", "", "")
+	flags.String("leaderboard.boards", "gift=电影票", "")
+	flags.CountP("verbose", "v", "")
+	flags.Int("log.max.size", 100, "")
+	flags.Int("log.max.backups", 10, "")
+	flags.Int("log.max.age", 30, "")
+	flags.String("storage.dir", "", "")
+	return flags
+}
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+
+	configPath := filepath.Join(t.TempDir(), CONFIG_FILE)
+	if err := os.WriteFile(configPath, []byte(content), 0600); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+	return configPath
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	configPath := writeConfig(t, `
+[obs]
+websocket_addr = "file:4455"
+password = "file"
+passwd = "typo"
+
+[overlay]
+addr = "file:8787"
+
+[log]
+verbose = 1
+`)
+	t.Setenv(envName("obs.password"), "env")
+	t.Setenv(envName("overlay.addr"), "env:8787")
+
+	flags := newConfigFlags()
+	if err := flags.Parse([]string{"--obs.password", "flag"}); err != nil {
+		t.Fatalf("failed to parse flags: %v", err)
+	}
+
+	unknownKeys, err := applyConfig(flags, configPath)
+	if err != nil {
+		t.Fatalf("failed to apply config: %v", err)
+	}
+	if !slices.Equal(unknownKeys, []string{"obs.passwd"}) {
+		t.Fatalf("expected unknown key obs.passwd, got %v", unknownKeys)
+	}
+
+	config, err := effectiveConfig(flags)
+	if err != nil {
+		t.Fatalf("failed to resolve config: %v", err)
+	}
+	tests := []struct {
+		name     string
+		actual   any
+		expected any
+	}{
+		{"flag over env and file", config.OBS.Password, "flag"},
+		{"env over file", config.Overlay.Addr, "env:8787"},
+		{"file over default", config.OBS.WebsocketAddr, "file:4455"},
+		{"file count flag", config.Log.Verbose, 1},
+		{"default", config.Danmaku.Sink, "bilibili"},
+		{"default int", config.Log.MaxSize, 100},
+	}
+	for _, test := range tests {
+		if test.actual != test.expected {
+			t.Fatalf("%s: expected %v, got %v", test.name, test.expected, test.actual)
+		}
+	}
+
+	// No config file is fine
+	if _, err := applyConfig(newConfigFlags(), filepath.Join(t.TempDir(), CONFIG_FILE)); err != nil {
+		t.Fatalf("expected no error without a config file, got %v", err)
+	}
+
+	// Invalid values are reported with their source
+	t.Setenv(envName("log.max.size"), "many")
+	if _, err := applyConfig(newConfigFlags(), configPath); err == nil {
+		t.Fatalf("expected error for invalid env value, got nil")
+	}
+}
+
+// Room IDs and leaderboards are lists, and go through their string flags as a whole.
+func TestConfigListRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		env     map[string]string
+		roomIDs RoomIDs
+		boards  LeaderboardDefs
+	}{
+		{
+			name: "arrays",
+			config: `
+[room]
+id = [123, 456]
+
+[leaderboard]
+boards = ["gift=电影票,metric=count", "gift=小花花,scope=day"]
+`,
+			roomIDs: RoomIDs{123, 456},
+			boards:  LeaderboardDefs{"gift=电影票,metric=count", "gift=小花花,scope=day"},
+		},
+		{
+			name: "scalars",
+			config: `
+[room]
+id = 123
+
+[leaderboard]
+boards = "gift=电影票; gift=小花花,scope=day"
+`,
+			roomIDs: RoomIDs{123},
+			boards:  LeaderboardDefs{"gift=电影票", "gift=小花花,scope=day"},
+		},
+		{
+			name: "env",
+			env: map[string]string{
+				envName("room.id"):            "1,2",
+				envName("leaderboard.boards"): "gift=小花花;gift=电影票,top=3",
+			},
+			roomIDs: RoomIDs{1, 2},
+			boards:  LeaderboardDefs{"gift=小花花", "gift=电影票,top=3"},
+		},
+		{
+			name:    "defaults",
+			roomIDs: nil,
+			boards:  LeaderboardDefs{"gift=电影票"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+
+			flags := newConfigFlags()
+			if _, err := applyConfig(flags, writeConfig(t, test.config)); err != nil {
+				t.Fatalf("failed to apply config: %v", err)
+			}
+			config, err := effectiveConfig(flags)
+			if err != nil {
+				t.Fatalf("failed to resolve config: %v", err)
+			}
+			if !slices.Equal(config.Room.IDs, test.roomIDs) {
+				t.Fatalf("expected room IDs %v, got %v", test.roomIDs, config.Room.IDs)
+			}
+			if !slices.Equal(config.Leaderboard.Boards, test.boards) {
+				t.Fatalf("expected leaderboards %q, got %q", test.boards, config.Leaderboard.Boards)
+			}
+
+			// The flag values written back by deref are parsed into the same lists
+			var roundTrip Config
+			if err := setField(&roundTrip.Room.IDs, deref(&config.Room.IDs).(string)); err != nil {
+				t.Fatalf("failed to set room IDs: %v", err)
+			}
+			if err := setField(&roundTrip.Leaderboard.Boards, deref(&config.Leaderboard.Boards).(string)); err != nil {
+				t.Fatalf("failed to set leaderboards: %v", err)
+			}
+			if !slices.Equal(roundTrip.Room.IDs, config.Room.IDs) || !slices.Equal(roundTrip.Leaderboard.Boards, config.Leaderboard.Boards) {
+				t.Fatalf("expected %v and %q after round trip, got %v and %q", config.Room.IDs, config.Leaderboard.Boards, roundTrip.Room.IDs, roundTrip.Leaderboard.Boards)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package command
+
+import (
+	"os"
+
+	"github.com/YangchenYe323/boxtroll/internal/store"
+	"github.com/spf13/cobra"
+)
+
+var migrateDryRun bool
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "升级数据库到当前版本",
+	Long: `升级数据库到当前版本。启动盒子怪时会自动升级, 升级前会在数据库目录旁备份整个数据库。
+使用 --dry-run 只显示需要执行的升级步骤, 不修改数据库。盒子怪运行时无法升级, 请先关闭盒子怪。`,
+	Run: func(cmd *cobra.Command, args []string) {
+		results, err := store.Migrate(DB_DIR, migrateDryRun)
+		if err != nil {
+			cmd.PrintErrf("数据库升级失败: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		if len(results) == 0 {
+			cmd.Printf("数据库已是最新版本 %d\n", store.SCHEMA_VERSION)
+			return
+		}
+
+		for _, result := range results {
+			if migrateDryRun {
+				cmd.Printf("[待执行] 版本 %d: %s (%d 条记录)\n", result.Version, result.Description, result.Keys)
+			} else {
+				cmd.Printf("[已完成] 版本 %d: %s (%d 条记录)\n", result.Version, result.Description, result.Keys)
+			}
+		}
+	},
+}
+
+func init() {
+	migrateCmd.Flags().BoolVar(&migrateDryRun, "dry-run", false, "只显示需要执行的升级步骤, 不修改数据库")
+}
@@ -0,0 +1,123 @@
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/YangchenYe323/boxtroll/internal/analytics"
+	"github.com/YangchenYe323/boxtroll/internal/store"
+	"github.com/spf13/cobra"
+)
+
+var (
+	outcomesRoomIDs []int64
+	outcomesUID     int64
+	outcomesFormat  string
+)
+
+// Outcome report of a blind box in a room
+type outcomeRow struct {
+	RoomID int64 `json:"room_id"`
+	*analytics.OutcomeReport
+}
+
+var outcomesCmd = &cobra.Command{
+	Use:   "outcomes",
+	Short: "比较盲盒爆出各个礼物的实际概率和公布概率",
+	Long: `统计每种盲盒爆出各个礼物的次数, 与B站公布的爆率比较。
+z 为爆出次数偏离期望的标准差倍数, 期望次数至少为 ` + fmt.Sprint(analytics.MIN_EXPECTED_COUNT) + ` 且 |z| ≥ ` + fmt.Sprint(analytics.SIGNIFICANCE_Z) + ` 时认为偏离显著。
+数据库以只读方式打开, 盒子怪运行时无法查询, 请先关闭盒子怪。`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if outcomesFormat != "table" && outcomesFormat != "json" {
+			cmd.PrintErrf("不支持的 --format %s, 可选 table, json\n", outcomesFormat)
+			os.Exit(1)
+		}
+
+		s, err := store.NewBadger(DB_DIR, store.WithReadOnly())
+		if err != nil {
+			cmd.PrintErrf("无法打开数据库 %s, 请确认盒子怪没有在运行: %s\n", DB_DIR, err.Error())
+			os.Exit(1)
+		}
+		defer s.Close()
+
+		roomIDs := outcomesRoomIDs
+		if len(roomIDs) == 0 {
+			roomIDs, err = s.ListAllRoomIDs(cmd.Context())
+			if err != nil {
+				cmd.PrintErrf("无法读取直播间列表: %s\n", err.Error())
+				os.Exit(1)
+			}
+		}
+		slices.Sort(roomIDs)
+
+		rows := []*outcomeRow{}
+		for _, roomID := range roomIDs {
+			room, err := s.GetRoom(cmd.Context(), roomID)
+			if err != nil {
+				cmd.PrintErrf("无法读取直播间 %d: %s\n", roomID, err.Error())
+				os.Exit(1)
+			}
+			counts, err := s.ListOutcomeCounts(cmd.Context(), roomID, outcomesUID)
+			if err != nil {
+				cmd.PrintErrf("无法读取直播间 %d 的盲盒爆出统计: %s\n", roomID, err.Error())
+				os.Exit(1)
+			}
+
+			for _, report := range analytics.AnalyzeOutcomes(room, counts) {
+				rows = append(rows, &outcomeRow{RoomID: roomID, OutcomeReport: report})
+			}
+		}
+
+		if outcomesFormat == "json" {
+			encoder := json.NewEncoder(cmd.OutOrStdout())
+			encoder.SetIndent("", "  ")
+			err = encoder.Encode(rows)
+		} else {
+			err = writeOutcomesTable(cmd, rows)
+		}
+		if err != nil {
+			cmd.PrintErrf("无法输出盲盒爆出统计: %s\n", err.Error())
+			os.Exit(1)
+		}
+	},
+}
+
+func writeOutcomesTable(cmd *cobra.Command, rows []*outcomeRow) error {
+	tw := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(tw, strings.Join([]string{"直播间", "盲盒", "礼物", "价格(电池)", "公布概率", "次数", "实际概率", "z", "结论"}, "\t"))
+	for _, row := range rows {
+		name := row.Name
+		if name == "" {
+			name = fmt.Sprintf("礼物 %d", row.GiftID)
+		}
+		price, advertised := "-", "-"
+		if row.Verdict != analytics.VerdictUnlisted {
+			price = fmt.Sprintf("%.1f", float64(row.Price)/100)
+			advertised = row.AdvertisedChance
+		}
+		fmt.Fprintln(tw, strings.Join([]string{
+			fmt.Sprint(row.RoomID),
+			row.BoxName,
+			name,
+			price,
+			advertised,
+			fmt.Sprintf("%d/%d", row.Num, row.TotalNum),
+			fmt.Sprintf("%.3f%%", row.ObservedChance*100),
+			fmt.Sprintf("%+.2f", row.Z),
+			row.Verdict.Label(),
+		}, "\t"))
+	}
+
+	return tw.Flush()
+}
+
+func init() {
+	outcomesCmd.Flags().Int64SliceVar(&outcomesRoomIDs, "room", nil, "只查询指定的直播间 (默认查询所有直播间)")
+	outcomesCmd.Flags().Int64VarP(&outcomesUID, "user", "u", 0, "只统计指定 UID 的用户 (默认统计直播间所有用户)")
+	outcomesCmd.Flags().StringVarP(&outcomesFormat, "format", "f", "table", "输出格式: table, json")
+}
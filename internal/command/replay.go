@@ -0,0 +1,118 @@
+package command
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/YangchenYe323/boxtroll/internal/boxtroll"
+	"github.com/YangchenYe323/boxtroll/internal/command/login"
+	"github.com/YangchenYe323/boxtroll/internal/live"
+	"github.com/YangchenYe323/boxtroll/internal/store"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var (
+	replaySpeed      float64
+	replayScratchDir string
+)
+
+var replayCmd = &cobra.Command{
+	Use:   "replay <抓包文件>",
+	Short: "回放 --live.capture-dir 录制的抓包文件",
+	Long: `回放 --live.capture-dir 录制的抓包文件, 消息经过与直播时完全相同的处理流程。
+统计写入临时数据库, 不影响盒子怪的数据库; 盈亏播报只输出到日志, 不连接OBS。
+弹幕不会发送到直播间, 默认输出到日志, 也可以用 --danmaku.sink stdout 或 file 输出到终端或文件。
+直播间和用户信息仍然从B站获取, 如果有缓存的登录凭证会使用它。`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if replaySpeed < 0 {
+			cmd.PrintErrf("--speed 不能为负数\n")
+			os.Exit(1)
+		}
+
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		// A replay never speaks in the streamer's chat
+		sink, err := boxtroll.ParseDanmakuSink(DANMAKU_SINK)
+		if err != nil {
+			log.Fatal().Err(err).Msg("无法解析 --danmaku.sink")
+		}
+		if sink == boxtroll.DanmakuSinkBilibili {
+			sink = boxtroll.DanmakuSinkLog
+		}
+		sender, closeSender, err := newDanmakuSender(sink)
+		if err != nil {
+			log.Fatal().Err(err).Msg("无法创建弹幕输出")
+		}
+		defer closeSender()
+
+		template, err := boxtroll.NewDanmakuTemplate(DANMAKU_TEMPLATE_BATCH, DANMAKU_TEMPLATE_HISTORY, DANMAKU_MIN_LOSS)
+		if err != nil {
+			log.Fatal().Err(err).Msg("无法解析弹幕模板")
+		}
+
+		leaderboards, err := boxtroll.ParseLeaderboardSpecs(LEADERBOARDS)
+		if err != nil {
+			log.Fatal().Err(err).Msg("无法解析 --leaderboard.boards")
+		}
+
+		f, err := os.Open(args[0])
+		if err != nil {
+			log.Fatal().Err(err).Msg("无法打开抓包文件")
+		}
+		defer f.Close()
+
+		capture, err := live.NewCaptureReader(f)
+		if err != nil {
+			log.Fatal().Err(err).Msg("无法读取抓包文件")
+		}
+
+		// Not required, but user names are resolved more reliably when logged in
+		if cred, err := login.GetCachedCredential(CREDS_DIR); err == nil {
+			if _, err := initializeBilibili(ctx, cred); err != nil {
+				log.Warn().Err(err).Msg("无法使用缓存的登录凭证, 以未登录状态回放")
+			}
+		}
+
+		dbDir := replayScratchDir
+		if dbDir == "" {
+			dbDir, err = os.MkdirTemp("", "boxtroll-replay-")
+			if err != nil {
+				log.Fatal().Err(err).Msg("无法创建临时数据库目录")
+			}
+			defer os.RemoveAll(dbDir)
+		}
+
+		s, err := store.NewBadger(dbDir)
+		if err != nil {
+			log.Fatal().Err(err).Msg("无法打开临时数据库")
+		}
+		defer s.Close()
+
+		log.Info().Int64("room", capture.RoomID).Str("db", dbDir).Float64("speed", replaySpeed).Msg("开始回放抓包文件")
+
+		replay := live.NewReplay(capture, replaySpeed)
+		b, err := boxtroll.New(ctx, s, replay, "", "", nil,
+			boxtroll.WithDanmakuTemplate(template),
+			boxtroll.WithDanmakuSender(sender),
+			boxtroll.WithLeaderboards(leaderboards),
+			boxtroll.WithReportLog(),
+		)
+		if err != nil {
+			// Not fatal, so that the scratch database is cleaned up
+			log.Err(err).Msg("无法初始化盒子怪")
+			return
+		}
+
+		// Returns once the capture is exhausted or on Ctrl-C, after the final flush
+		b.Run(ctx)
+	},
+}
+
+func init() {
+	replayCmd.Flags().Float64Var(&replaySpeed, "speed", 1, "回放速度, 相对于录制时的倍数 (0 表示尽快回放)")
+	replayCmd.Flags().StringVar(&replayScratchDir, "scratch-dir", "", "回放使用的数据库目录 (默认使用临时目录, 回放结束后删除)")
+}
@@ -0,0 +1,164 @@
+package command
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/YangchenYe323/boxtroll/internal/store"
+	"github.com/spf13/cobra"
+)
+
+var (
+	revenueRoomIDs []int64
+	revenueUID     int64
+	revenueLatest  bool
+	revenueFormat  string
+)
+
+// Revenue of a user in a room, prices are in the same unit as gift prices
+type revenueRow struct {
+	RoomID    int64  `json:"room_id"`
+	UID       int64  `json:"uid"`
+	Name      string `json:"name"`
+	Guard     int64  `json:"guard"`      // 大航海
+	SuperChat int64  `json:"super_chat"` // 醒目留言
+	Total     int64  `json:"total"`
+	Events    int    `json:"events"` // Number of revenue events
+}
+
+var revenueCmd = &cobra.Command{
+	Use:   "revenue",
+	Short: "查询大航海和醒目留言的营收统计",
+	Long: `按用户统计直播间的大航海 (舰长/提督/总督) 和醒目留言营收, 单位为电池。
+数据库以只读方式打开, 盒子怪运行时无法查询, 请先关闭盒子怪。`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if revenueFormat != "table" && revenueFormat != "json" {
+			cmd.PrintErrf("不支持的 --format %s, 可选 table, json\n", revenueFormat)
+			os.Exit(1)
+		}
+
+		s, err := store.NewBadger(DB_DIR, store.WithReadOnly())
+		if err != nil {
+			cmd.PrintErrf("无法打开数据库 %s, 请确认盒子怪没有在运行: %s\n", DB_DIR, err.Error())
+			os.Exit(1)
+		}
+		defer s.Close()
+
+		roomIDs := revenueRoomIDs
+		if len(roomIDs) == 0 {
+			roomIDs, err = s.ListAllRoomIDs(cmd.Context())
+			if err != nil {
+				cmd.PrintErrf("无法读取直播间列表: %s\n", err.Error())
+				os.Exit(1)
+			}
+		}
+		slices.Sort(roomIDs)
+
+		rows := []*revenueRow{}
+		for _, roomID := range roomIDs {
+			var start time.Time
+			var session *store.Session
+			if revenueLatest {
+				session, err = s.GetLatestSession(cmd.Context(), roomID)
+				if errors.Is(err, store.ErrNotFound) {
+					continue
+				}
+				if err != nil {
+					cmd.PrintErrf("无法读取直播间 %d 的直播场次: %s\n", roomID, err.Error())
+					os.Exit(1)
+				}
+				start = session.StartTime
+			}
+
+			var events []*store.RevenueEvent
+			if revenueUID != 0 {
+				events, err = s.ListRevenueEventsByUser(cmd.Context(), roomID, revenueUID, start, time.Time{})
+			} else {
+				events, err = s.ListRevenueEventsByTime(cmd.Context(), roomID, start, time.Time{})
+			}
+			if err != nil {
+				cmd.PrintErrf("无法读取直播间 %d 的营收记录: %s\n", roomID, err.Error())
+				os.Exit(1)
+			}
+
+			byUser := make(map[int64]*revenueRow)
+			for _, event := range events {
+				if session != nil && event.SessionID != session.ID {
+					continue
+				}
+				row, ok := byUser[event.UID]
+				if !ok {
+					row = &revenueRow{RoomID: roomID, UID: event.UID}
+					if user, err := s.GetUser(cmd.Context(), event.UID); err == nil {
+						row.Name = user.Name
+					}
+					byUser[event.UID] = row
+				}
+				switch event.Kind {
+				case store.RevenueKindGuard:
+					row.Guard += event.TotalPrice()
+				case store.RevenueKindSuperChat:
+					row.SuperChat += event.TotalPrice()
+				}
+				row.Total += event.TotalPrice()
+				row.Events++
+			}
+
+			roomRows := make([]*revenueRow, 0, len(byUser))
+			for _, row := range byUser {
+				roomRows = append(roomRows, row)
+			}
+			slices.SortFunc(roomRows, func(a, b *revenueRow) int {
+				if a.Total != b.Total {
+					return int(b.Total - a.Total)
+				}
+				return int(a.UID - b.UID)
+			})
+			rows = append(rows, roomRows...)
+		}
+
+		if revenueFormat == "json" {
+			encoder := json.NewEncoder(cmd.OutOrStdout())
+			encoder.SetIndent("", "  ")
+			err = encoder.Encode(rows)
+		} else {
+			err = writeRevenueTable(cmd, rows)
+		}
+		if err != nil {
+			cmd.PrintErrf("无法输出营收统计: %s\n", err.Error())
+			os.Exit(1)
+		}
+	},
+}
+
+func writeRevenueTable(cmd *cobra.Command, rows []*revenueRow) error {
+	tw := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(tw, strings.Join([]string{"直播间", "UID", "用户", "大航海(电池)", "醒目留言(电池)", "合计(电池)", "次数"}, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join([]string{
+			fmt.Sprint(row.RoomID),
+			fmt.Sprint(row.UID),
+			row.Name,
+			fmt.Sprint(row.Guard / 100),
+			fmt.Sprint(row.SuperChat / 100),
+			fmt.Sprint(row.Total / 100),
+			fmt.Sprint(row.Events),
+		}, "\t"))
+	}
+
+	return tw.Flush()
+}
+
+func init() {
+	revenueCmd.Flags().Int64SliceVar(&revenueRoomIDs, "room", nil, "只查询指定的直播间 (默认查询所有直播间)")
+	revenueCmd.Flags().Int64VarP(&revenueUID, "user", "u", 0, "只统计指定 UID 的用户 (默认统计直播间所有用户)")
+	revenueCmd.Flags().BoolVar(&revenueLatest, "latest", false, "只统计每个直播间最近一场直播")
+	revenueCmd.Flags().StringVarP(&revenueFormat, "format", "f", "table", "输出格式: table, json")
+}
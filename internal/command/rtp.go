@@ -0,0 +1,118 @@
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/YangchenYe323/boxtroll/internal/analytics"
+	"github.com/YangchenYe323/boxtroll/internal/store"
+	"github.com/spf13/cobra"
+)
+
+var (
+	rtpRoomIDs []int64
+	rtpFormat  string
+)
+
+// Return-to-player report of a blind box in a room
+type rtpRow struct {
+	RoomID int64 `json:"room_id"`
+	*analytics.BoxReport
+}
+
+var rtpCmd = &cobra.Command{
+	Use:   "rtp",
+	Short: "比较盲盒的理论返还率和直播间的实际返还率",
+	Long: `根据B站公布的盲盒爆率计算每种盲盒的理论返还率 (期望价值 / 盲盒价格), 与直播间所有用户的实际返还率比较。
+z 为实际爆出价值偏离期望的标准差倍数, 开出至少 ` + fmt.Sprint(analytics.MIN_SAMPLE_SIZE) + ` 个盲盒且 |z| ≥ ` + fmt.Sprint(analytics.SIGNIFICANCE_Z) + ` 时认为偏离显著。
+数据库以只读方式打开, 盒子怪运行时无法查询, 请先关闭盒子怪。`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if rtpFormat != "table" && rtpFormat != "json" {
+			cmd.PrintErrf("不支持的 --format %s, 可选 table, json\n", rtpFormat)
+			os.Exit(1)
+		}
+
+		s, err := store.NewBadger(DB_DIR, store.WithReadOnly())
+		if err != nil {
+			cmd.PrintErrf("无法打开数据库 %s, 请确认盒子怪没有在运行: %s\n", DB_DIR, err.Error())
+			os.Exit(1)
+		}
+		defer s.Close()
+
+		roomIDs := rtpRoomIDs
+		if len(roomIDs) == 0 {
+			roomIDs, err = s.ListAllRoomIDs(cmd.Context())
+			if err != nil {
+				cmd.PrintErrf("无法读取直播间列表: %s\n", err.Error())
+				os.Exit(1)
+			}
+		}
+		slices.Sort(roomIDs)
+
+		rows := []*rtpRow{}
+		for _, roomID := range roomIDs {
+			room, err := s.GetRoom(cmd.Context(), roomID)
+			if err != nil {
+				cmd.PrintErrf("无法读取直播间 %d: %s\n", roomID, err.Error())
+				os.Exit(1)
+			}
+			boxStatistics, err := analytics.RoomBoxStatistics(cmd.Context(), s, roomID)
+			if err != nil {
+				cmd.PrintErrf("无法读取直播间 %d 的盲盒统计: %s\n", roomID, err.Error())
+				os.Exit(1)
+			}
+
+			for _, report := range analytics.AnalyzeRoom(room, boxStatistics) {
+				rows = append(rows, &rtpRow{RoomID: roomID, BoxReport: report})
+			}
+		}
+
+		if rtpFormat == "json" {
+			encoder := json.NewEncoder(cmd.OutOrStdout())
+			encoder.SetIndent("", "  ")
+			err = encoder.Encode(rows)
+		} else {
+			err = writeRTPTable(cmd, rows)
+		}
+		if err != nil {
+			cmd.PrintErrf("无法输出返还率: %s\n", err.Error())
+			os.Exit(1)
+		}
+	},
+}
+
+func writeRTPTable(cmd *cobra.Command, rows []*rtpRow) error {
+	tw := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(tw, strings.Join([]string{"直播间", "盲盒", "价格(电池)", "数量", "理论返还率", "实际返还率", "偏离期望(电池)", "z", "结论"}, "\t"))
+	for _, row := range rows {
+		observed, deviation, z := "-", "-", "-"
+		if row.TotalNum > 0 {
+			observed = fmt.Sprintf("%.2f%%", row.ObservedRTP*100)
+			deviation = fmt.Sprintf("%+.1f", (float64(row.TotalPrice)-row.ExpectedPrice)/100)
+			z = fmt.Sprintf("%+.2f", row.Z)
+		}
+		fmt.Fprintln(tw, strings.Join([]string{
+			fmt.Sprint(row.RoomID),
+			row.Name,
+			fmt.Sprintf("%.1f", float64(row.Price)/100),
+			fmt.Sprint(row.TotalNum),
+			fmt.Sprintf("%.2f%%", row.ExpectedRTP*100),
+			observed,
+			deviation,
+			z,
+			row.Verdict.Label(),
+		}, "\t"))
+	}
+
+	return tw.Flush()
+}
+
+func init() {
+	rtpCmd.Flags().Int64SliceVar(&rtpRoomIDs, "room", nil, "只查询指定的直播间 (默认查询所有直播间)")
+	rtpCmd.Flags().StringVarP(&rtpFormat, "format", "f", "table", "输出格式: table, json")
+}
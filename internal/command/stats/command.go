@@ -0,0 +1,76 @@
+package stats
+
+import (
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/YangchenYe323/boxtroll/internal/store"
+	"github.com/spf13/cobra"
+)
+
+var (
+	roomIDs []int64
+	user    string
+	groupBy string
+	sortBy  string
+	reverse bool
+	format  string
+)
+
+var Cmd = &cobra.Command{
+	Use:   "stats",
+	Short: "查询数据库中的盲盒盈亏统计",
+	Long: `查询数据库中的盲盒盈亏统计, 不需要连接直播间。
+数据库以只读方式打开, 盒子怪运行时无法查询, 请先关闭盒子怪。`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if !slices.Contains(groupByValues, groupBy) {
+			cmd.PrintErrf("不支持的 --group-by %s, 可选 %s\n", groupBy, strings.Join(groupByValues, ", "))
+			os.Exit(1)
+		}
+		if _, ok := sortKeys[sortBy]; !ok {
+			cmd.PrintErrf("不支持的 --sort %s, 可选 %s\n", sortBy, strings.Join(sortKeyNames(), ", "))
+			os.Exit(1)
+		}
+		if _, ok := writers[format]; !ok {
+			cmd.PrintErrf("不支持的 --format %s, 可选 table, json, csv\n", format)
+			os.Exit(1)
+		}
+
+		dbDir, err := cmd.Flags().GetString("db-dir")
+		if err != nil {
+			panic("db-dir flag is not defined")
+		}
+
+		s, err := store.NewBadger(dbDir, store.WithReadOnly())
+		if err != nil {
+			cmd.PrintErrf("无法打开数据库 %s, 请确认盒子怪没有在运行: %s\n", dbDir, err.Error())
+			os.Exit(1)
+		}
+		defer s.Close()
+
+		rows, err := queryRows(cmd.Context(), s, roomIDs)
+		if err != nil {
+			cmd.PrintErrf("无法读取统计数据: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		rows = filterRows(rows, user)
+		rows = groupRows(rows, groupBy)
+		sortRows(rows, sortBy, reverse)
+
+		if err := writers[format](cmd.OutOrStdout(), rows, groupBy); err != nil {
+			cmd.PrintErrf("无法输出统计数据: %s\n", err.Error())
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	Cmd.Flags().Int64SliceVar(&roomIDs, "room", nil, "只查询指定的直播间 (默认查询所有直播间)")
+	Cmd.Flags().StringVarP(&user, "user", "u", "", "只查询指定的用户, UID 或用户名的一部分")
+	Cmd.Flags().StringVarP(&groupBy, "group-by", "g", GROUP_BY_BOX, "统计粒度: box (每个用户的每种盲盒), user (每个用户), room (每个直播间)")
+	Cmd.Flags().StringVarP(&sortBy, "sort", "s", "diff", "排序依据: "+strings.Join(sortKeyNames(), ", "))
+	Cmd.Flags().BoolVar(&reverse, "reverse", false, "反转排序 (默认从大到小)")
+	Cmd.Flags().StringVarP(&format, "format", "f", "table", "输出格式: table, json, csv")
+}
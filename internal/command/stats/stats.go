@@ -0,0 +1,342 @@
+package stats
+
+import (
+	"cmp"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/YangchenYe323/boxtroll/internal/store"
+)
+
+const (
+	GROUP_BY_BOX  = "box"
+	GROUP_BY_USER = "user"
+	GROUP_BY_ROOM = "room"
+)
+
+var groupByValues = []string{GROUP_BY_BOX, GROUP_BY_USER, GROUP_BY_ROOM}
+
+// A row of the statistics table. Depending on the grouping, UID and BoxID are 0
+// if the row is aggregated over users or boxes.
+type Row struct {
+	RoomID   int64
+	UID      int64
+	UserName string
+	BoxID    int64
+	BoxName  string
+	st       store.BoxStatistics
+}
+
+func (r *Row) diff() int64 {
+	return r.st.TotalPrice - r.st.TotalOriginalPrice
+}
+
+func (r *Row) returnRate() float64 {
+	if r.st.TotalOriginalPrice == 0 {
+		return 0
+	}
+	return float64(r.st.TotalPrice) / float64(r.st.TotalOriginalPrice) * 100
+}
+
+// Read the statistics of the given rooms, or all rooms if none is given, one row per <room, user, box>.
+func queryRows(ctx context.Context, s store.Store, roomIDs []int64) ([]*Row, error) {
+	if len(roomIDs) == 0 {
+		var err error
+		roomIDs, err = s.ListAllRoomIDs(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	users := make(map[int64]*store.User)
+	var rows []*Row
+	for _, roomID := range roomIDs {
+		room, err := s.GetRoom(ctx, roomID)
+		if err != nil {
+			return nil, fmt.Errorf("无法读取直播间 %d: %w", roomID, err)
+		}
+		boxNames := make(map[int64]string)
+		for _, gift := range room.Gifts {
+			boxNames[gift.GiftID] = gift.Name
+		}
+
+		boxStatistics, err := s.ListAllBoxStatistics(ctx, roomID)
+		if err != nil {
+			return nil, err
+		}
+
+		for key, st := range boxStatistics {
+			_, uid, boxID, err := s.ParseBoxStatisticsKey([]byte(key))
+			if err != nil {
+				return nil, err
+			}
+
+			if _, ok := users[uid]; !ok {
+				user, err := s.GetUser(ctx, uid)
+				if err != nil && !errors.Is(err, store.ErrNotFound) {
+					return nil, err
+				}
+				// The user may not have been fetched from Bilibili yet
+				users[uid] = user
+			}
+
+			row := &Row{
+				RoomID:  roomID,
+				UID:     uid,
+				BoxID:   boxID,
+				BoxName: boxNames[boxID],
+				st:      *st,
+			}
+			if user := users[uid]; user != nil {
+				row.UserName = user.Name
+			}
+			rows = append(rows, row)
+		}
+	}
+
+	return rows, nil
+}
+
+// Keep rows of the given user, matched by UID or a part of the user name.
+func filterRows(rows []*Row, user string) []*Row {
+	if user == "" {
+		return rows
+	}
+
+	uid, err := strconv.ParseInt(user, 10, 64)
+	isUID := err == nil
+
+	return slices.DeleteFunc(rows, func(row *Row) bool {
+		if isUID && row.UID == uid {
+			return false
+		}
+		return !strings.Contains(strings.ToLower(row.UserName), strings.ToLower(user))
+	})
+}
+
+func groupRows(rows []*Row, groupBy string) []*Row {
+	if groupBy == GROUP_BY_BOX {
+		return rows
+	}
+
+	type groupKey struct {
+		roomID int64
+		uid    int64
+	}
+
+	groups := make(map[groupKey]*Row)
+	for _, row := range rows {
+		key := groupKey{roomID: row.RoomID}
+		if groupBy == GROUP_BY_USER {
+			key.uid = row.UID
+		}
+
+		group, ok := groups[key]
+		if !ok {
+			group = &Row{RoomID: row.RoomID}
+			if groupBy == GROUP_BY_USER {
+				group.UID = row.UID
+				group.UserName = row.UserName
+			}
+			groups[key] = group
+		}
+
+		lastUpdateTime := group.st.LastUpdateTime
+		group.st.Merge(row.st)
+		if lastUpdateTime.After(group.st.LastUpdateTime) {
+			group.st.LastUpdateTime = lastUpdateTime
+		}
+	}
+
+	return slices.Collect(maps.Values(groups))
+}
+
+var sortKeys = map[string]func(a, b *Row) int{
+	"diff":     func(a, b *Row) int { return cmp.Compare(a.diff(), b.diff()) },
+	"rate":     func(a, b *Row) int { return cmp.Compare(a.returnRate(), b.returnRate()) },
+	"num":      func(a, b *Row) int { return cmp.Compare(a.st.TotalNum, b.st.TotalNum) },
+	"original": func(a, b *Row) int { return cmp.Compare(a.st.TotalOriginalPrice, b.st.TotalOriginalPrice) },
+	"price":    func(a, b *Row) int { return cmp.Compare(a.st.TotalPrice, b.st.TotalPrice) },
+	"time":     func(a, b *Row) int { return a.st.LastUpdateTime.Compare(b.st.LastUpdateTime) },
+	"uid":      func(a, b *Row) int { return cmp.Compare(a.UID, b.UID) },
+	"name":     func(a, b *Row) int { return strings.Compare(a.UserName, b.UserName) },
+}
+
+func sortKeyNames() []string {
+	return slices.Sorted(maps.Keys(sortKeys))
+}
+
+// Sort rows in descending order of the given key, ties broken by room, user and box
+// so that the output is stable.
+func sortRows(rows []*Row, sortBy string, reverse bool) {
+	compare := sortKeys[sortBy]
+	slices.SortFunc(rows, func(a, b *Row) int {
+		c := compare(b, a)
+		if reverse {
+			c = -c
+		}
+		return cmp.Or(
+			c,
+			cmp.Compare(a.RoomID, b.RoomID),
+			cmp.Compare(a.UID, b.UID),
+			cmp.Compare(a.BoxID, b.BoxID),
+		)
+	})
+}
+
+// Format a price in 金瓜子 as 电池
+func battery(price int64) string {
+	return strconv.FormatFloat(float64(price)/100, 'f', -1, 64)
+}
+
+func columns(groupBy string) []string {
+	switch groupBy {
+	case GROUP_BY_ROOM:
+		return []string{"room_id", "num", "original_price", "price", "diff", "return_rate", "last_update_time"}
+	case GROUP_BY_USER:
+		return []string{"room_id", "uid", "user_name", "num", "original_price", "price", "diff", "return_rate", "last_update_time"}
+	default:
+		return []string{"room_id", "uid", "user_name", "box_id", "box_name", "num", "original_price", "price", "diff", "return_rate", "last_update_time"}
+	}
+}
+
+// Values of the given columns of the row. Prices are in 电池.
+func (r *Row) values(columns []string) []string {
+	var values []string
+	for _, column := range columns {
+		var value string
+		switch column {
+		case "room_id":
+			value = strconv.FormatInt(r.RoomID, 10)
+		case "uid":
+			value = strconv.FormatInt(r.UID, 10)
+		case "user_name":
+			value = r.UserName
+		case "box_id":
+			value = strconv.FormatInt(r.BoxID, 10)
+		case "box_name":
+			value = r.BoxName
+		case "num":
+			value = strconv.FormatInt(r.st.TotalNum, 10)
+		case "original_price":
+			value = battery(r.st.TotalOriginalPrice)
+		case "price":
+			value = battery(r.st.TotalPrice)
+		case "diff":
+			value = battery(r.diff())
+		case "return_rate":
+			value = strconv.FormatFloat(r.returnRate(), 'f', 1, 64)
+		case "last_update_time":
+			if !r.st.LastUpdateTime.IsZero() {
+				value = r.st.LastUpdateTime.Local().Format(time.DateTime)
+			}
+		}
+		values = append(values, value)
+	}
+	return values
+}
+
+type rowWriter = func(w io.Writer, rows []*Row, groupBy string) error
+
+var writers = map[string]rowWriter{
+	"table": writeTable,
+	"json":  writeJSON,
+	"csv":   writeCSV,
+}
+
+var tableHeaders = map[string]string{
+	"room_id":          "直播间",
+	"uid":              "UID",
+	"user_name":        "用户",
+	"box_id":           "盲盒ID",
+	"box_name":         "盲盒",
+	"num":              "数量",
+	"original_price":   "原价(电池)",
+	"price":            "爆出(电池)",
+	"diff":             "盈亏(电池)",
+	"return_rate":      "返还率(%)",
+	"last_update_time": "最后更新",
+}
+
+func writeTable(w io.Writer, rows []*Row, groupBy string) error {
+	columns := columns(groupBy)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	var headers []string
+	for _, column := range columns {
+		headers = append(headers, tableHeaders[column])
+	}
+	fmt.Fprintln(tw, strings.Join(headers, "\t"))
+
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row.values(columns), "\t"))
+	}
+
+	return tw.Flush()
+}
+
+func writeCSV(w io.Writer, rows []*Row, groupBy string) error {
+	columns := columns(groupBy)
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(columns); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if err := cw.Write(row.values(columns)); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+
+	return cw.Error()
+}
+
+// JSON representation of a row. Prices are in 电池.
+type jsonRow struct {
+	RoomID         int64     `json:"room_id"`
+	UID            int64     `json:"uid,omitempty"`
+	UserName       string    `json:"user_name,omitempty"`
+	BoxID          int64     `json:"box_id,omitempty"`
+	BoxName        string    `json:"box_name,omitempty"`
+	Num            int64     `json:"num"`
+	OriginalPrice  float64   `json:"original_price"`
+	Price          float64   `json:"price"`
+	Diff           float64   `json:"diff"`
+	ReturnRate     float64   `json:"return_rate"`
+	LastUpdateTime time.Time `json:"last_update_time"`
+}
+
+func writeJSON(w io.Writer, rows []*Row, groupBy string) error {
+	jsonRows := make([]jsonRow, 0, len(rows))
+	for _, row := range rows {
+		jsonRows = append(jsonRows, jsonRow{
+			RoomID:         row.RoomID,
+			UID:            row.UID,
+			UserName:       row.UserName,
+			BoxID:          row.BoxID,
+			BoxName:        row.BoxName,
+			Num:            row.st.TotalNum,
+			OriginalPrice:  float64(row.st.TotalOriginalPrice) / 100,
+			Price:          float64(row.st.TotalPrice) / 100,
+			Diff:           float64(row.diff()) / 100,
+			ReturnRate:     row.returnRate(),
+			LastUpdateTime: row.st.LastUpdateTime,
+		})
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(jsonRows)
+}
@@ -0,0 +1,196 @@
+package live
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// A capture file records the raw frames received from the danmaku servers, to be replayed
+// without being live. Layout, all integers in big endian:
+//
+//	magic (8 bytes) | room ID (int64)
+//	timestamp (int64 unix nanoseconds) | frame (MessageHeader + body)
+//	...
+var captureMagic = []byte("BTCAP\x00\x00\x01")
+
+// Frames larger than this are considered corrupted
+const maxFrameLength = 16 * 1024 * 1024
+
+// Read a single raw frame, header included.
+func readFrame(r io.Reader) ([]byte, error) {
+	frame := make([]byte, 16)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+
+	var header MessageHeader
+	if err := header.Read(bytes.NewReader(frame)); err != nil {
+		return nil, err
+	}
+	if header.TotalLength < 16 || header.TotalLength > maxFrameLength {
+		return nil, fmt.Errorf("invalid frame length %d", header.TotalLength)
+	}
+
+	frame = append(frame, make([]byte, header.TotalLength-16)...)
+	if _, err := io.ReadFull(r, frame[16:]); err != nil {
+		return nil, err
+	}
+
+	return frame, nil
+}
+
+// Operation of a raw frame read by readFrame
+func frameOp(frame []byte) Op {
+	return Op(binary.BigEndian.Uint32(frame[8:12]))
+}
+
+// Records raw frames to a capture file. Safe for concurrent use.
+type CaptureWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewCaptureWriter(w io.Writer, roomID int64) (*CaptureWriter, error) {
+	header := make([]byte, 0, len(captureMagic)+8)
+	header = append(header, captureMagic...)
+	header = binary.BigEndian.AppendUint64(header, uint64(roomID))
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &CaptureWriter{w: w}, nil
+}
+
+// Record a frame received at the given time. Each record is written with a single Write call,
+// so that a crash leaves at most the last record truncated.
+func (c *CaptureWriter) Record(timestamp time.Time, frame []byte) error {
+	record := make([]byte, 0, 8+len(frame))
+	record = binary.BigEndian.AppendUint64(record, uint64(timestamp.UnixNano()))
+	record = append(record, frame...)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, err := c.w.Write(record)
+	return err
+}
+
+// Reads frames from a capture file.
+type CaptureReader struct {
+	r      io.Reader
+	RoomID int64 // Room the capture is recorded in
+}
+
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	header := make([]byte, len(captureMagic)+8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("malformed capture file: %w", err)
+	}
+	if !bytes.Equal(header[:len(captureMagic)], captureMagic) {
+		return nil, errors.New("malformed capture file: bad magic")
+	}
+
+	return &CaptureReader{
+		r:      r,
+		RoomID: int64(binary.BigEndian.Uint64(header[len(captureMagic):])),
+	}, nil
+}
+
+// Read the next frame and the time it was received. Returns io.EOF at the end of the capture.
+// A truncated last record, e.g., from a crash during recording, is treated as the end.
+func (c *CaptureReader) Next() (time.Time, []byte, error) {
+	var nanos int64
+	if err := binary.Read(c.r, binary.BigEndian, &nanos); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			err = io.EOF
+		}
+		return time.Time{}, nil, err
+	}
+
+	frame, err := readFrame(c.r)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			log.Warn().Msg("抓包文件末尾不完整, 忽略最后一帧")
+			err = io.EOF
+		}
+		return time.Time{}, nil, err
+	}
+
+	return time.Unix(0, nanos), frame, nil
+}
+
+// A Source replaying a capture file.
+type Replay struct {
+	capture *CaptureReader
+	speed   float64
+}
+
+// Replay the capture at the given speed relative to the recording, e.g., 1 for real time
+// and 10 for ten times faster. A speed of 0 replays as fast as possible.
+func NewReplay(capture *CaptureReader, speed float64) *Replay {
+	return &Replay{
+		capture: capture,
+		speed:   speed,
+	}
+}
+
+func (r *Replay) Room() int64 {
+	return r.capture.RoomID
+}
+
+// Returns when the whole capture is replayed or ctx is cancelled.
+func (r *Replay) Run(ctx context.Context, msgChan chan<- Message) {
+	var first, start time.Time
+	frames := 0
+	for {
+		timestamp, frame, err := r.capture.Next()
+		if errors.Is(err, io.EOF) {
+			log.Info().Int("frames", frames).Msg("抓包回放完成")
+			return
+		}
+		if err != nil {
+			log.Err(err).Int("frames", frames).Msg("无法读取抓包文件, 停止回放")
+			return
+		}
+
+		if frames == 0 {
+			first, start = timestamp, time.Now()
+		}
+		frames++
+
+		// Keep the pace of the recording
+		if r.speed > 0 {
+			due := start.Add(time.Duration(float64(timestamp.Sub(first)) / r.speed))
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Until(due)):
+			}
+		}
+
+		messages, err := ReadMessages(bytes.NewReader(frame))
+		if err != nil {
+			log.Err(err).Int("frame", frames).Msg("无法解析抓包中的消息")
+			continue
+		}
+
+		for _, message := range messages {
+			if message == nil {
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case msgChan <- *message:
+			}
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package live_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/YangchenYe323/boxtroll/internal/live"
+)
+
+func TestCaptureReplay(t *testing.T) {
+	var frames [][]byte
+	for _, name := range []string{"danmu_msg_text.json", "danmu_msg_legacy.json"} {
+		body, err := os.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatalf("failed to read fixture %s: %v", name, err)
+		}
+		raw, err := io.ReadAll(frame(t, bytes.TrimSpace(body)))
+		if err != nil {
+			t.Fatalf("failed to build frame: %v", err)
+		}
+		frames = append(frames, raw)
+	}
+
+	var buf bytes.Buffer
+	w, err := live.NewCaptureWriter(&buf, 22637261)
+	if err != nil {
+		t.Fatalf("failed to create capture writer: %v", err)
+	}
+	start := time.Unix(1700000000, 0)
+	for i, raw := range frames {
+		if err := w.Record(start.Add(time.Duration(i)*time.Second), raw); err != nil {
+			t.Fatalf("failed to record frame: %v", err)
+		}
+	}
+	// A crash in the middle of a record leaves a truncated tail
+	if err := w.Record(start.Add(time.Hour), frames[0]); err != nil {
+		t.Fatalf("failed to record frame: %v", err)
+	}
+	capture := buf.Bytes()[:buf.Len()-5]
+
+	r, err := live.NewCaptureReader(bytes.NewReader(capture))
+	if err != nil {
+		t.Fatalf("failed to create capture reader: %v", err)
+	}
+	if r.RoomID != 22637261 {
+		t.Fatalf("expected room 22637261, got %d", r.RoomID)
+	}
+
+	for i, raw := range frames {
+		timestamp, actual, err := r.Next()
+		if err != nil {
+			t.Fatalf("failed to read frame %d: %v", i, err)
+		}
+		if !timestamp.Equal(start.Add(time.Duration(i) * time.Second)) {
+			t.Fatalf("expected frame %d at %v, got %v", i, start.Add(time.Duration(i)*time.Second), timestamp)
+		}
+		if !bytes.Equal(actual, raw) {
+			t.Fatalf("expected frame %d to round trip, got %q", i, actual)
+		}
+	}
+	if _, _, err := r.Next(); err != io.EOF {
+		t.Fatalf("expected io.EOF at the truncated tail, got %v", err)
+	}
+
+	// Replaying as fast as possible yields every message in order
+	r, err = live.NewCaptureReader(bytes.NewReader(capture))
+	if err != nil {
+		t.Fatalf("failed to create capture reader: %v", err)
+	}
+	replay := live.NewReplay(r, 0)
+	if replay.Room() != 22637261 {
+		t.Fatalf("expected room 22637261, got %d", replay.Room())
+	}
+
+	msgChan := make(chan live.Message, 10)
+	replay.Run(context.Background(), msgChan)
+	close(msgChan)
+
+	var texts []string
+	for msg := range msgChan {
+		if msg.Danmaku == nil {
+			t.Fatalf("expected danmaku message, got %s", msg.Cmd)
+		}
+		texts = append(texts, msg.Danmaku.Text)
+	}
+	if len(texts) != len(frames) {
+		t.Fatalf("expected %d messages, got %d", len(frames), len(texts))
+	}
+	if texts[0] != "盲盒查询" {
+		t.Fatalf("expected first message 盲盒查询, got %s", texts[0])
+	}
+}
+
+func TestCaptureBadMagic(t *testing.T) {
+	if _, err := live.NewCaptureReader(bytes.NewReader([]byte("not a capture file"))); err == nil {
+		t.Fatalf("expected error for bad magic, got nil")
+	}
+}
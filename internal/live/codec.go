@@ -3,8 +3,11 @@ package live
 import (
 	"bytes"
 	"compress/zlib"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"io"
+	"strings"
 
 	"github.com/andybalholm/brotli"
 	"github.com/rs/zerolog/log"
@@ -12,9 +15,11 @@ import (
 
 // ReadMessages read messages from the given input stream and return a list of messages.
 //
-// It only errors out if the input stream is closed, if it encounters unknown or
-// unparsable messages, it logs error and skip the message. It can return a nil or empty
-// slice.
+// It only errors out if the input stream is closed or the server rejects the auth message
+// (ErrAuthFailed), if it encounters unknown or unparsable messages, it logs error and skip the
+// message. It can return a nil or empty slice.
+//
+// Heartbeat replies are returned as a POPULARITY message.
 func ReadMessages(in io.Reader) ([]*Message, error) {
 	// Fetch a header
 	var header MessageHeader
@@ -29,14 +34,13 @@ func ReadMessages(in io.Reader) ([]*Message, error) {
 		return nil, err
 	}
 
-	// NOTE: We don't handle heartbeat and auth reply for now
 	if header.OpCode == OpHeartbeatReply {
 		log.Debug().Msg("收到心跳回复消息")
-		return nil, nil
+		return parseHeartbeatReply(buf.Bytes()), nil
 	}
 	if header.OpCode == OpAuthReply {
 		log.Debug().Msg("收到认证回复消息")
-		return nil, nil
+		return nil, parseAuthReply(buf.Bytes())
 	}
 
 	var messages []*Message
@@ -99,6 +103,34 @@ func ReadMessages(in io.Reader) ([]*Message, error) {
 	return messages, nil
 }
 
+// The body of a heartbeat reply starts with the popularity of the room as a big endian uint32
+func parseHeartbeatReply(body []byte) []*Message {
+	if len(body) < 4 {
+		log.Warn().Int("len", len(body)).Msg("心跳回复消息长度不足")
+		return nil
+	}
+	return []*Message{{
+		Cmd:        CmdPopularity,
+		Popularity: &PopularityMessage{Popularity: int64(binary.BigEndian.Uint32(body))},
+	}}
+}
+
+// The body of an auth reply is {"code":0} on success
+func parseAuthReply(body []byte) error {
+	var reply struct {
+		Code int64 `json:"code"`
+	}
+	if err := json.Unmarshal(body, &reply); err != nil {
+		// Treated as success, a bad token is reported with a well formed reply
+		log.Err(err).Str("msg", string(body)).Msg("认证回复消息解析失败")
+		return nil
+	}
+	if reply.Code != 0 {
+		return &AuthError{Code: reply.Code}
+	}
+	return nil
+}
+
 func parseMessage(bytes []byte) (*Message, error) {
 	type dummyMessage struct {
 		Cmd string `json:"cmd"`
@@ -107,6 +139,10 @@ func parseMessage(bytes []byte) (*Message, error) {
 		Cmd  string           `json:"cmd"`
 		Data *SendGiftMessage `json:"data"`
 	}
+	type danmakuMessage struct {
+		Cmd  string            `json:"cmd"`
+		Info []json.RawMessage `json:"info"`
+	}
 
 	// First unmarshal the bytes into a dummy message to extract the cmd, and then
 	// re-unmarshal the bytes into the actual message type depending on the cmd
@@ -116,7 +152,10 @@ func parseMessage(bytes []byte) (*Message, error) {
 		return nil, err
 	}
 
-	switch dummy.Cmd {
+	// Some commands carry a protocol version suffix, e.g., DANMU_MSG:4:0:2:2:2:0
+	cmd, _, _ := strings.Cut(dummy.Cmd, ":")
+
+	switch cmd {
 	case "SEND_GIFT":
 		var message giftMessage
 		if err := json.Unmarshal(bytes, &message); err != nil {
@@ -124,9 +163,92 @@ func parseMessage(bytes []byte) (*Message, error) {
 			return nil, err
 		}
 		return &Message{
-			Cmd:      dummy.Cmd,
+			Cmd:      cmd,
 			SendGift: message.Data,
 		}, nil
+	case "DANMU_MSG":
+		var message danmakuMessage
+		if err := json.Unmarshal(bytes, &message); err != nil {
+			log.Err(err).Str("msg", string(bytes)).Msg("DANMU_MSG 消息解析失败")
+			return nil, err
+		}
+		danmaku, err := decodeDanmakuInfo(message.Info)
+		if err != nil {
+			log.Err(err).Str("msg", string(bytes)).Msg("DANMU_MSG 消息解析失败")
+			return nil, err
+		}
+		return &Message{
+			Cmd:     cmd,
+			Danmaku: danmaku,
+		}, nil
+	case "LIVE":
+		var message LiveMessage
+		if err := json.Unmarshal(bytes, &message); err != nil {
+			log.Err(err).Str("msg", string(bytes)).Msg("LIVE 消息解析失败")
+			return nil, err
+		}
+		return &Message{
+			Cmd:  cmd,
+			Live: &message,
+		}, nil
+	case "PREPARING":
+		var message PreparingMessage
+		if err := json.Unmarshal(bytes, &message); err != nil {
+			log.Err(err).Str("msg", string(bytes)).Msg("PREPARING 消息解析失败")
+			return nil, err
+		}
+		return &Message{
+			Cmd:       cmd,
+			Preparing: &message,
+		}, nil
+	case "COMBO_SEND":
+		var message struct {
+			Data *ComboSendMessage `json:"data"`
+		}
+		if err := json.Unmarshal(bytes, &message); err != nil {
+			log.Err(err).Str("msg", string(bytes)).Msg("COMBO_SEND 消息解析失败")
+			return nil, err
+		}
+		if message.Data == nil {
+			log.Error().Str("msg", string(bytes)).Msg("COMBO_SEND 消息缺少 data")
+			return nil, errors.New("COMBO_SEND 消息缺少 data")
+		}
+		return &Message{
+			Cmd:       cmd,
+			ComboSend: message.Data,
+		}, nil
+	case "GUARD_BUY":
+		var message struct {
+			Data *GuardBuyMessage `json:"data"`
+		}
+		if err := json.Unmarshal(bytes, &message); err != nil {
+			log.Err(err).Str("msg", string(bytes)).Msg("GUARD_BUY 消息解析失败")
+			return nil, err
+		}
+		if message.Data == nil {
+			log.Error().Str("msg", string(bytes)).Msg("GUARD_BUY 消息缺少 data")
+			return nil, errors.New("GUARD_BUY 消息缺少 data")
+		}
+		return &Message{
+			Cmd:      cmd,
+			GuardBuy: message.Data,
+		}, nil
+	case "SUPER_CHAT_MESSAGE":
+		var message struct {
+			Data *SuperChatMessage `json:"data"`
+		}
+		if err := json.Unmarshal(bytes, &message); err != nil {
+			log.Err(err).Str("msg", string(bytes)).Msg("SUPER_CHAT_MESSAGE 消息解析失败")
+			return nil, err
+		}
+		if message.Data == nil {
+			log.Error().Str("msg", string(bytes)).Msg("SUPER_CHAT_MESSAGE 消息缺少 data")
+			return nil, errors.New("SUPER_CHAT_MESSAGE 消息缺少 data")
+		}
+		return &Message{
+			Cmd:       cmd,
+			SuperChat: message.Data,
+		}, nil
 	default:
 		log.Debug().Str("msg", string(bytes)).Msgf("弹幕消息 %s 还未实现", dummy.Cmd)
 		return nil, nil
@@ -0,0 +1,307 @@
+package live_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/YangchenYe323/boxtroll/internal/live"
+)
+
+// Wrap a captured command body into a single uncompressed frame
+func frame(t *testing.T, body []byte) *bytes.Reader {
+	t.Helper()
+	return frameOp(t, live.OpNormal, body)
+}
+
+// Wrap a body into a single uncompressed frame of the given operation
+func frameOp(t *testing.T, op live.Op, body []byte) *bytes.Reader {
+	t.Helper()
+
+	header := live.MessageHeader{
+		TotalLength:  uint32(len(body)) + 16,
+		HeaderLength: 16,
+		Type:         live.MessageTypeUncompressedNormal,
+		OpCode:       op,
+	}
+
+	var buf bytes.Buffer
+	if err := header.Write(&buf); err != nil {
+		t.Fatalf("failed to write header: %v", err)
+	}
+	buf.Write(body)
+	return bytes.NewReader(buf.Bytes())
+}
+
+func readFixture(t *testing.T, name string) []*live.Message {
+	t.Helper()
+
+	body, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("failed to read fixture %s: %v", name, err)
+	}
+
+	messages, err := live.ReadMessages(frame(t, bytes.TrimSpace(body)))
+	if err != nil {
+		t.Fatalf("failed to read messages: %v", err)
+	}
+	return messages
+}
+
+func TestParseDanmakuMessage(t *testing.T) {
+	tests := []struct {
+		fixture  string
+		expected live.DanmakuMessage
+	}{
+		{
+			fixture: "danmu_msg_text.json",
+			expected: live.DanmakuMessage{
+				UID:   12345678,
+				UName: "盒子怪的粉丝",
+				Text:  "盲盒查询",
+				Medal: &live.FanMedal{
+					Level:        21,
+					Name:         "怪兽",
+					AnchorUName:  "盒子怪",
+					AnchorRoomID: 22625025,
+					AnchorUID:    7706705,
+					GuardLevel:   3,
+				},
+				GuardLevel: 3,
+				Timestamp:  time.UnixMilli(1717745212345),
+			},
+		},
+		{
+			fixture: "danmu_msg_emoticon.json",
+			expected: live.DanmakuMessage{
+				UID:       87654321,
+				UName:     "路过的观众",
+				Text:      "赢麻了",
+				Emoticon:  true,
+				Timestamp: time.UnixMilli(1717745301000),
+			},
+		},
+		{
+			fixture: "danmu_msg_legacy.json",
+			expected: live.DanmakuMessage{
+				UID:   1000,
+				UName: "老用户",
+				Text:  "来了来了",
+				Medal: &live.FanMedal{
+					Level:        5,
+					Name:         "旧牌子",
+					AnchorUName:  "主播",
+					AnchorRoomID: 1000,
+				},
+				GuardLevel: 2,
+				Timestamp:  time.Unix(1568036736, 0),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.fixture, func(t *testing.T) {
+			messages := readFixture(t, test.fixture)
+			if len(messages) != 1 {
+				t.Fatalf("expected 1 message, got %d", len(messages))
+			}
+			if messages[0].Cmd != "DANMU_MSG" {
+				t.Fatalf("expected cmd DANMU_MSG, got %s", messages[0].Cmd)
+			}
+
+			actual := messages[0].Danmaku
+			if actual == nil {
+				t.Fatalf("expected danmaku message, got nil")
+			}
+			if actual.UID != test.expected.UID {
+				t.Fatalf("expected uid %d, got %d", test.expected.UID, actual.UID)
+			}
+			if actual.UName != test.expected.UName {
+				t.Fatalf("expected uname %s, got %s", test.expected.UName, actual.UName)
+			}
+			if actual.Text != test.expected.Text {
+				t.Fatalf("expected text %s, got %s", test.expected.Text, actual.Text)
+			}
+			if actual.GuardLevel != test.expected.GuardLevel {
+				t.Fatalf("expected guard level %d, got %d", test.expected.GuardLevel, actual.GuardLevel)
+			}
+			if actual.Emoticon != test.expected.Emoticon {
+				t.Fatalf("expected emoticon %v, got %v", test.expected.Emoticon, actual.Emoticon)
+			}
+			if !actual.Timestamp.Equal(test.expected.Timestamp) {
+				t.Fatalf("expected timestamp %v, got %v", test.expected.Timestamp, actual.Timestamp)
+			}
+			if (actual.Medal == nil) != (test.expected.Medal == nil) {
+				t.Fatalf("expected medal %v, got %v", test.expected.Medal, actual.Medal)
+			}
+			if test.expected.Medal != nil && *actual.Medal != *test.expected.Medal {
+				t.Fatalf("expected medal %+v, got %+v", *test.expected.Medal, *actual.Medal)
+			}
+		})
+	}
+}
+
+func TestParseMalformedDanmakuMessage(t *testing.T) {
+	// A malformed message is skipped without failing the stream
+	messages := readFixture(t, "danmu_msg_malformed.json")
+	if len(messages) != 0 {
+		t.Fatalf("expected no messages, got %d", len(messages))
+	}
+}
+
+func TestParseRevenueMessages(t *testing.T) {
+	messages := readFixture(t, "guard_buy.json")
+	if len(messages) != 1 || messages[0].GuardBuy == nil {
+		t.Fatalf("expected 1 guard buy message, got %d", len(messages))
+	}
+	guard := messages[0].GuardBuy
+	if guard.UID != 12345678 || guard.Username != "盒子怪的粉丝" || guard.GuardLevel != 3 {
+		t.Fatalf("expected 舰长 bought by 12345678, got %+v", guard)
+	}
+	if guard.Num != 2 || guard.Price != 198000 || guard.GiftName != "舰长" {
+		t.Fatalf("expected 2 months of 舰长 at 198000, got %+v", guard)
+	}
+	if guard.ID() != "guard-12345678-3-1717745300-2" {
+		t.Fatalf("expected guard ID guard-12345678-3-1717745300-2, got %s", guard.ID())
+	}
+
+	messages = readFixture(t, "super_chat_message.json")
+	if len(messages) != 1 || messages[0].SuperChat == nil {
+		t.Fatalf("expected 1 super chat message, got %d", len(messages))
+	}
+	sc := messages[0].SuperChat
+	if sc.ID != 9876543 || sc.UID != 87654321 || sc.UserInfo.UName != "路过的观众" {
+		t.Fatalf("expected super chat 9876543 sent by 87654321, got %+v", sc)
+	}
+	if sc.Message != "今天一定出告白气球" || sc.Time != 60 {
+		t.Fatalf("expected super chat message pinned for 60s, got %q for %ds", sc.Message, sc.Time)
+	}
+	if sc.GoldPrice() != 30000 {
+		t.Fatalf("expected 30 元 as 30000 金瓜子, got %d", sc.GoldPrice())
+	}
+}
+
+// Blind boxes sent without a TID are still counted, identified by the fallback ID
+func TestParseSendGiftWithoutTID(t *testing.T) {
+	messages := readFixture(t, "send_gift_empty_tid.json")
+	if len(messages) != 1 || messages[0].SendGift == nil {
+		t.Fatalf("expected 1 send gift message, got %d", len(messages))
+	}
+	gift := messages[0].SendGift
+	if gift.TID != "" || gift.BlindGift == nil || gift.BlindGift.OriginalGiftID != 32251 {
+		t.Fatalf("expected 心动盲盒 without TID, got %+v", gift)
+	}
+	if gift.ID() != "12345678-32356-1717745300-1" {
+		t.Fatalf("expected fallback ID 12345678-32356-1717745300-1, got %s", gift.ID())
+	}
+
+	// Numeric TIDs are kept verbatim
+	body := []byte(`{"cmd":"SEND_GIFT","data":{"giftId":31036,"num":1,"uid":1,"tid":1717745230110100004}}`)
+	messages, err := live.ReadMessages(frame(t, body))
+	if err != nil || len(messages) != 1 {
+		t.Fatalf("expected 1 message, got %d and %v", len(messages), err)
+	}
+	if messages[0].SendGift.ID() != "1717745230110100004" {
+		t.Fatalf("expected ID 1717745230110100004, got %s", messages[0].SendGift.ID())
+	}
+}
+
+func TestParseReplies(t *testing.T) {
+	messages, err := live.ReadMessages(frameOp(t, live.OpAuthReply, []byte(`{"code":0}`)))
+	if err != nil || len(messages) != 0 {
+		t.Fatalf("expected no messages and no error for a successful auth, got %d and %v", len(messages), err)
+	}
+
+	_, err = live.ReadMessages(frameOp(t, live.OpAuthReply, []byte(`{"code":-101}`)))
+	if !errors.Is(err, live.ErrAuthFailed) {
+		t.Fatalf("expected ErrAuthFailed for code -101, got %v", err)
+	}
+	var authErr *live.AuthError
+	if !errors.As(err, &authErr) || authErr.Code != -101 {
+		t.Fatalf("expected auth error with code -101, got %v", err)
+	}
+
+	messages, err = live.ReadMessages(frameOp(t, live.OpHeartbeatReply, []byte{0x00, 0x01, 0xe2, 0x40}))
+	if err != nil {
+		t.Fatalf("failed to read heartbeat reply: %v", err)
+	}
+	if len(messages) != 1 || messages[0].Cmd != live.CmdPopularity || messages[0].Popularity == nil {
+		t.Fatalf("expected 1 popularity message, got %d", len(messages))
+	}
+	if messages[0].Popularity.Popularity != 123456 {
+		t.Fatalf("expected popularity 123456, got %d", messages[0].Popularity.Popularity)
+	}
+}
+
+// A recorded sequence of combo sends: a combo of single 小花花, a combo of batches of 10 小花花
+// delivered without TIDs, and 5 blind boxes opened at once, with redeliveries after reconnects.
+func TestComboSequence(t *testing.T) {
+	body, err := os.ReadFile(filepath.Join("testdata", "combo_sequence.jsonl"))
+	if err != nil {
+		t.Fatalf("failed to read fixture: %v", err)
+	}
+
+	var messages []*live.Message
+	for line := range bytes.Lines(bytes.TrimSpace(body)) {
+		parsed, err := live.ReadMessages(frame(t, bytes.TrimSpace(line)))
+		if err != nil {
+			t.Fatalf("failed to read messages: %v", err)
+		}
+		messages = append(messages, parsed...)
+	}
+	if len(messages) != 12 {
+		t.Fatalf("expected 12 messages, got %d", len(messages))
+	}
+
+	// Gold spent per gift, or per blind box, counted from SEND_GIFT and from COMBO_SEND
+	seen := make(map[string]bool)
+	spent := make(map[int64]int64)
+	sent := make(map[int64]int64)
+	comboSpent := make(map[int64]int64)
+	comboSent := make(map[int64]int64)
+	duplicates := 0
+	for _, msg := range messages {
+		switch msg.Cmd {
+		case "SEND_GIFT":
+			gift := msg.SendGift
+			if seen[gift.ID()] {
+				duplicates++
+				continue
+			}
+			seen[gift.ID()] = true
+
+			if gift.Cost() != gift.TotalCoin {
+				t.Fatalf("expected cost %d of %s to match total coin, got %d", gift.TotalCoin, gift.ID(), gift.Cost())
+			}
+			id := gift.GiftID
+			if gift.BlindGift != nil {
+				id = gift.BlindGift.OriginalGiftID
+			}
+			spent[id] += gift.Cost()
+			sent[id] += gift.Num
+		case "COMBO_SEND":
+			comboSpent[msg.ComboSend.GiftID] += msg.ComboSend.ComboTotalCoin
+			comboSent[msg.ComboSend.GiftID] += msg.ComboSend.TotalNum
+		default:
+			t.Fatalf("unexpected cmd %s", msg.Cmd)
+		}
+	}
+
+	if duplicates != 2 {
+		t.Fatalf("expected 2 redelivered messages, got %d", duplicates)
+	}
+	// 3 single 小花花 and 2 batches of 10 at 100 each, 5 心动盲盒 at 1500 each
+	expectedSpent := map[int64]int64{31036: 2300, 32251: 7500}
+	expectedSent := map[int64]int64{31036: 23, 32251: 5}
+	for id, expected := range expectedSpent {
+		if spent[id] != expected || comboSpent[id] != expected {
+			t.Fatalf("expected %d spent on gift %d, got %d from SEND_GIFT and %d from COMBO_SEND", expected, id, spent[id], comboSpent[id])
+		}
+		if sent[id] != expectedSent[id] || comboSent[id] != expectedSent[id] {
+			t.Fatalf("expected %d of gift %d, got %d from SEND_GIFT and %d from COMBO_SEND", expectedSent[id], id, sent[id], comboSent[id])
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package live
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Decode the positional "info" array of a DANMU_MSG command.
+//
+// The payload looks like (irrelevant slots omitted):
+//
+//	[
+//	  [0, mode, fontsize, color, timestamp_ms, rnd, 0, uid_crc32, 0, 0, 0, "", dm_type, emoticon, ...],
+//	  "text",
+//	  [uid, "uname", is_admin, vip, svip, rank, mobile_verify, "uname_color"],
+//	  [medal_level, "medal_name", "anchor_uname", anchor_room_id, medal_color, ..., guard_level, is_lighted, anchor_uid],
+//	  [user_level, ...],
+//	  ...,
+//	  guard_level, (index 7)
+//	  ...,
+//	  {"ts": timestamp_s, "ct": "..."}, (index 9)
+//	]
+//
+// Bilibili changes this layout from time to time, so every slot is optional: a missing or
+// mistyped slot leaves the corresponding field zero-valued instead of failing the whole message.
+// Only the sender and the text are mandatory.
+func decodeDanmakuInfo(info []json.RawMessage) (*DanmakuMessage, error) {
+	var msg DanmakuMessage
+
+	if len(info) < 3 {
+		return nil, fmt.Errorf("DANMU_MSG info 长度不足: %d", len(info))
+	}
+
+	if err := json.Unmarshal(info[1], &msg.Text); err != nil {
+		return nil, fmt.Errorf("无法解析弹幕内容: %w", err)
+	}
+
+	var sender []json.RawMessage
+	if err := json.Unmarshal(info[2], &sender); err != nil || len(sender) < 2 {
+		return nil, fmt.Errorf("无法解析弹幕发送者: %s", string(info[2]))
+	}
+	if err := json.Unmarshal(sender[0], &msg.UID); err != nil {
+		return nil, fmt.Errorf("无法解析弹幕发送者UID: %w", err)
+	}
+	if err := json.Unmarshal(sender[1], &msg.UName); err != nil {
+		return nil, fmt.Errorf("无法解析弹幕发送者昵称: %w", err)
+	}
+
+	var meta []json.RawMessage
+	if json.Unmarshal(info[0], &meta) == nil {
+		var timestampMs int64
+		if slotInto(meta, 4, &timestampMs) && timestampMs > 0 {
+			msg.Timestamp = time.UnixMilli(timestampMs)
+		}
+		var dmType int64
+		if slotInto(meta, 12, &dmType) {
+			msg.Emoticon = dmType == 1
+		}
+	}
+
+	var medal []json.RawMessage
+	if len(info) > 3 && json.Unmarshal(info[3], &medal) == nil && len(medal) >= 2 {
+		var m FanMedal
+		slotInto(medal, 0, &m.Level)
+		slotInto(medal, 1, &m.Name)
+		slotInto(medal, 2, &m.AnchorUName)
+		slotInto(medal, 3, &m.AnchorRoomID)
+		slotInto(medal, 10, &m.GuardLevel)
+		slotInto(medal, 12, &m.AnchorUID)
+		msg.Medal = &m
+	}
+
+	if len(info) > 7 {
+		slotInto(info, 7, &msg.GuardLevel)
+	}
+
+	// Fall back to the second precision timestamp
+	if msg.Timestamp.IsZero() && len(info) > 9 {
+		var check struct {
+			TS int64 `json:"ts"`
+		}
+		if json.Unmarshal(info[9], &check) == nil && check.TS > 0 {
+			msg.Timestamp = time.Unix(check.TS, 0)
+		}
+	}
+
+	return &msg, nil
+}
+
+// Unmarshal slots[idx] into v, returning whether it succeeded.
+func slotInto(slots []json.RawMessage, idx int, v any) bool {
+	if idx >= len(slots) {
+		return false
+	}
+	return json.Unmarshal(slots[idx], v) == nil
+}
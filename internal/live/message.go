@@ -2,7 +2,11 @@ package live
 
 import (
 	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"time"
 )
 
 type MessageType uint16
@@ -78,8 +82,41 @@ func (m *MessageHeader) Read(r io.Reader) error {
 
 // A faked enum representing all possible messages
 type Message struct {
-	Cmd      string           `json:"cmd"`
-	SendGift *SendGiftMessage `json:"send_gift,omitempty"`
+	Cmd       string            `json:"cmd"`
+	SendGift  *SendGiftMessage  `json:"send_gift,omitempty"`
+	Danmaku   *DanmakuMessage   `json:"danmaku,omitempty"`
+	Live      *LiveMessage      `json:"live,omitempty"`
+	Preparing *PreparingMessage `json:"preparing,omitempty"`
+	GuardBuy  *GuardBuyMessage  `json:"guard_buy,omitempty"`
+	SuperChat *SuperChatMessage `json:"super_chat,omitempty"`
+	ComboSend *ComboSendMessage `json:"combo_send,omitempty"`
+
+	Popularity *PopularityMessage `json:"popularity,omitempty"`
+}
+
+// Cmd of the message decoded from a heartbeat reply. The server does not send it as a command,
+// it is named here so that every message can be dispatched by Cmd.
+const CmdPopularity = "POPULARITY"
+
+// The popularity counter (人气值) of the room, sent in reply to every heartbeat
+type PopularityMessage struct {
+	Popularity int64 `json:"popularity"`
+}
+
+// The danmaku server rejected the auth message, e.g., the token expired
+var ErrAuthFailed = errors.New("弹幕服务器认证失败")
+
+// The auth reply with a non-zero code, e.g., -101 for a bad token. It matches ErrAuthFailed.
+type AuthError struct {
+	Code int64
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("%s: code %d", ErrAuthFailed.Error(), e.Code)
+}
+
+func (e *AuthError) Is(target error) bool {
+	return target == ErrAuthFailed
 }
 
 type AuthMessage struct {
@@ -91,6 +128,9 @@ type AuthMessage struct {
 	Key      string `json:"key"`      // The token of the user
 }
 
+// A single gift sending. Continuous sends of a gift (连击) are delivered as one SEND_GIFT per send,
+// each carrying only its own Num, and summarized by COMBO_SEND afterwards, so counting every
+// SEND_GIFT once counts every gift once.
 type SendGiftMessage struct {
 	GiftID    int64      `json:"giftId"`
 	GiftName  string     `json:"giftName"`
@@ -99,6 +139,62 @@ type SendGiftMessage struct {
 	BlindGift *BlindGift `json:"blind_gift,omitempty"`
 	UID       int64      `json:"uid"`
 	UName     string     `json:"uname"`
+	TID       FlexString `json:"tid"`       // Transaction ID, unique per gift sending, may be empty
+	Rnd       FlexString `json:"rnd"`       // Random ID of the request, shared by the messages of a single send
+	Timestamp int64      `json:"timestamp"` // Unix seconds
+	TotalCoin int64      `json:"total_coin"`
+	// Identity of the combo the send belongs to, e.g., batch:gift:combo_id:12345678:7706705:31036:1717745212.1234
+	BatchComboID   string         `json:"batch_combo_id"`
+	ComboSend      *ComboProgress `json:"combo_send,omitempty"`       // Position of the send in its combo, nil if not a combo
+	BatchComboSend *ComboProgress `json:"batch_combo_send,omitempty"` // Position of the send in its batch combo, nil if not a combo
+}
+
+// Identity of the gift message, the same if the message is delivered more than once.
+func (m *SendGiftMessage) ID() string {
+	if m.TID != "" {
+		return string(m.TID)
+	}
+	// Sends of a combo only differ in their position in the combo
+	if m.BatchComboID != "" && m.BatchComboSend != nil {
+		return fmt.Sprintf("%s-%d-%d", m.BatchComboID, m.GiftID, m.BatchComboSend.BatchComboNum)
+	}
+	if m.Rnd != "" {
+		return fmt.Sprintf("%d-%d-%s-%d", m.UID, m.GiftID, m.Rnd, m.Num)
+	}
+	// Not seen in practice, but don't drop messages without a TID
+	return fmt.Sprintf("%d-%d-%d-%d", m.UID, m.GiftID, m.Timestamp, m.Num)
+}
+
+// Price paid for the message, i.e., the price of the blind boxes opened or the gifts sent
+func (m *SendGiftMessage) Cost() int64 {
+	if m.BlindGift != nil {
+		return m.BlindGift.OriginalGiftPrice * m.Num
+	}
+	return m.Price * m.Num
+}
+
+// Position of a gift sending within its combo
+type ComboProgress struct {
+	ComboID       string `json:"combo_id"`
+	ComboNum      int64  `json:"combo_num"` // Number of sends in the combo so far, including this one
+	BatchComboID  string `json:"batch_combo_id"`
+	BatchComboNum int64  `json:"batch_combo_num"` // Number of sends in the batch combo so far, including this one
+	GiftNum       int64  `json:"gift_num"`        // Gifts in this send
+}
+
+// Summary of a gift combo decoded from COMBO_SEND. The gifts are already counted by their
+// SEND_GIFT messages, it must not be counted again.
+type ComboSendMessage struct {
+	UID            int64  `json:"uid"`
+	UName          string `json:"uname"`
+	GiftID         int64  `json:"gift_id"`
+	GiftName       string `json:"gift_name"`
+	ComboID        string `json:"combo_id"`
+	ComboNum       int64  `json:"combo_num"` // Number of sends in the combo
+	BatchComboID   string `json:"batch_combo_id"`
+	BatchComboNum  int64  `json:"batch_combo_num"`
+	TotalNum       int64  `json:"total_num"`        // Number of gifts in the combo
+	ComboTotalCoin int64  `json:"combo_total_coin"` // Price paid for the combo
 }
 
 type BlindGift struct {
@@ -107,3 +203,104 @@ type BlindGift struct {
 	OriginalGiftName  string `json:"original_gift_name"`
 	OriginalGiftPrice int64  `json:"original_gift_price"`
 }
+
+// A chat message decoded from DANMU_MSG
+type DanmakuMessage struct {
+	UID        int64     `json:"uid"`
+	UName      string    `json:"uname"`
+	Text       string    `json:"text"`
+	Medal      *FanMedal `json:"medal,omitempty"` // Fan medal worn by the sender, nil if none
+	GuardLevel int64     `json:"guard_level"`     // 0: none, 1: 总督, 2: 提督, 3: 舰长
+	Emoticon   bool      `json:"emoticon"`        // Whether the message is an emoticon (表情包) instead of text
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+type FanMedal struct {
+	Level        int64  `json:"level"`
+	Name         string `json:"name"`
+	AnchorUName  string `json:"anchor_uname"`
+	AnchorRoomID int64  `json:"anchor_room_id"`
+	AnchorUID    int64  `json:"anchor_uid"`
+	GuardLevel   int64  `json:"guard_level"`
+}
+
+// A guard (大航海) purchase decoded from GUARD_BUY
+type GuardBuyMessage struct {
+	UID        int64  `json:"uid"`
+	Username   string `json:"username"`
+	GuardLevel int64  `json:"guard_level"` // 1: 总督, 2: 提督, 3: 舰长
+	Num        int64  `json:"num"`         // Number of months
+	Price      int64  `json:"price"`       // Price of a single month, in 金瓜子 like gift prices
+	GiftID     int64  `json:"gift_id"`
+	GiftName   string `json:"gift_name"`  // e.g., 舰长
+	StartTime  int64  `json:"start_time"` // Unix seconds
+}
+
+// Identity of the purchase, the same if the message is delivered more than once.
+// GUARD_BUY carries no transaction ID, the purchase time is unique enough per user.
+func (m *GuardBuyMessage) ID() string {
+	return fmt.Sprintf("guard-%d-%d-%d-%d", m.UID, m.GuardLevel, m.StartTime, m.Num)
+}
+
+// A Super Chat (醒目留言) decoded from SUPER_CHAT_MESSAGE
+type SuperChatMessage struct {
+	ID        FlexInt64 `json:"id"`
+	UID       FlexInt64 `json:"uid"`
+	Price     int64     `json:"price"` // In 元
+	Message   string    `json:"message"`
+	StartTime int64     `json:"start_time"` // Unix seconds
+	Time      int64     `json:"time"`       // Seconds the Super Chat is pinned
+	UserInfo  struct {
+		UName string `json:"uname"`
+	} `json:"user_info"`
+}
+
+// Price in 金瓜子 like gift prices, 1 元 = 1000 金瓜子
+func (m *SuperChatMessage) GoldPrice() int64 {
+	return m.Price * 1000
+}
+
+// The room starts broadcasting. Bilibili usually sends it more than once per broadcast.
+type LiveMessage struct {
+	RoomID   FlexInt64 `json:"roomid"`
+	LiveKey  string    `json:"live_key"`
+	LiveTime int64     `json:"live_time"` // Unix seconds of the broadcast start, 0 if absent
+}
+
+// The room stops broadcasting.
+type PreparingMessage struct {
+	RoomID FlexInt64 `json:"roomid"`
+}
+
+// A string that bilibili sometimes encodes as a JSON number, e.g., "rnd": 1717745212
+type FlexString string
+
+func (f *FlexString) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*f = FlexString(s)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return err
+	}
+	*f = FlexString(n.String())
+	return nil
+}
+
+// An integer that bilibili sometimes encodes as a JSON string, e.g., "roomid": "22625025"
+type FlexInt64 int64
+
+func (f *FlexInt64) UnmarshalJSON(data []byte) error {
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return err
+	}
+	i, err := n.Int64()
+	if err != nil {
+		return err
+	}
+	*f = FlexInt64(i)
+	return nil
+}
@@ -1,23 +1,106 @@
 package live
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net"
-	"strconv"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/YangchenYe323/boxtroll/internal/bilibili"
+	"github.com/YangchenYe323/boxtroll/internal/retry"
 	"github.com/rs/zerolog/log"
 )
 
+// A source of live messages of a single room, e.g., a Stream or a Replay.
+type Source interface {
+	// Room the messages come from
+	Room() int64
+	// Send messages to msgChan until ctx is cancelled or the source is exhausted.
+	// A Stream is never exhausted.
+	Run(ctx context.Context, msgChan chan<- Message)
+}
+
+var _ Source = &Stream{}
+var _ Source = &Replay{}
+
+const (
+	// Send heartbeats every 20 seconds, to give some headroom and avoid the connection being
+	// terminated by the server
+	defaultHeartbeatInterval = 20 * time.Second
+	// The server replies to every heartbeat, so a connection without a heartbeat reply for
+	// this long is considered dead, even if the socket is still open
+	defaultReadTimeout = 3*defaultHeartbeatInterval + 10*time.Second
+)
+
+// Wait between reconnections, growing on consecutive failures
+var defaultReconnectBackoff = &retry.ExponentialBackoffWithJitter{
+	Min:        time.Second,
+	Max:        time.Minute,
+	Multiplier: 2,
+	Jttr:       0.2,
+}
+
 type Stream struct {
 	RoomID int64 // Room ID to connect to
 
 	endpoints []*bilibili.LiveEndpoint // A list of endpoints to connect to
 	uid       int64                    // User ID of the user
 	token     string                   // Auth token for the user
+	transport Transport                // How to connect to the endpoints
+	capture   *CaptureWriter           // Records every received frame if not nil
+
+	heartbeatInterval time.Duration                       // Interval between heartbeats
+	readTimeout       time.Duration                       // The connection is stalled without a heartbeat reply for this long
+	backoff           *retry.ExponentialBackoffWithJitter // Wait between reconnections
+
+	// Fetch a new token and endpoints when the server rejects the token
+	fetchStreamInfo func(ctx context.Context, roomID int64) (*bilibili.MessageStreamInfo, error)
+}
+
+type StreamOption = func(s *Stream)
+
+// Select the transport used to connect to the danmaku servers. Defaults to TransportTCP.
+func WithTransport(transport Transport) StreamOption {
+	return func(s *Stream) {
+		s.transport = transport
+	}
+}
+
+// Record every frame received from the danmaku servers, to be replayed later.
+func WithCapture(capture *CaptureWriter) StreamOption {
+	return func(s *Stream) {
+		s.capture = capture
+	}
+}
+
+// Fetch the token and endpoints with the given function when the danmaku server rejects the
+// token. Defaults to bilibili.GetMessageStreamInfo.
+func WithStreamInfoFetcher(fetch func(ctx context.Context, roomID int64) (*bilibili.MessageStreamInfo, error)) StreamOption {
+	return func(s *Stream) {
+		s.fetchStreamInfo = fetch
+	}
+}
+
+// Send heartbeats every heartbeatInterval and consider the connection stalled if no heartbeat reply
+// arrives for readTimeout. Defaults to 20 seconds and 70 seconds.
+func WithLiveness(heartbeatInterval time.Duration, readTimeout time.Duration) StreamOption {
+	return func(s *Stream) {
+		s.heartbeatInterval = heartbeatInterval
+		s.readTimeout = readTimeout
+	}
+}
+
+// Wait between reconnections according to the given backoff. Defaults to waiting 1 second,
+// doubling up to 1 minute.
+func WithReconnectBackoff(backoff *retry.ExponentialBackoffWithJitter) StreamOption {
+	return func(s *Stream) {
+		s.backoff = backoff
+	}
 }
 
 func NewStream(
@@ -25,51 +108,139 @@ func NewStream(
 	uID int64,
 	token string,
 	endpoints []*bilibili.LiveEndpoint,
+	options ...StreamOption,
 ) *Stream {
 	s := &Stream{
 		RoomID:    roomID,
 		uid:       uID,
 		token:     token,
 		endpoints: endpoints,
+		transport: TransportTCP,
+
+		heartbeatInterval: defaultHeartbeatInterval,
+		readTimeout:       defaultReadTimeout,
+		backoff:           defaultReconnectBackoff,
+		fetchStreamInfo:   bilibili.GetMessageStreamInfo,
+	}
+
+	for _, f := range options {
+		f(s)
 	}
 
 	return s
 }
 
+func (s *Stream) Room() int64 {
+	return s.RoomID
+}
+
 func (s *Stream) Run(
 	ctx context.Context,
 	msgChan chan<- Message, // Send decoded message to the channel
 ) {
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
-
 	nextEndpoint := s.roundRobinEndpointSelector()
 
+	transport := s.transport
+	if transport == TransportAuto {
+		transport = TransportTCP
+	}
+	tcpFailures := 0
+	// Consecutive failed connections, reset once a connection stays healthy
+	failures := 0
+
 	for {
 		endpoint := nextEndpoint()
 
-		conn, err := connect(endpoint)
+		conn, err := dial(ctx, transport, endpoint)
 		if err != nil {
-			log.Err(err).Msgf("无法连接到弹幕服务器: %s:%d, 5秒后重试其他服务器...", endpoint.Host, endpoint.Port)
-			time.Sleep(5 * time.Second)
-			continue
-		}
-		log.Info().Msgf("连接到弹幕服务器: %s:%d", endpoint.Host, endpoint.Port)
+			if ctx.Err() != nil {
+				log.Info().Msg("退出弹幕流")
+				return
+			}
+
+			backoff := s.backoff.Backoff(failures)
+			failures++
+			log.Err(err).Str("transport", string(transport)).Msgf("无法连接到弹幕服务器: %s, %s后重试其他服务器...", endpoint.Host, backoff.Round(time.Millisecond))
+
+			if s.transport == TransportAuto && transport == TransportTCP {
+				tcpFailures++
+				if tcpFailures >= autoFallbackThreshold {
+					log.Warn().Int("failures", tcpFailures).Msg("TCP连接弹幕服务器连续失败, 改用WSS连接")
+					transport = TransportWSS
+				}
+			}
 
-		if err := s.driveConnection(ctx, conn, msgChan); err != nil {
-			if errors.Is(err, context.Canceled) {
+			if !sleep(ctx, backoff) {
 				log.Info().Msg("退出弹幕流")
-				conn.Close()
 				return
 			}
+			continue
+		}
+		tcpFailures = 0
+		log.Info().Str("transport", string(transport)).Msgf("连接到弹幕服务器: %s", conn.RemoteAddr())
+
+		connected := time.Now()
+		err = s.driveConnection(ctx, conn, msgChan)
+		if errors.Is(err, context.Canceled) {
+			log.Info().Msg("退出弹幕流")
+			return
+		}
+
+		// The connection outlived a stall, so the servers are reachable again
+		if time.Since(connected) > s.readTimeout {
+			failures = 0
+		}
+		backoff := s.backoff.Backoff(failures)
+		failures++
+
+		if errors.Is(err, ErrAuthFailed) {
+			log.Err(err).Msg("弹幕服务器认证失败, 重新获取弹幕流信息...")
+			if err := s.refreshStreamInfo(ctx); err != nil {
+				log.Err(err).Msgf("无法获取直播间弹幕流信息, %s后使用原有信息重试...", backoff.Round(time.Millisecond))
+			} else {
+				nextEndpoint = s.roundRobinEndpointSelector()
+			}
+		} else {
+			log.Err(err).Msgf("弹幕服务器连接异常退出, %s后重试其他服务器...", backoff.Round(time.Millisecond))
+		}
 
-			log.Err(err).Msgf("弹幕服务器连接异常退出, 5秒后重试其他服务器...")
+		if !sleep(ctx, backoff) {
+			log.Info().Msg("退出弹幕流")
+			return
 		}
+	}
+}
+
+// Sleep for the given duration. Returns false if ctx is cancelled first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
 
-		time.Sleep(5 * time.Second)
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
 	}
 }
 
+// Replace the token and endpoints with fresh ones, e.g., after the token expires.
+// Only called from Run between connections.
+func (s *Stream) refreshStreamInfo(ctx context.Context) error {
+	info, err := s.fetchStreamInfo(ctx, s.RoomID)
+	if err != nil {
+		return err
+	}
+	if len(info.HostList) == 0 {
+		return errors.New("弹幕流信息中没有服务器地址")
+	}
+
+	s.token = info.Token
+	s.endpoints = info.HostList
+	log.Info().Int("endpoints", len(info.HostList)).Msg("已更新弹幕流信息")
+	return nil
+}
+
 func (s *Stream) roundRobinEndpointSelector() func() *bilibili.LiveEndpoint {
 	curEndpoint := 0
 	return func() *bilibili.LiveEndpoint {
@@ -80,23 +251,73 @@ func (s *Stream) roundRobinEndpointSelector() func() *bilibili.LiveEndpoint {
 	}
 }
 
-// Drive the life cycle of an established TCP connection until either context is cancelled or the connection is closed.
-// Note that the socket is BLOCKING, so if the server blocks forever we will too.
+// Drive the life cycle of an established connection until either context is cancelled or the
+// connection fails, and close it. It always returns a non-nil error.
+//
+// The connection fails if either the reading or the heartbeat goroutine fails, or no heartbeat reply
+// arrives within readTimeout, which also catches a server that keeps the socket open but stops
+// sending. Both goroutines are gone when it returns.
 func (s *Stream) driveConnection(ctx context.Context, conn net.Conn, msgChan chan<- Message) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel(nil)
+
+	wg.Add(1)
 	go func() {
+		defer wg.Done()
 		if err := s.authAndHeartbeat(ctx, conn); err != nil {
-			log.Err(err).Msg("心跳线程异常退出")
+			cancel(fmt.Errorf("心跳线程异常退出: %w", err))
 		}
 	}()
 
+	// Closing the connection unblocks the pending read and write
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	err := s.readMessages(ctx, conn, msgChan)
+	if cause := context.Cause(ctx); cause != nil {
+		// The read failed because the connection is torn down, report why
+		return cause
+	}
+	return err
+}
+
+// Read messages from the connection until it fails.
+func (s *Stream) readMessages(ctx context.Context, conn net.Conn, msgChan chan<- Message) error {
+	// The first deadline covers the auth reply and the reply to the first heartbeat
+	if err := conn.SetReadDeadline(time.Now().Add(s.readTimeout)); err != nil {
+		return err
+	}
+
 	for {
-		if ctx.Err() != nil {
-			return ctx.Err()
+		frame, err := readFrame(conn)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return fmt.Errorf("%s内没有收到心跳回复, 连接已失效: %w", s.readTimeout, err)
+		}
+		if err != nil {
+			return err
+		}
+
+		if op := frameOp(frame); op == OpHeartbeatReply || op == OpAuthReply {
+			if err := conn.SetReadDeadline(time.Now().Add(s.readTimeout)); err != nil {
+				return err
+			}
+		}
+
+		if s.capture != nil {
+			if err := s.capture.Record(time.Now(), frame); err != nil {
+				log.Err(err).Msg("无法写入抓包文件")
+			}
 		}
 
-		messages, err := ReadMessages(conn)
+		messages, err := ReadMessages(bytes.NewReader(frame))
 		if err != nil {
-			log.Err(err).Msg("读取消息线程异常退出")
 			return err
 		}
 
@@ -104,7 +325,11 @@ func (s *Stream) driveConnection(ctx context.Context, conn net.Conn, msgChan cha
 			if message == nil {
 				continue
 			}
-			msgChan <- *message
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case msgChan <- *message:
+			}
 		}
 
 		// Wait for 10ms before reading again
@@ -117,6 +342,7 @@ func (s *Stream) driveConnection(ctx context.Context, conn net.Conn, msgChan cha
 	}
 }
 
+// Send the auth message and then a heartbeat every heartbeatInterval until ctx is cancelled.
 func (s *Stream) authAndHeartbeat(ctx context.Context, conn net.Conn) error {
 	sequenceID := uint32(0)
 	// Send auth message
@@ -134,41 +360,33 @@ func (s *Stream) authAndHeartbeat(ctx context.Context, conn net.Conn) error {
 		return err
 	}
 
-	authMessageHeader := MessageHeader{
-		TotalLength:  uint32(len(authMessageBytes)) + 16,
-		HeaderLength: 16,
-		Type:         MessageTypeUncompressedNormal,
-		OpCode:       OpAuth,
-		SequenceID:   sequenceID,
-	}
-
-	heartbeatHeader := MessageHeader{
-		TotalLength:  uint32(16),
-		HeaderLength: 16,
-		Type:         MessageTypeUncompressedNormal,
-		OpCode:       OpHeartbeat,
-		SequenceID:   sequenceID,
+	// Each frame is written with a single Write call, which the websocket transport relies on
+	authFrame, err := encodeFrame(OpAuth, sequenceID, authMessageBytes)
+	if err != nil {
+		return err
 	}
 
 	// Write auth message
-	if err := authMessageHeader.Write(conn); err != nil {
-		return err
-	}
-	if _, err := conn.Write(authMessageBytes); err != nil {
+	if _, err := conn.Write(authFrame); err != nil {
 		return err
 	}
 
-	// Send heartbeat every 20 seconds, to give some headroom and avoid the connection being
-	// terminated by the server
-	ticker := time.NewTicker(time.Second * 20)
+	ticker := time.NewTicker(s.heartbeatInterval)
 	defer ticker.Stop()
 
 	for {
-		if err := heartbeatHeader.Write(conn); err != nil {
+		sequenceID++
+		heartbeatFrame, err := encodeFrame(OpHeartbeat, sequenceID, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := conn.Write(heartbeatFrame); err != nil {
+			if ctx.Err() != nil {
+				// The connection is closed because it is torn down
+				return nil
+			}
 			return err
 		}
-		sequenceID++
-		heartbeatHeader.SequenceID = sequenceID
 
 		select {
 		case <-ctx.Done():
@@ -178,11 +396,3 @@ func (s *Stream) authAndHeartbeat(ctx context.Context, conn net.Conn) error {
 		}
 	}
 }
-
-func connect(endpoint *bilibili.LiveEndpoint) (net.Conn, error) {
-	conn, err := net.Dial("tcp", net.JoinHostPort(endpoint.Host, strconv.Itoa(endpoint.Port)))
-	if err != nil {
-		return nil, err
-	}
-	return conn, nil
-}
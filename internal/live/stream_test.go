@@ -0,0 +1,216 @@
+package live_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/YangchenYe323/boxtroll/internal/bilibili"
+	"github.com/YangchenYe323/boxtroll/internal/live"
+	"github.com/YangchenYe323/boxtroll/internal/retry"
+)
+
+// A danmaku server on localhost, handing every accepted connection to the test
+type fakeServer struct {
+	listener net.Listener
+	conns    chan net.Conn
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	server := &fakeServer{listener: listener, conns: make(chan net.Conn, 8)}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server.conns <- conn
+		}
+	}()
+
+	return server
+}
+
+func (f *fakeServer) endpoint() *bilibili.LiveEndpoint {
+	addr := f.listener.Addr().(*net.TCPAddr)
+	return &bilibili.LiveEndpoint{Host: addr.IP.String(), Port: addr.Port}
+}
+
+// Wait for the next connection of the stream
+func (f *fakeServer) accept(t *testing.T) net.Conn {
+	t.Helper()
+
+	select {
+	case conn := <-f.conns:
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected a connection within 2s, got none")
+		return nil
+	}
+}
+
+// Read the auth frame sent by the stream
+func readAuth(t *testing.T, conn net.Conn) live.AuthMessage {
+	t.Helper()
+
+	var header live.MessageHeader
+	if err := header.Read(conn); err != nil {
+		t.Fatalf("failed to read auth header: %v", err)
+	}
+	if header.OpCode != live.OpAuth {
+		t.Fatalf("expected auth frame, got op %d", header.OpCode)
+	}
+	body := make([]byte, header.TotalLength-uint32(header.HeaderLength))
+	if _, err := io.ReadFull(conn, body); err != nil {
+		t.Fatalf("failed to read auth body: %v", err)
+	}
+
+	var auth live.AuthMessage
+	if err := json.Unmarshal(body, &auth); err != nil {
+		t.Fatalf("failed to parse auth message: %v", err)
+	}
+	return auth
+}
+
+func writeFrame(t *testing.T, conn net.Conn, op live.Op, body []byte) {
+	t.Helper()
+
+	header := live.MessageHeader{
+		TotalLength:  uint32(len(body)) + 16,
+		HeaderLength: 16,
+		Type:         live.MessageTypeUncompressedOperation,
+		OpCode:       op,
+	}
+	var buf bytes.Buffer
+	if err := header.Write(&buf); err != nil {
+		t.Fatalf("failed to write header: %v", err)
+	}
+	buf.Write(body)
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		t.Fatalf("failed to write frame: %v", err)
+	}
+}
+
+func writePopularity(t *testing.T, conn net.Conn, popularity uint32) {
+	t.Helper()
+	writeFrame(t, conn, live.OpHeartbeatReply, binary.BigEndian.AppendUint32(nil, popularity))
+}
+
+func expectPopularity(t *testing.T, msgChan <-chan live.Message, popularity int64) {
+	t.Helper()
+
+	select {
+	case msg := <-msgChan:
+		if msg.Cmd != live.CmdPopularity || msg.Popularity.Popularity != popularity {
+			t.Fatalf("expected popularity %d, got %+v", popularity, msg)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected popularity %d within 2s, got nothing", popularity)
+	}
+}
+
+func runStream(t *testing.T, stream *live.Stream) (chan live.Message, func()) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	msgChan := make(chan live.Message, 16)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		stream.Run(ctx, msgChan)
+	}()
+
+	stop := func() {
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expected the stream to exit within 2s after cancellation")
+		}
+	}
+	t.Cleanup(stop)
+	return msgChan, stop
+}
+
+var testBackoff = &retry.ExponentialBackoffWithJitter{
+	Min:        10 * time.Millisecond,
+	Max:        50 * time.Millisecond,
+	Multiplier: 2,
+}
+
+// A server that stops replying to heartbeats is dropped and the stream reconnects.
+func TestStreamReconnectsStalledConnection(t *testing.T) {
+	server := newFakeServer(t)
+	stream := live.NewStream(1, 2, "token", []*bilibili.LiveEndpoint{server.endpoint()},
+		live.WithLiveness(20*time.Millisecond, 200*time.Millisecond),
+		live.WithReconnectBackoff(testBackoff),
+	)
+	msgChan, stop := runStream(t, stream)
+
+	stalled := server.accept(t)
+	readAuth(t, stalled)
+	writeFrame(t, stalled, live.OpAuthReply, []byte(`{"code":0}`))
+	writePopularity(t, stalled, 1)
+	expectPopularity(t, msgChan, 1)
+
+	// Keep the socket open but stay silent, the stream must give up on it
+	start := time.Now()
+	conn := server.accept(t)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected the stalled connection to be dropped within 1s, took %s", elapsed)
+	}
+
+	readAuth(t, conn)
+	writeFrame(t, conn, live.OpAuthReply, []byte(`{"code":0}`))
+	writePopularity(t, conn, 42)
+	expectPopularity(t, msgChan, 42)
+
+	stop()
+}
+
+// A rejected token is replaced by a fresh one before reconnecting.
+func TestStreamRefreshesTokenOnAuthFailure(t *testing.T) {
+	server := newFakeServer(t)
+	fetched := 0
+	stream := live.NewStream(1, 2, "expired", []*bilibili.LiveEndpoint{server.endpoint()},
+		live.WithReconnectBackoff(testBackoff),
+		live.WithStreamInfoFetcher(func(ctx context.Context, roomID int64) (*bilibili.MessageStreamInfo, error) {
+			fetched++
+			return &bilibili.MessageStreamInfo{Token: "fresh", HostList: []*bilibili.LiveEndpoint{server.endpoint()}}, nil
+		}),
+	)
+	msgChan, stop := runStream(t, stream)
+
+	conn := server.accept(t)
+	if auth := readAuth(t, conn); auth.Key != "expired" || auth.RoomID != 1 {
+		t.Fatalf("expected the initial token for room 1, got %+v", auth)
+	}
+	writeFrame(t, conn, live.OpAuthReply, []byte(`{"code":-101}`))
+
+	conn = server.accept(t)
+	if auth := readAuth(t, conn); auth.Key != "fresh" {
+		t.Fatalf("expected the refreshed token, got %q", auth.Key)
+	}
+	writeFrame(t, conn, live.OpAuthReply, []byte(`{"code":0}`))
+	writePopularity(t, conn, 7)
+	expectPopularity(t, msgChan, 7)
+
+	stop()
+	if fetched != 1 {
+		t.Fatalf("expected the stream info to be fetched once, got %d", fetched)
+	}
+}
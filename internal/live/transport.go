@@ -0,0 +1,161 @@
+package live
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/YangchenYe323/boxtroll/internal/bilibili"
+	"github.com/gorilla/websocket"
+)
+
+// Transport selects how the stream connects to the bilibili danmaku servers.
+type Transport string
+
+const (
+	// Raw TCP connection to host:port
+	TransportTCP Transport = "tcp"
+	// Websocket over TLS connection to wss://host:wss_port/sub
+	TransportWSS Transport = "wss"
+	// Try raw TCP first, fall back to WSS permanently if TCP dials keep failing
+	TransportAuto Transport = "auto"
+)
+
+// Number of consecutive TCP dial failures before TransportAuto switches to WSS
+const autoFallbackThreshold = 3
+
+func ParseTransport(s string) (Transport, error) {
+	switch t := Transport(s); t {
+	case TransportTCP, TransportWSS, TransportAuto:
+		return t, nil
+	default:
+		return "", fmt.Errorf("未知的弹幕连接方式: %s (可选 tcp, wss, auto)", s)
+	}
+}
+
+func dial(ctx context.Context, transport Transport, endpoint *bilibili.LiveEndpoint) (net.Conn, error) {
+	switch transport {
+	case TransportWSS:
+		return dialWSS(ctx, endpoint)
+	default:
+		return dialTCP(ctx, endpoint)
+	}
+}
+
+func dialTCP(ctx context.Context, endpoint *bilibili.LiveEndpoint) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", net.JoinHostPort(endpoint.Host, strconv.Itoa(endpoint.Port)))
+}
+
+func dialWSS(ctx context.Context, endpoint *bilibili.LiveEndpoint) (net.Conn, error) {
+	port := endpoint.WssPort
+	if port == 0 {
+		port = 443
+	}
+	url := fmt.Sprintf("wss://%s/sub", net.JoinHostPort(endpoint.Host, strconv.Itoa(port)))
+
+	// The default dialer honors HTTP(S)_PROXY from the environment
+	ws, _, err := websocket.DefaultDialer.DialContext(ctx, url, http.Header{
+		"User-Agent": bilibili.DefaultClient.DefaultHeaders["User-Agent"],
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &wsConn{ws: ws}, nil
+}
+
+// wsConn adapts a websocket connection to net.Conn so that it can carry the same
+// MessageHeader framing as the raw TCP connection.
+//
+// The server packs one or more complete frames in each binary websocket message, and
+// expects each frame we send to arrive in its own binary message. Thus every Write
+// call must contain exactly one complete frame.
+type wsConn struct {
+	ws     *websocket.Conn
+	reader io.Reader // Reader of the websocket message currently being consumed
+}
+
+var _ net.Conn = &wsConn{}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for {
+		if c.reader == nil {
+			_, reader, err := c.ws.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			c.reader = reader
+		}
+
+		n, err := c.reader.Read(p)
+		if err == io.EOF {
+			// Current websocket message exhausted, move on to the next one
+			c.reader = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) Close() error {
+	return c.ws.Close()
+}
+
+func (c *wsConn) LocalAddr() net.Addr {
+	return c.ws.LocalAddr()
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.ws.RemoteAddr()
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.ws.SetWriteDeadline(t)
+}
+
+func (c *wsConn) SetReadDeadline(t time.Time) error {
+	return c.ws.SetReadDeadline(t)
+}
+
+func (c *wsConn) SetWriteDeadline(t time.Time) error {
+	return c.ws.SetWriteDeadline(t)
+}
+
+// Encode a complete frame (header + body) so that it can be written with a single Write call,
+// which is required by the websocket transport.
+func encodeFrame(op Op, sequenceID uint32, body []byte) ([]byte, error) {
+	header := MessageHeader{
+		TotalLength:  uint32(len(body)) + 16,
+		HeaderLength: 16,
+		Type:         MessageTypeUncompressedNormal,
+		OpCode:       op,
+		SequenceID:   sequenceID,
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(int(header.TotalLength))
+	if err := header.Write(&buf); err != nil {
+		return nil, err
+	}
+	buf.Write(body)
+	return buf.Bytes(), nil
+}
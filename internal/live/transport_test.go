@@ -0,0 +1,108 @@
+package live
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestParseTransport(t *testing.T) {
+	tests := []struct {
+		s        string
+		expected Transport
+	}{
+		{"tcp", TransportTCP},
+		{"wss", TransportWSS},
+		{"auto", TransportAuto},
+	}
+	for _, test := range tests {
+		actual, err := ParseTransport(test.s)
+		if err != nil {
+			t.Fatalf("failed to parse transport %q: %v", test.s, err)
+		}
+		if actual != test.expected {
+			t.Fatalf("expected transport %s for %q, got %s", test.expected, test.s, actual)
+		}
+	}
+
+	for _, s := range []string{"", "ws", "TCP", "udp"} {
+		if _, err := ParseTransport(s); err == nil {
+			t.Fatalf("expected error for transport %q, got nil", s)
+		}
+	}
+}
+
+// Frames are read across websocket message boundaries, and every Write is sent as one message.
+func TestWsConnRoundTrip(t *testing.T) {
+	frames := make([][]byte, 3)
+	for i := range frames {
+		frame, err := encodeFrame(OpNormal, uint32(i), []byte(strings.Repeat("x", 10*(i+1))))
+		if err != nil {
+			t.Fatalf("failed to encode frame: %v", err)
+		}
+		frames[i] = frame
+	}
+	stream := bytes.Join(frames, nil)
+
+	// The second frame is split inside its header, with an empty message in between
+	messages := [][]byte{
+		stream[:len(frames[0])+5],
+		{},
+		stream[len(frames[0])+5 : len(frames[0])+len(frames[1])],
+		stream[len(frames[0])+len(frames[1]):],
+	}
+
+	received := make(chan []byte, 1)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+
+		for _, message := range messages {
+			if err := ws.WriteMessage(websocket.BinaryMessage, message); err != nil {
+				return
+			}
+		}
+		_, message, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		received <- message
+	}))
+	defer server.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("failed to dial websocket server: %v", err)
+	}
+	conn := &wsConn{ws: ws}
+	defer conn.Close()
+
+	for i, expected := range frames {
+		frame, err := readFrame(conn)
+		if err != nil {
+			t.Fatalf("failed to read frame %d: %v", i, err)
+		}
+		if !bytes.Equal(frame, expected) {
+			t.Fatalf("expected frame %d to be %x, got %x", i, expected, frame)
+		}
+	}
+
+	heartbeat, err := encodeFrame(OpHeartbeat, 1, nil)
+	if err != nil {
+		t.Fatalf("failed to encode heartbeat: %v", err)
+	}
+	if n, err := conn.Write(heartbeat); err != nil || n != len(heartbeat) {
+		t.Fatalf("expected to write %d bytes, got %d and %v", len(heartbeat), n, err)
+	}
+	if message := <-received; !bytes.Equal(message, heartbeat) {
+		t.Fatalf("expected the heartbeat in a single message %x, got %x", heartbeat, message)
+	}
+}
@@ -0,0 +1,35 @@
+package overlay
+
+import "time"
+
+// A snapshot of the leaderboards of a live room, served to the browser source.
+type Report struct {
+	RoomID     int64     `json:"room_id"`
+	UpdatedAt  time.Time `json:"updated_at"`
+	Popularity int64     `json:"popularity"` // 人气值 of the room, 0 if unknown
+	Boards     []*Board  `json:"boards"`
+}
+
+// A single leaderboard, e.g., 本场盲盒幸运儿排行榜
+type Board struct {
+	Title   string   `json:"title"`
+	Entries []*Entry `json:"entries"`
+	Size    int      `json:"size"` // Number of rows to display, missing rows are shown as placeholders
+}
+
+type Entry struct {
+	UID     int64   `json:"uid"`
+	Name    string  `json:"name"`
+	Face    string  `json:"face"`           // Avatar URL
+	Value   int64   `json:"value"`          // Raw value used for ranking
+	Display string  `json:"display"`        // Formatted value, e.g., "+12 电池"
+	Luck    string  `json:"luck,omitempty"` // How the entry ranks by luck, e.g., "比92%的人倒霉"
+	Gifts   []*Gift `json:"gifts,omitempty"`
+}
+
+// A gift shown next to an entry, e.g., the blind boxes the user has sent
+type Gift struct {
+	GiftID int64  `json:"gift_id"`
+	Name   string `json:"name"`
+	ImgURL string `json:"img_url"`
+}
@@ -0,0 +1,222 @@
+// This package serves a browser-source overlay for OBS showing the live leaderboards.
+
+package overlay
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+//go:embed static
+var static embed.FS
+
+// Server serves the overlay page and pushes report updates to it.
+// A single server may serve several live rooms, each publishing its own report.
+//
+// Routes:
+// - /: The overlay page to be added as an OBS Browser Source
+// - /api/report: The latest report as JSON
+// - /api/events: Server-sent events stream of reports
+//
+// Every route takes an optional ?room=<room id> query parameter selecting the live room,
+// defaulting to the room with the smallest ID.
+type Server struct {
+	addr string
+
+	mu          sync.Mutex
+	reports     map[int64][]byte      // Latest encoded report of each room
+	subscribers map[chan []byte]int64 // Connected SSE clients -> room, 0 for the default room
+}
+
+func New(addr string) *Server {
+	return &Server{
+		addr:        addr,
+		reports:     make(map[int64][]byte),
+		subscribers: make(map[chan []byte]int64),
+	}
+}
+
+func (s *Server) Addr() string {
+	return s.addr
+}
+
+// Serve the overlay until ctx is cancelled.
+func (s *Server) Run(ctx context.Context) error {
+	srv := &http.Server{
+		Addr:    s.addr,
+		Handler: s.handler(),
+		BaseContext: func(_ net.Listener) context.Context {
+			return ctx
+		},
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	log.Info().Str("addr", fmt.Sprintf("http://%s/", s.addr)).Msg("浏览器源叠加层已启动")
+
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// The routes of the server
+func (s *Server) handler() http.Handler {
+	staticFS, err := fs.Sub(static, "static")
+	if err != nil {
+		// unreachable
+		panic(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /", http.FileServerFS(staticFS))
+	mux.HandleFunc("GET /api/report", s.handleReport)
+	mux.HandleFunc("GET /api/events", s.handleEvents)
+	return mux
+}
+
+// Publish a new report to all clients connected to the room of the report.
+func (s *Server) Publish(report *Report) {
+	bytes, err := json.Marshal(report)
+	if err != nil {
+		// unreachable
+		panic(err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.reports[report.RoomID] = bytes
+	defaultRoom := s.defaultRoom()
+	for sub, room := range s.subscribers {
+		if room == 0 {
+			room = defaultRoom
+		}
+		if room != report.RoomID {
+			continue
+		}
+
+		select {
+		case sub <- bytes:
+		default:
+			// Slow client, it will catch up with the next report
+		}
+	}
+}
+
+// The room served when the client does not specify one. Must be called with mu held.
+func (s *Server) defaultRoom() int64 {
+	var defaultRoom int64
+	for room := range s.reports {
+		if defaultRoom == 0 || room < defaultRoom {
+			defaultRoom = room
+		}
+	}
+	return defaultRoom
+}
+
+// Latest report of the given room. Must be called with mu held.
+func (s *Server) latestReport(room int64) []byte {
+	if room == 0 {
+		room = s.defaultRoom()
+	}
+	return s.reports[room]
+}
+
+// Parse the ?room= query parameter, 0 if not given.
+func parseRoom(r *http.Request) (int64, error) {
+	param := r.URL.Query().Get("room")
+	if param == "" {
+		return 0, nil
+	}
+
+	room, err := strconv.ParseInt(param, 10, 64)
+	if err != nil || room <= 0 {
+		return 0, fmt.Errorf("invalid room %q", param)
+	}
+	return room, nil
+}
+
+func (s *Server) handleReport(w http.ResponseWriter, r *http.Request) {
+	room, err := parseRoom(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	report := s.latestReport(room)
+	s.mu.Unlock()
+
+	if report == nil {
+		http.Error(w, "no report yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(report)
+}
+
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	room, err := parseRoom(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sub := make(chan []byte, 1)
+
+	s.mu.Lock()
+	s.subscribers[sub] = room
+	// Send the latest report right away so the page does not start empty
+	if report := s.latestReport(room); report != nil {
+		sub <- report
+	}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.subscribers, sub)
+		s.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case report := <-sub:
+			if _, err := fmt.Fprintf(w, "event: report\ndata: %s\n\n", report); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package overlay
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func getReport(t *testing.T, url string) *Report {
+	t.Helper()
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("failed to get report: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("expected status 200 from %s, got %d: %s", url, resp.StatusCode, body)
+	}
+
+	var report Report
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Fatalf("failed to decode report: %v", err)
+	}
+	return &report
+}
+
+// Subscribe to the reports of a room, the reports are sent to the returned channel
+func subscribe(t *testing.T, url string) <-chan *Report {
+	t.Helper()
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200 from %s, got %d", url, resp.StatusCode)
+	}
+
+	reports := make(chan *Report, 10)
+	go func() {
+		defer close(reports)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+			if !ok {
+				continue
+			}
+			var report Report
+			if err := json.Unmarshal([]byte(data), &report); err != nil {
+				return
+			}
+			reports <- &report
+		}
+	}()
+	return reports
+}
+
+func nextReport(t *testing.T, reports <-chan *Report) *Report {
+	t.Helper()
+
+	select {
+	case report, ok := <-reports:
+		if !ok {
+			t.Fatalf("expected a report, got end of stream")
+		}
+		return report
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for a report")
+		return nil
+	}
+}
+
+func TestServerRooms(t *testing.T) {
+	s := New("")
+	server := httptest.NewServer(s.handler())
+	// Closed after the subscriptions, it waits for their connections
+	t.Cleanup(server.Close)
+
+	// No room has published yet
+	resp, err := http.Get(server.URL + "/api/report")
+	if err != nil {
+		t.Fatalf("failed to get report: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected status 503 before the first report, got %d", resp.StatusCode)
+	}
+
+	s.Publish(&Report{RoomID: 456, Popularity: 1})
+	s.Publish(&Report{RoomID: 123, Popularity: 2})
+
+	tests := []struct {
+		query      string
+		room       int64
+		popularity int64
+	}{
+		{"?room=456", 456, 1},
+		{"?room=123", 123, 2},
+		// The smallest room ID, not the first to publish
+		{"", 123, 2},
+	}
+	for _, test := range tests {
+		report := getReport(t, server.URL+"/api/report"+test.query)
+		if report.RoomID != test.room || report.Popularity != test.popularity {
+			t.Fatalf("expected report of room %d with popularity %d for %q, got room %d with popularity %d",
+				test.room, test.popularity, test.query, report.RoomID, report.Popularity)
+		}
+	}
+
+	resp, err = http.Get(server.URL + "/api/report?room=abc")
+	if err != nil {
+		t.Fatalf("failed to get report: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected status 400 for an invalid room, got %d", resp.StatusCode)
+	}
+
+	// Subscribers start with the latest report of their room, then only get the reports of their room
+	room456 := subscribe(t, server.URL+"/api/events?room=456")
+	defaultRoom := subscribe(t, server.URL+"/api/events")
+	if report := nextReport(t, room456); report.RoomID != 456 || report.Popularity != 1 {
+		t.Fatalf("expected the latest report of room 456, got room %d with popularity %d", report.RoomID, report.Popularity)
+	}
+	if report := nextReport(t, defaultRoom); report.RoomID != 123 || report.Popularity != 2 {
+		t.Fatalf("expected the latest report of room 123, got room %d with popularity %d", report.RoomID, report.Popularity)
+	}
+
+	s.Publish(&Report{RoomID: 123, Popularity: 3})
+	s.Publish(&Report{RoomID: 456, Popularity: 4})
+	if report := nextReport(t, room456); report.RoomID != 456 || report.Popularity != 4 {
+		t.Fatalf("expected the new report of room 456, got room %d with popularity %d", report.RoomID, report.Popularity)
+	}
+	if report := nextReport(t, defaultRoom); report.RoomID != 123 || report.Popularity != 3 {
+		t.Fatalf("expected the new report of room 123, got room %d with popularity %d", report.RoomID, report.Popularity)
+	}
+}
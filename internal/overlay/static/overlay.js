@@ -0,0 +1,118 @@
+// Render the leaderboards pushed by boxtroll.
+//
+// Query parameters:
+// - board: only show boards whose title contains the given text, e.g., ?board=电影票
+// - room: show the given live room when boxtroll monitors several rooms, e.g., ?room=22637261
+// - luck: show how each entry ranks by luck, e.g., ?luck=1 shows 比92%的人倒霉
+// - rotate: show two boards at a time and rotate to the next two every given seconds, e.g., ?rotate=10
+// - popularity: show the popularity counter of the room above the boards, e.g., ?popularity=1
+"use strict";
+
+const params = new URLSearchParams(window.location.search);
+const boardFilter = params.get("board");
+const room = params.get("room");
+const showLuck = params.get("luck") === "1";
+const showPopularity = params.get("popularity") === "1";
+const rotateSeconds = Number(params.get("rotate")) || 0;
+const BOARDS_PER_PAGE = 2;
+
+let lastReport = null;
+let page = 0;
+
+function element(tag, className, text) {
+  const el = document.createElement(tag);
+  if (className) {
+    el.className = className;
+  }
+  if (text !== undefined) {
+    el.textContent = text;
+  }
+  return el;
+}
+
+function image(className, src) {
+  const img = element("img", className);
+  img.src = src;
+  // Bilibili image hosts reject requests with a foreign referrer
+  img.referrerPolicy = "no-referrer";
+  return img;
+}
+
+function renderEntry(entry, rank) {
+  const row = element("div", "entry");
+  row.appendChild(element("span", "rank", `${rank}.`));
+
+  if (!entry) {
+    row.classList.add("empty");
+    row.appendChild(element("span", "name", "暂无~"));
+    return row;
+  }
+
+  if (entry.face) {
+    row.appendChild(image("face", entry.face));
+  }
+  row.appendChild(element("span", "name", entry.name));
+  if (showLuck && entry.luck) {
+    row.appendChild(element("span", "luck", entry.luck));
+  }
+  for (const gift of entry.gifts || []) {
+    const img = image("gift", gift.img_url);
+    img.title = gift.name;
+    row.appendChild(img);
+  }
+
+  const value = element("span", "value", entry.display);
+  if (entry.value > 0) {
+    value.classList.add("positive");
+  } else if (entry.value < 0) {
+    value.classList.add("negative");
+  }
+  row.appendChild(value);
+  return row;
+}
+
+function render(report) {
+  lastReport = report;
+  const container = document.getElementById("boards");
+  container.replaceChildren();
+
+  if (showPopularity && report.popularity > 0) {
+    container.appendChild(element("div", "popularity", `人气 ${report.popularity}`));
+  }
+
+  let boards = (report.boards || []).filter((board) => !boardFilter || board.title.includes(boardFilter));
+  if (rotateSeconds > 0 && boards.length > 0) {
+    const pages = Math.ceil(boards.length / BOARDS_PER_PAGE);
+    const start = (page % pages) * BOARDS_PER_PAGE;
+    boards = boards.slice(start, start + BOARDS_PER_PAGE);
+  }
+
+  for (const board of boards) {
+    const el = element("div", "board");
+    el.appendChild(element("h2", null, board.title));
+    const entries = board.entries || [];
+    const size = Math.max(board.size, entries.length);
+    for (let i = 0; i < size; i++) {
+      el.appendChild(renderEntry(entries[i], i + 1));
+    }
+    container.appendChild(el);
+  }
+}
+
+function connect() {
+  const url = room ? `api/events?room=${encodeURIComponent(room)}` : "api/events";
+  const events = new EventSource(url);
+  events.addEventListener("report", (e) => render(JSON.parse(e.data)));
+  // EventSource reconnects by itself when boxtroll restarts
+}
+
+connect();
+
+if (rotateSeconds > 0) {
+  setInterval(() => {
+    page++;
+    if (lastReport) {
+      render(lastReport);
+    }
+  }, rotateSeconds * 1000);
+}
@@ -31,12 +31,30 @@ func (e *ExponentialBackoffWithJitter) Retry(f func() error, retriable func(erro
 		lastRetriableErr = err
 
 		time.Sleep(backoff)
-		backoff = time.Duration(float64(backoff) * e.Multiplier)
-		backoff += time.Duration(rand.Float64() * e.Jttr * float64(backoff))
-		if backoff > e.Max {
-			backoff = e.Max
-		}
+		backoff = e.next(backoff)
 	}
 
 	return lastRetriableErr
 }
+
+// Wait interval after the given number of consecutive failures, starting from 0, for callers that
+// never give up and drive the loop themselves, e.g., reconnecting to a server. MaxAttempts is ignored.
+func (e *ExponentialBackoffWithJitter) Backoff(failures int) time.Duration {
+	backoff := e.Min
+	for range failures {
+		if backoff >= e.Max {
+			break
+		}
+		backoff = e.next(backoff)
+	}
+	return backoff
+}
+
+func (e *ExponentialBackoffWithJitter) next(backoff time.Duration) time.Duration {
+	backoff = time.Duration(float64(backoff) * e.Multiplier)
+	backoff += time.Duration(rand.Float64() * e.Jttr * float64(backoff))
+	if backoff > e.Max {
+		backoff = e.Max
+	}
+	return backoff
+}
@@ -1,12 +1,16 @@
 package store
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/dgraph-io/badger/v4"
 	"github.com/rs/zerolog/log"
@@ -16,14 +20,43 @@ import (
 // Key space:
 // - user/<uid>: User metadata
 // - room/<roomID>: Room metadata
-// - <roomID>/<uid>/<boxID>: Box statistics
+// - stats/<roomID>/<uid>/<boxID>: Box statistics
+// - event/<roomID>/<timestamp>/<seq>: Gift event log
+// - event_user/<roomID>/<uid>/<timestamp>/<seq>: Gift event log indexed by user
+// - session/<roomID>/<sessionID>: Live session metadata
+// - session_stats/<roomID>/<sessionID>/<uid>/<boxID>: Box statistics of a live session
+// - journal/<roomID>/<eventID>: Accepted gift events not yet committed to box statistics
+// - seen/<roomID>/<eventID>: Recently accepted gift events, expiring after GIFT_EVENT_DEDUPE_WINDOW
+// - outcome/<roomID>/<uid>/<boxID>/<giftID>: Number of times a blind box yielded an outcome gift
+// - board/<roomID>/<board>/<period>/<uid>: Leaderboard scores
+// - board_seen/<roomID>/<eventID>: Recently scored gift events, expiring after GIFT_EVENT_DEDUPE_WINDOW
+// - revenue/<roomID>/<timestamp>/<seq>: Revenue event log (大航海 and 醒目留言)
+// - revenue_user/<roomID>/<uid>/<timestamp>/<seq>: Revenue event log indexed by user
+// - revenue_seen/<roomID>/<eventID>: Recently accepted revenue events, expiring after GIFT_EVENT_DEDUPE_WINDOW
+// - meta/event_seq: Sequence of gift and revenue events
+// - meta/schema_version: Version of the key space, see migration.go
 type badgerStore struct {
 	b *badger.DB
+
+	// Sequence used to disambiguate gift events with the same timestamp.
+	// Leased lazily on the first write.
+	eventSeqMu sync.Mutex
+	eventSeq   *badger.Sequence
 }
 
 var _ Store = &badgerStore{}
 
-func NewBadger(dbPath string) (Store, error) {
+type BadgerOption = func(opts *badger.Options)
+
+// Open the database read-only, e.g., for offline queries. It fails if the database
+// is opened by another process for writing, or was not closed properly.
+func WithReadOnly() BadgerOption {
+	return func(opts *badger.Options) {
+		opts.ReadOnly = true
+	}
+}
+
+func NewBadger(dbPath string, options ...BadgerOption) (Store, error) {
 	if dbPath == "" {
 		return nil, errors.New("db path is empty")
 	}
@@ -32,15 +65,38 @@ func NewBadger(dbPath string) (Store, error) {
 	// Use zerolog as the logger
 	opts.Logger = &badgerLoggerAdapter{}
 
+	for _, f := range options {
+		f(&opts)
+	}
+
 	db, err := badger.Open(opts)
 	if err != nil {
 		return nil, err
 	}
 
+	if opts.ReadOnly {
+		// Cannot migrate a read-only database, make sure we understand its key space
+		err = checkSchemaVersion(db)
+	} else {
+		_, err = migrate(db, dbPath, false)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
 	return &badgerStore{b: db}, nil
 }
 
 func (b *badgerStore) Close() error {
+	b.eventSeqMu.Lock()
+	defer b.eventSeqMu.Unlock()
+	if b.eventSeq != nil {
+		if err := b.eventSeq.Release(); err != nil {
+			log.Err(err).Msg("failed to release event sequence")
+		}
+	}
+
 	return b.b.Close()
 }
 
@@ -111,11 +167,46 @@ func (b *badgerStore) SetUser(ctx context.Context, uid int64, user *User) error
 	})
 }
 
+func (b *badgerStore) ListAllRoomIDs(ctx context.Context) ([]int64, error) {
+	var roomIDs []int64
+
+	if err := b.b.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchSize = 10
+		opts.PrefetchValues = false
+		opts.Prefix = []byte("room/")
+
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			item := iter.Item()
+
+			roomID := strings.TrimPrefix(string(item.Key()), "room/")
+			roomIDInt, err := strconv.ParseInt(roomID, 10, 64)
+			if err != nil {
+				panic("Malformed room ID: " + roomID)
+			}
+
+			roomIDs = append(roomIDs, roomIDInt)
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return roomIDs, nil
+}
+
 func (b *badgerStore) GetRoom(ctx context.Context, roomID int64) (*Room, error) {
 	key := fmt.Appendf(nil, "room/%d", roomID)
 	var room Room
 	if err := b.b.View(func(txn *badger.Txn) error {
 		item, err := txn.Get(key)
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return fmt.Errorf("%w: room %d not found", ErrNotFound, roomID)
+		}
 		if err != nil {
 			return err
 		}
@@ -140,7 +231,30 @@ func (b *badgerStore) SetRoom(ctx context.Context, roomID int64, room *Room) err
 }
 
 func (b *badgerStore) BoxStatisticsKey(roomID int64, uid int64, boxID int64) []byte {
-	return fmt.Appendf(nil, "%d/%d/%d", roomID, uid, boxID)
+	return fmt.Appendf(nil, "stats/%d/%d/%d", roomID, uid, boxID)
+}
+
+func (b *badgerStore) ParseBoxStatisticsKey(key []byte) (int64, int64, int64, error) {
+	stripped, ok := bytes.CutPrefix(key, []byte("stats/"))
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("malformed box statistics key: %s", string(key))
+	}
+
+	parts := strings.Split(string(stripped), "/")
+	if len(parts) != 3 {
+		return 0, 0, 0, fmt.Errorf("malformed box statistics key: %s", string(key))
+	}
+
+	var ids [3]int64
+	for i, part := range parts {
+		id, err := strconv.ParseInt(part, 10, 64)
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("malformed box statistics key: %s", string(key))
+		}
+		ids[i] = id
+	}
+
+	return ids[0], ids[1], ids[2], nil
 }
 
 func (b *badgerStore) GetBoxStatistics(ctx context.Context, transfers []BoxStatisticsTransfer, notFoundBehavior NotFoundBehavior) error {
@@ -196,7 +310,7 @@ func (b *badgerStore) ListAllBoxSenderUserIDs(ctx context.Context, roomID int64)
 		opts := badger.DefaultIteratorOptions
 		opts.PrefetchSize = 10
 		opts.PrefetchValues = false
-		opts.Prefix = fmt.Appendf(nil, "%d/", roomID)
+		opts.Prefix = fmt.Appendf(nil, "stats/%d/", roomID)
 
 		iter := txn.NewIterator(opts)
 		defer iter.Close()
@@ -204,8 +318,8 @@ func (b *badgerStore) ListAllBoxSenderUserIDs(ctx context.Context, roomID int64)
 		for iter.Rewind(); iter.Valid(); iter.Next() {
 			item := iter.Item()
 
-			// Trim <roommID>/ prefix and /<boxID> suffix
-			userID := strings.TrimPrefix(string(item.Key()), fmt.Sprintf("%d/", roomID))
+			// Trim stats/<roommID>/ prefix and /<boxID> suffix
+			userID := strings.TrimPrefix(string(item.Key()), fmt.Sprintf("stats/%d/", roomID))
 			userID, _, _ = strings.Cut(userID, "/")
 			userIDInt, err := strconv.ParseInt(userID, 10, 64)
 
@@ -229,7 +343,7 @@ func (b *badgerStore) ListAllBoxStatistics(ctx context.Context, roomID int64) (m
 
 	if err := b.b.View(func(txn *badger.Txn) error {
 		opts := badger.DefaultIteratorOptions
-		opts.Prefix = fmt.Appendf(nil, "%d/", roomID)
+		opts.Prefix = fmt.Appendf(nil, "stats/%d/", roomID)
 
 		iter := txn.NewIterator(opts)
 		defer iter.Close()
@@ -258,6 +372,599 @@ func (b *badgerStore) ListAllBoxStatistics(ctx context.Context, roomID int64) (m
 	return result, nil
 }
 
+func (b *badgerStore) nextEventSeq() (uint64, error) {
+	b.eventSeqMu.Lock()
+	defer b.eventSeqMu.Unlock()
+
+	if b.eventSeq == nil {
+		seq, err := b.b.GetSequence([]byte("meta/event_seq"), 1000)
+		if err != nil {
+			return 0, err
+		}
+		b.eventSeq = seq
+	}
+
+	return b.eventSeq.Next()
+}
+
+// Timestamps are zero padded so that keys sort in time order
+func eventKey(event *GiftEvent, seq uint64) []byte {
+	return fmt.Appendf(nil, "event/%d/%020d/%020d", event.RoomID, event.Timestamp.UnixNano(), seq)
+}
+
+func eventUserKey(event *GiftEvent, seq uint64) []byte {
+	return fmt.Appendf(nil, "event_user/%d/%d/%020d/%020d", event.RoomID, event.UID, event.Timestamp.UnixNano(), seq)
+}
+
+func (b *badgerStore) AppendGiftEvents(ctx context.Context, events []*GiftEvent) error {
+	return b.b.Update(func(txn *badger.Txn) error {
+		return b.appendGiftEvents(txn, events)
+	})
+}
+
+func (b *badgerStore) appendGiftEvents(txn *badger.Txn, events []*GiftEvent) error {
+	for _, event := range events {
+		seq, err := b.nextEventSeq()
+		if err != nil {
+			return fmt.Errorf("failed to lease event sequence: %w", err)
+		}
+
+		bytes, err := json.Marshal(event)
+		if err != nil {
+			return fmt.Errorf("failed to marshal gift event: %w", err)
+		}
+
+		if err := txn.Set(eventKey(event, seq), bytes); err != nil {
+			return fmt.Errorf("failed to set gift event: %w", err)
+		}
+		if err := txn.Set(eventUserKey(event, seq), bytes); err != nil {
+			return fmt.Errorf("failed to set gift event user index: %w", err)
+		}
+	}
+	return nil
+}
+
+func journalKey(roomID int64, eventID string) []byte {
+	return fmt.Appendf(nil, "journal/%d/%s", roomID, eventID)
+}
+
+func seenKey(roomID int64, eventID string) []byte {
+	return fmt.Appendf(nil, "seen/%d/%s", roomID, eventID)
+}
+
+func (b *badgerStore) AcceptGiftEvent(ctx context.Context, event *GiftEvent) (bool, error) {
+	if event.ID == "" {
+		return false, errors.New("gift event has no ID")
+	}
+
+	accepted := false
+	err := b.b.Update(func(txn *badger.Txn) error {
+		_, err := txn.Get(seenKey(event.RoomID, event.ID))
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, badger.ErrKeyNotFound) {
+			return err
+		}
+
+		bytes, err := json.Marshal(event)
+		if err != nil {
+			return fmt.Errorf("failed to marshal gift event: %w", err)
+		}
+
+		if err := txn.SetEntry(badger.NewEntry(seenKey(event.RoomID, event.ID), nil).WithTTL(GIFT_EVENT_DEDUPE_WINDOW)); err != nil {
+			return fmt.Errorf("failed to set seen gift event: %w", err)
+		}
+		if err := txn.Set(journalKey(event.RoomID, event.ID), bytes); err != nil {
+			return fmt.Errorf("failed to journal gift event: %w", err)
+		}
+		if err := b.appendGiftEvents(txn, []*GiftEvent{event}); err != nil {
+			return err
+		}
+
+		accepted = true
+		return nil
+	})
+
+	return accepted, err
+}
+
+func (b *badgerStore) ListJournal(ctx context.Context, roomID int64) ([]*GiftEvent, error) {
+	var events []*GiftEvent
+
+	if err := b.b.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = fmt.Appendf(nil, "journal/%d/", roomID)
+
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			if err := iter.Item().Value(func(val []byte) error {
+				var event GiftEvent
+				if err := json.Unmarshal(val, &event); err != nil {
+					return err
+				}
+				events = append(events, &event)
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	slices.SortStableFunc(events, func(a, b *GiftEvent) int {
+		return a.Timestamp.Compare(b.Timestamp)
+	})
+
+	return events, nil
+}
+
+func (b *badgerStore) CommitBatch(ctx context.Context, batch *Batch) error {
+	return b.b.Update(func(txn *badger.Txn) error {
+		for _, transfer := range batch.BoxStatistics {
+			bytes, err := json.Marshal(transfer.GetBoxStatistics())
+			if err != nil {
+				return fmt.Errorf("failed to marshal box statistics: %s", string(transfer.Key()))
+			}
+
+			if err := txn.Set(transfer.Key(), bytes); err != nil {
+				return fmt.Errorf("failed to set box statistics: %s", string(transfer.Key()))
+			}
+		}
+
+		if batch.Session != nil {
+			if err := setSessionBoxStatistics(txn, batch.Session, batch.SessionBoxStatistics); err != nil {
+				return err
+			}
+		}
+
+		for _, eventID := range batch.EventIDs {
+			if err := txn.Delete(journalKey(batch.RoomID, eventID)); err != nil {
+				return fmt.Errorf("failed to delete journaled gift event: %s", eventID)
+			}
+		}
+
+		for _, count := range batch.OutcomeCounts {
+			if err := addOutcomeCount(txn, count); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func outcomeKey(roomID int64, uid int64, boxID int64, giftID int64) []byte {
+	return fmt.Appendf(nil, "outcome/%d/%d/%d/%d", roomID, uid, boxID, giftID)
+}
+
+// Add count.Num to the stored count
+func addOutcomeCount(txn *badger.Txn, count *OutcomeCount) error {
+	key := outcomeKey(count.RoomID, count.UID, count.BoxID, count.GiftID)
+
+	var num int64
+	item, err := txn.Get(key)
+	if err != nil && !errors.Is(err, badger.ErrKeyNotFound) {
+		return err
+	}
+	if err == nil {
+		if err := item.Value(func(val []byte) error {
+			return json.Unmarshal(val, &num)
+		}); err != nil {
+			return fmt.Errorf("failed to unmarshal outcome count: %s", string(key))
+		}
+	}
+
+	bytes, err := json.Marshal(num + count.Num)
+	if err != nil {
+		return err
+	}
+	return txn.Set(key, bytes)
+}
+
+func (b *badgerStore) ListOutcomeCounts(ctx context.Context, roomID int64, uid int64) ([]*OutcomeCount, error) {
+	prefix := fmt.Appendf(nil, "outcome/%d/", roomID)
+	if uid != 0 {
+		prefix = fmt.Appendf(nil, "outcome/%d/%d/", roomID, uid)
+	}
+
+	var counts []*OutcomeCount
+	if err := b.b.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			item := iter.Item()
+
+			count := &OutcomeCount{}
+			if _, err := fmt.Sscanf(string(item.Key()), "outcome/%d/%d/%d/%d", &count.RoomID, &count.UID, &count.BoxID, &count.GiftID); err != nil {
+				return fmt.Errorf("malformed outcome count key: %s", string(item.Key()))
+			}
+			if err := item.Value(func(val []byte) error {
+				return json.Unmarshal(val, &count.Num)
+			}); err != nil {
+				return err
+			}
+			counts = append(counts, count)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return counts, nil
+}
+
+func (b *badgerStore) SetOutcomeCounts(ctx context.Context, counts []*OutcomeCount) error {
+	return b.b.Update(func(txn *badger.Txn) error {
+		for _, count := range counts {
+			bytes, err := json.Marshal(count.Num)
+			if err != nil {
+				return err
+			}
+			if err := txn.Set(outcomeKey(count.RoomID, count.UID, count.BoxID, count.GiftID), bytes); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *badgerStore) AddOutcomeCounts(ctx context.Context, counts []*OutcomeCount) error {
+	return b.b.Update(func(txn *badger.Txn) error {
+		for _, count := range counts {
+			if err := addOutcomeCount(txn, count); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func leaderboardKey(roomID int64, board string, period string, uid int64) []byte {
+	return fmt.Appendf(nil, "board/%d/%s/%s/%d", roomID, board, period, uid)
+}
+
+func leaderboardSeenKey(roomID int64, eventID string) []byte {
+	return fmt.Appendf(nil, "board_seen/%d/%s", roomID, eventID)
+}
+
+func (b *badgerStore) AddLeaderboardScores(ctx context.Context, eventID string, scores []*LeaderboardScore) (bool, error) {
+	if eventID == "" {
+		return false, errors.New("leaderboard event has no ID")
+	}
+	if len(scores) == 0 {
+		return true, nil
+	}
+
+	accepted := false
+	err := b.b.Update(func(txn *badger.Txn) error {
+		seen := leaderboardSeenKey(scores[0].RoomID, eventID)
+		_, err := txn.Get(seen)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, badger.ErrKeyNotFound) {
+			return err
+		}
+
+		if err := txn.SetEntry(badger.NewEntry(seen, nil).WithTTL(GIFT_EVENT_DEDUPE_WINDOW)); err != nil {
+			return fmt.Errorf("failed to set seen leaderboard event: %w", err)
+		}
+
+		// Scores sharing a key are added up first, so that each key is read and written once
+		var keys [][]byte
+		sums := make(map[string]int64, len(scores))
+		for _, score := range scores {
+			key := leaderboardKey(score.RoomID, score.Board, score.Period, score.UID)
+			if _, ok := sums[string(key)]; !ok {
+				keys = append(keys, key)
+			}
+			sums[string(key)] += score.Value
+		}
+
+		for _, key := range keys {
+			var value int64
+			item, err := txn.Get(key)
+			if err != nil && !errors.Is(err, badger.ErrKeyNotFound) {
+				return err
+			}
+			if err == nil {
+				if err := item.Value(func(val []byte) error {
+					return json.Unmarshal(val, &value)
+				}); err != nil {
+					return fmt.Errorf("failed to unmarshal leaderboard score: %s", string(key))
+				}
+			}
+
+			bytes, err := json.Marshal(value + sums[string(key)])
+			if err != nil {
+				return err
+			}
+			if err := txn.Set(key, bytes); err != nil {
+				return fmt.Errorf("failed to set leaderboard score: %w", err)
+			}
+		}
+
+		accepted = true
+		return nil
+	})
+
+	return accepted, err
+}
+
+func (b *badgerStore) ListLeaderboardScores(ctx context.Context, roomID int64, board string, period string) ([]*LeaderboardScore, error) {
+	prefix := fmt.Appendf(nil, "board/%d/%s/%s/", roomID, board, period)
+
+	var scores []*LeaderboardScore
+	if err := b.b.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			item := iter.Item()
+
+			score := &LeaderboardScore{RoomID: roomID, Board: board, Period: period}
+			uid, err := strconv.ParseInt(string(bytes.TrimPrefix(item.Key(), prefix)), 10, 64)
+			if err != nil {
+				// A board or period extending this one, e.g., day/2024-06-07/x
+				continue
+			}
+			score.UID = uid
+			if err := item.Value(func(val []byte) error {
+				return json.Unmarshal(val, &score.Value)
+			}); err != nil {
+				return fmt.Errorf("failed to unmarshal leaderboard score: %s", string(item.Key()))
+			}
+			scores = append(scores, score)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return scores, nil
+}
+
+func revenueKey(event *RevenueEvent, seq uint64) []byte {
+	return fmt.Appendf(nil, "revenue/%d/%020d/%020d", event.RoomID, event.Timestamp.UnixNano(), seq)
+}
+
+func revenueUserKey(event *RevenueEvent, seq uint64) []byte {
+	return fmt.Appendf(nil, "revenue_user/%d/%d/%020d/%020d", event.RoomID, event.UID, event.Timestamp.UnixNano(), seq)
+}
+
+func revenueSeenKey(roomID int64, eventID string) []byte {
+	return fmt.Appendf(nil, "revenue_seen/%d/%s", roomID, eventID)
+}
+
+func (b *badgerStore) AcceptRevenueEvent(ctx context.Context, event *RevenueEvent) (bool, error) {
+	if event.ID == "" {
+		return false, errors.New("revenue event has no ID")
+	}
+
+	accepted := false
+	err := b.b.Update(func(txn *badger.Txn) error {
+		_, err := txn.Get(revenueSeenKey(event.RoomID, event.ID))
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, badger.ErrKeyNotFound) {
+			return err
+		}
+
+		seq, err := b.nextEventSeq()
+		if err != nil {
+			return fmt.Errorf("failed to lease event sequence: %w", err)
+		}
+
+		bytes, err := json.Marshal(event)
+		if err != nil {
+			return fmt.Errorf("failed to marshal revenue event: %w", err)
+		}
+
+		if err := txn.SetEntry(badger.NewEntry(revenueSeenKey(event.RoomID, event.ID), nil).WithTTL(GIFT_EVENT_DEDUPE_WINDOW)); err != nil {
+			return fmt.Errorf("failed to set seen revenue event: %w", err)
+		}
+		if err := txn.Set(revenueKey(event, seq), bytes); err != nil {
+			return fmt.Errorf("failed to set revenue event: %w", err)
+		}
+		if err := txn.Set(revenueUserKey(event, seq), bytes); err != nil {
+			return fmt.Errorf("failed to set revenue event user index: %w", err)
+		}
+
+		accepted = true
+		return nil
+	})
+
+	return accepted, err
+}
+
+func (b *badgerStore) ListRevenueEventsByTime(ctx context.Context, roomID int64, start, end time.Time) ([]*RevenueEvent, error) {
+	return scanByTime[RevenueEvent](b.b, fmt.Appendf(nil, "revenue/%d/", roomID), start, end)
+}
+
+func (b *badgerStore) ListRevenueEventsByUser(ctx context.Context, roomID int64, uid int64, start, end time.Time) ([]*RevenueEvent, error) {
+	return scanByTime[RevenueEvent](b.b, fmt.Appendf(nil, "revenue_user/%d/%d/", roomID, uid), start, end)
+}
+
+func (b *badgerStore) ListGiftEventsByTime(ctx context.Context, roomID int64, start, end time.Time) ([]*GiftEvent, error) {
+	return scanByTime[GiftEvent](b.b, fmt.Appendf(nil, "event/%d/", roomID), start, end)
+}
+
+func (b *badgerStore) ListGiftEventsByUser(ctx context.Context, roomID int64, uid int64, start, end time.Time) ([]*GiftEvent, error) {
+	return scanByTime[GiftEvent](b.b, fmt.Appendf(nil, "event_user/%d/%d/", roomID, uid), start, end)
+}
+
+// Scan events under prefix with timestamps within [start, end). Keys under prefix start with the
+// zero padded timestamp of the event.
+func scanByTime[T any](db *badger.DB, prefix []byte, start, end time.Time) ([]*T, error) {
+	var events []*T
+
+	seekKey := prefix
+	if !start.IsZero() {
+		seekKey = fmt.Appendf(nil, "%s%020d", prefix, start.UnixNano())
+	}
+	var endKey []byte
+	if !end.IsZero() {
+		endKey = fmt.Appendf(nil, "%s%020d", prefix, end.UnixNano())
+	}
+
+	if err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+
+		for iter.Seek(seekKey); iter.Valid(); iter.Next() {
+			item := iter.Item()
+			if endKey != nil && bytes.Compare(item.Key(), endKey) >= 0 {
+				break
+			}
+
+			if err := item.Value(func(val []byte) error {
+				var event T
+				if err := json.Unmarshal(val, &event); err != nil {
+					return err
+				}
+				events = append(events, &event)
+				return nil
+			}); err != nil {
+				return fmt.Errorf("failed to unmarshal event: %s", string(item.Key()))
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// Session IDs are zero padded so that keys sort in time order
+func sessionKey(roomID int64, sessionID int64) []byte {
+	return fmt.Appendf(nil, "session/%d/%020d", roomID, sessionID)
+}
+
+func (b *badgerStore) GetLatestSession(ctx context.Context, roomID int64) (*Session, error) {
+	prefix := fmt.Appendf(nil, "session/%d/", roomID)
+
+	var session Session
+	if err := b.b.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		opts.Reverse = true
+
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+
+		// Seek to the largest key under the prefix
+		iter.Seek(append(prefix, 0xFF))
+		if !iter.Valid() {
+			return fmt.Errorf("%w: room %d has no session", ErrNotFound, roomID)
+		}
+
+		return iter.Item().Value(func(val []byte) error {
+			return json.Unmarshal(val, &session)
+		})
+	}); err != nil {
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+func (b *badgerStore) SetSession(ctx context.Context, session *Session) error {
+	return b.b.Update(func(txn *badger.Txn) error {
+		bytes, err := json.Marshal(session)
+		if err != nil {
+			return err
+		}
+		return txn.Set(sessionKey(session.RoomID, session.ID), bytes)
+	})
+}
+
+func (b *badgerStore) SetSessionBoxStatistics(ctx context.Context, session *Session, st map[int64]map[int64]*BoxStatistics) error {
+	return b.b.Update(func(txn *badger.Txn) error {
+		return setSessionBoxStatistics(txn, session, st)
+	})
+}
+
+func setSessionBoxStatistics(txn *badger.Txn, session *Session, st map[int64]map[int64]*BoxStatistics) error {
+	for uid, boxIDMap := range st {
+		for boxID, boxSt := range boxIDMap {
+			key := fmt.Appendf(nil, "session_stats/%d/%d/%d/%d", session.RoomID, session.ID, uid, boxID)
+
+			bytes, err := json.Marshal(boxSt)
+			if err != nil {
+				return fmt.Errorf("failed to marshal session box statistics: %s", string(key))
+			}
+			if err := txn.Set(key, bytes); err != nil {
+				return fmt.Errorf("failed to set session box statistics: %s", string(key))
+			}
+		}
+	}
+	return nil
+}
+
+func (b *badgerStore) ListSessionBoxStatistics(ctx context.Context, session *Session) (map[int64]map[int64]*BoxStatistics, error) {
+	prefix := fmt.Appendf(nil, "session_stats/%d/%d/", session.RoomID, session.ID)
+	result := make(map[int64]map[int64]*BoxStatistics)
+
+	if err := b.b.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			item := iter.Item()
+
+			// Trim session_stats/<roomID>/<sessionID>/ prefix, leaving <uid>/<boxID>
+			uidStr, boxIDStr, _ := strings.Cut(strings.TrimPrefix(string(item.Key()), string(prefix)), "/")
+			uid, err := strconv.ParseInt(uidStr, 10, 64)
+			if err != nil {
+				panic("Malformed user ID: " + uidStr)
+			}
+			boxID, err := strconv.ParseInt(boxIDStr, 10, 64)
+			if err != nil {
+				panic("Malformed box ID: " + boxIDStr)
+			}
+
+			var st BoxStatistics
+			if err := item.Value(func(val []byte) error {
+				return json.Unmarshal(val, &st)
+			}); err != nil {
+				return fmt.Errorf("failed to unmarshal session box statistics: %s", string(item.Key()))
+			}
+
+			if _, ok := result[uid]; !ok {
+				result[uid] = make(map[int64]*BoxStatistics)
+			}
+			result[uid][boxID] = &st
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
 type badgerLoggerAdapter struct{}
 
 func (l *badgerLoggerAdapter) Errorf(format string, v ...interface{}) {
@@ -0,0 +1,346 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Version of the bundle format written by ExportBundle.
+// Bump it on incompatible changes, ImportBundle rejects bundles from newer versions.
+//
+// Versions:
+// - 1: Users, rooms and box statistics
+// - 2: Outcome counts
+const BUNDLE_VERSION = 2
+
+// Box statistics are written in transactions of this size when importing,
+// to stay below badger's transaction size limit.
+const bundleImportBatchSize = 1000
+
+// A bundle is a portable dump of the store in JSON lines. The first line is the header,
+// followed by one record per line:
+//
+//	{"type":"header","version":1,"created_at":"..."}
+//	{"type":"user","user":{...}}
+//	{"type":"room","room":{...}}
+//	{"type":"box_statistics","room_id":1,"uid":2,"box_id":3,"box_statistics":{...}}
+//	{"type":"outcome_count","outcome_count":{...}}
+//
+// Gift events, revenue events and live sessions are not included.
+type bundleRecord struct {
+	Type string `json:"type"`
+
+	// Header
+	Version   int       `json:"version,omitempty"`
+	CreatedAt time.Time `json:"created_at,omitzero"`
+
+	User *User `json:"user,omitempty"`
+	Room *Room `json:"room,omitempty"`
+
+	RoomID        int64          `json:"room_id,omitempty"`
+	UID           int64          `json:"uid,omitempty"`
+	BoxID         int64          `json:"box_id,omitempty"`
+	BoxStatistics *BoxStatistics `json:"box_statistics,omitempty"`
+
+	OutcomeCount *OutcomeCount `json:"outcome_count,omitempty"`
+}
+
+const (
+	bundleRecordHeader        = "header"
+	bundleRecordUser          = "user"
+	bundleRecordRoom          = "room"
+	bundleRecordBoxStatistics = "box_statistics"
+	bundleRecordOutcomeCount  = "outcome_count"
+)
+
+// How imported records are combined with records already in the store
+type ImportMode int
+
+const (
+	// Add imported box statistics and outcome counts to the existing ones. Existing users and rooms are kept.
+	// NOTE: importing the same bundle twice counts its statistics twice.
+	ImportModeMerge ImportMode = iota
+	// Replace existing users, rooms, box statistics and outcome counts with the imported ones.
+	// Records not in the bundle are left untouched.
+	ImportModeOverwrite
+)
+
+// Number of records of each kind exported or imported
+type BundleSummary struct {
+	Users         int
+	Rooms         int
+	BoxStatistics int
+	OutcomeCounts int
+}
+
+// Write users, rooms, box statistics and outcome counts of the given rooms to w as a bundle.
+// If no room is given, all rooms are exported.
+func ExportBundle(ctx context.Context, s Store, w io.Writer, roomIDs []int64) (*BundleSummary, error) {
+	var summary BundleSummary
+
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(&bundleRecord{
+		Type:      bundleRecordHeader,
+		Version:   BUNDLE_VERSION,
+		CreatedAt: time.Now(),
+	}); err != nil {
+		return nil, err
+	}
+
+	userIDs, err := s.ListAllUserIDs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, uid := range userIDs {
+		user, err := s.GetUser(ctx, uid)
+		if err != nil {
+			return nil, err
+		}
+		if err := encoder.Encode(&bundleRecord{Type: bundleRecordUser, User: user}); err != nil {
+			return nil, err
+		}
+		summary.Users++
+	}
+
+	if len(roomIDs) == 0 {
+		roomIDs, err = s.ListAllRoomIDs(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, roomID := range roomIDs {
+		room, err := s.GetRoom(ctx, roomID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get room %d: %w", roomID, err)
+		}
+		if err := encoder.Encode(&bundleRecord{Type: bundleRecordRoom, Room: room}); err != nil {
+			return nil, err
+		}
+		summary.Rooms++
+
+		boxStatistics, err := s.ListAllBoxStatistics(ctx, roomID)
+		if err != nil {
+			return nil, err
+		}
+		for key, st := range boxStatistics {
+			roomID, uid, boxID, err := s.ParseBoxStatisticsKey([]byte(key))
+			if err != nil {
+				return nil, err
+			}
+			if err := encoder.Encode(&bundleRecord{
+				Type:          bundleRecordBoxStatistics,
+				RoomID:        roomID,
+				UID:           uid,
+				BoxID:         boxID,
+				BoxStatistics: st,
+			}); err != nil {
+				return nil, err
+			}
+			summary.BoxStatistics++
+		}
+
+		counts, err := s.ListOutcomeCounts(ctx, roomID, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, count := range counts {
+			if err := encoder.Encode(&bundleRecord{Type: bundleRecordOutcomeCount, OutcomeCount: count}); err != nil {
+				return nil, err
+			}
+			summary.OutcomeCounts++
+		}
+	}
+
+	return &summary, nil
+}
+
+// Load a bundle written by ExportBundle into the store.
+func ImportBundle(ctx context.Context, s Store, r io.Reader, mode ImportMode) (*BundleSummary, error) {
+	var summary BundleSummary
+
+	scanner := bufio.NewScanner(r)
+	// Rooms with many gifts make long lines
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+
+	var batch []*keyedBoxStatistics
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := importBoxStatistics(ctx, s, batch, mode); err != nil {
+			return err
+		}
+		summary.BoxStatistics += len(batch)
+		batch = nil
+		return nil
+	}
+
+	var counts []*OutcomeCount
+	flushCounts := func() error {
+		if len(counts) == 0 {
+			return nil
+		}
+		var err error
+		if mode == ImportModeMerge {
+			err = s.AddOutcomeCounts(ctx, counts)
+		} else {
+			err = s.SetOutcomeCounts(ctx, counts)
+		}
+		if err != nil {
+			return err
+		}
+		summary.OutcomeCounts += len(counts)
+		counts = nil
+		return nil
+	}
+
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+
+		var record bundleRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("malformed bundle line %d: %w", lineNo, err)
+		}
+
+		if lineNo == 1 {
+			if record.Type != bundleRecordHeader {
+				return nil, errors.New("malformed bundle: missing header")
+			}
+			if record.Version < 1 || record.Version > BUNDLE_VERSION {
+				return nil, fmt.Errorf("unsupported bundle version %d, supported up to %d", record.Version, BUNDLE_VERSION)
+			}
+			continue
+		}
+
+		switch record.Type {
+		case bundleRecordUser:
+			if record.User == nil {
+				return nil, fmt.Errorf("malformed bundle line %d: missing user", lineNo)
+			}
+			imported, err := importRecord(mode, func() error {
+				_, err := s.GetUser(ctx, record.User.MID)
+				return err
+			}, func() error {
+				return s.SetUser(ctx, record.User.MID, record.User)
+			})
+			if err != nil {
+				return nil, err
+			}
+			if imported {
+				summary.Users++
+			}
+		case bundleRecordRoom:
+			if record.Room == nil {
+				return nil, fmt.Errorf("malformed bundle line %d: missing room", lineNo)
+			}
+			imported, err := importRecord(mode, func() error {
+				_, err := s.GetRoom(ctx, record.Room.RoomID)
+				return err
+			}, func() error {
+				return s.SetRoom(ctx, record.Room.RoomID, record.Room)
+			})
+			if err != nil {
+				return nil, err
+			}
+			if imported {
+				summary.Rooms++
+			}
+		case bundleRecordBoxStatistics:
+			if record.BoxStatistics == nil {
+				return nil, fmt.Errorf("malformed bundle line %d: missing box statistics", lineNo)
+			}
+			batch = append(batch, &keyedBoxStatistics{
+				key: s.BoxStatisticsKey(record.RoomID, record.UID, record.BoxID),
+				st:  *record.BoxStatistics,
+			})
+			if len(batch) >= bundleImportBatchSize {
+				if err := flush(); err != nil {
+					return nil, err
+				}
+			}
+		case bundleRecordOutcomeCount:
+			if record.OutcomeCount == nil {
+				return nil, fmt.Errorf("malformed bundle line %d: missing outcome count", lineNo)
+			}
+			counts = append(counts, record.OutcomeCount)
+			if len(counts) >= bundleImportBatchSize {
+				if err := flushCounts(); err != nil {
+					return nil, err
+				}
+			}
+		default:
+			return nil, fmt.Errorf("malformed bundle line %d: unknown record type %q", lineNo, record.Type)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if lineNo == 0 {
+		return nil, errors.New("malformed bundle: empty")
+	}
+
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	if err := flushCounts(); err != nil {
+		return nil, err
+	}
+
+	return &summary, nil
+}
+
+// Import a user or room record. In merge mode, records already in the store are kept.
+func importRecord(mode ImportMode, get func() error, set func() error) (bool, error) {
+	if mode == ImportModeMerge {
+		err := get()
+		if err == nil {
+			return false, nil
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return false, err
+		}
+	}
+
+	if err := set(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func importBoxStatistics(ctx context.Context, s Store, batch []*keyedBoxStatistics, mode ImportMode) error {
+	transfers := make([]BoxStatisticsTransfer, 0, len(batch))
+	for _, imported := range batch {
+		transfers = append(transfers, imported)
+	}
+
+	if mode == ImportModeMerge {
+		existing := make([]*keyedBoxStatistics, 0, len(batch))
+		existingTransfers := make([]BoxStatisticsTransfer, 0, len(batch))
+		for _, imported := range batch {
+			e := &keyedBoxStatistics{key: imported.key}
+			existing = append(existing, e)
+			existingTransfers = append(existingTransfers, e)
+		}
+		if err := s.GetBoxStatistics(ctx, existingTransfers, NotFoundBehaviorSkip); err != nil {
+			return err
+		}
+
+		for i, imported := range batch {
+			merged := existing[i].st
+			merged.Merge(imported.st)
+			// Keep the most recent update time
+			if existing[i].st.LastUpdateTime.After(imported.st.LastUpdateTime) {
+				merged.LastUpdateTime = existing[i].st.LastUpdateTime
+			}
+			imported.st = merged
+		}
+	}
+
+	return s.SetBoxStatistics(ctx, transfers)
+}
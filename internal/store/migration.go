@@ -0,0 +1,348 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// Version of the badger key space written by this binary.
+//
+// Versions:
+// - 1: The original layout, box statistics under <roomID>/<uid>/<boxID>. Databases without a version key are at 1.
+// - 2: Box statistics moved under stats/<roomID>/<uid>/<boxID>
+// - 3: Outcome counts under outcome/<roomID>/<uid>/<boxID>/<giftID>, backfilled from the gift event log
+const SCHEMA_VERSION = 3
+
+var schemaVersionKey = []byte("meta/schema_version")
+
+// An upgrade step of the key space. Migrations must be idempotent, as a migration
+// interrupted half-way is run again from the start on the next open.
+type migration struct {
+	version     int    // Schema version after the migration
+	description string // What the migration does
+	// Apply the migration, or only count the keys it would change if dryRun is set.
+	// Returns the number of keys changed.
+	migrate func(db *badger.DB, dryRun bool) (int, error)
+}
+
+// Ordered by version
+var migrations = []migration{
+	{
+		version:     2,
+		description: "将盲盒统计从 <roomID>/<uid>/<boxID> 移动到 stats/<roomID>/<uid>/<boxID>",
+		migrate:     migrateStatsPrefix,
+	},
+	{
+		version:     3,
+		description: "从礼物事件日志回填每种盲盒爆出各个礼物的次数",
+		migrate:     migrateOutcomeCounts,
+	},
+}
+
+// Result of a single migration
+type MigrationResult struct {
+	Version     int
+	Description string
+	Keys        int // Number of keys changed, or to be changed in a dry run
+}
+
+// Bring the database at dbPath to SCHEMA_VERSION. In a dry run, the database is opened read-only
+// and the pending migrations are reported without changing anything.
+//
+// Opening the store with NewBadger migrates automatically, this is for running migrations explicitly.
+func Migrate(dbPath string, dryRun bool) ([]MigrationResult, error) {
+	opts := badger.DefaultOptions(dbPath)
+	opts.Logger = &badgerLoggerAdapter{}
+	opts.ReadOnly = dryRun
+
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	return migrate(db, dbPath, dryRun)
+}
+
+func migrate(db *badger.DB, dbPath string, dryRun bool) ([]MigrationResult, error) {
+	version, err := readSchemaVersion(db)
+	if err != nil {
+		return nil, err
+	}
+
+	if version == 0 {
+		// A fresh database, nothing to migrate
+		if dryRun {
+			return nil, nil
+		}
+		return nil, writeSchemaVersion(db, SCHEMA_VERSION)
+	}
+
+	if version > SCHEMA_VERSION {
+		return nil, fmt.Errorf("数据库版本 %d 高于程序支持的版本 %d, 请升级盒子怪", version, SCHEMA_VERSION)
+	}
+
+	var pending []migration
+	for _, m := range migrations {
+		if m.version > version {
+			pending = append(pending, m)
+		}
+	}
+	if len(pending) == 0 {
+		return nil, nil
+	}
+
+	if !dryRun {
+		backupPath, err := backup(db, dbPath, version)
+		if err != nil {
+			return nil, fmt.Errorf("迁移前无法备份数据库: %w", err)
+		}
+		log.Info().Str("backup", backupPath).Int("from", version).Int("to", SCHEMA_VERSION).Msg("升级数据库前已备份, 可用 badger restore 恢复")
+	}
+
+	var results []MigrationResult
+	for _, m := range pending {
+		keys, err := m.migrate(db, dryRun)
+		if err != nil {
+			return nil, fmt.Errorf("数据库迁移到版本 %d 失败: %w", m.version, err)
+		}
+
+		if !dryRun {
+			if err := writeSchemaVersion(db, m.version); err != nil {
+				return nil, err
+			}
+			log.Info().Int("version", m.version).Int("keys", keys).Msg(m.description)
+		}
+
+		results = append(results, MigrationResult{
+			Version:     m.version,
+			Description: m.description,
+			Keys:        keys,
+		})
+	}
+
+	return results, nil
+}
+
+// Fail unless the database is at SCHEMA_VERSION or fresh.
+func checkSchemaVersion(db *badger.DB) error {
+	version, err := readSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version != 0 && version != SCHEMA_VERSION {
+		return fmt.Errorf("数据库版本 %d 与程序支持的版本 %d 不一致, 请先运行 boxtroll migrate", version, SCHEMA_VERSION)
+	}
+	return nil
+}
+
+// Read the schema version. Returns 0 for an empty database, and 1 for a database
+// written before the version key was introduced.
+func readSchemaVersion(db *badger.DB) (int, error) {
+	var version int
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(schemaVersionKey)
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			opts := badger.DefaultIteratorOptions
+			opts.PrefetchValues = false
+			iter := txn.NewIterator(opts)
+			defer iter.Close()
+
+			iter.Rewind()
+			if iter.Valid() {
+				version = 1
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		return item.Value(func(val []byte) error {
+			version, err = strconv.Atoi(string(val))
+			if err != nil {
+				return fmt.Errorf("malformed schema version: %s", string(val))
+			}
+			return nil
+		})
+	})
+	return version, err
+}
+
+func writeSchemaVersion(db *badger.DB, version int) error {
+	return db.Update(func(txn *badger.Txn) error {
+		return txn.Set(schemaVersionKey, []byte(strconv.Itoa(version)))
+	})
+}
+
+// Back up the whole database next to it, e.g., db.v1-20250101T120000.bak
+func backup(db *badger.DB, dbPath string, version int) (string, error) {
+	backupPath := fmt.Sprintf("%s.v%d-%s.bak", filepath.Clean(dbPath), version, time.Now().Format("20060102T150405"))
+
+	f, err := os.OpenFile(backupPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := db.Backup(f, 0); err != nil {
+		f.Close()
+		return "", err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return "", err
+	}
+
+	return backupPath, f.Close()
+}
+
+// Legacy box statistics keys are the only keys made of three numbers
+func isLegacyBoxStatisticsKey(key []byte) bool {
+	parts := strings.Split(string(key), "/")
+	if len(parts) != 3 {
+		return false
+	}
+	for _, part := range parts {
+		if _, err := strconv.ParseInt(part, 10, 64); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func migrateStatsPrefix(db *badger.DB, dryRun bool) (int, error) {
+	type kv struct {
+		key   []byte
+		value []byte
+	}
+
+	var legacy []kv
+	if err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = !dryRun
+
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			item := iter.Item()
+			if !isLegacyBoxStatisticsKey(item.Key()) {
+				continue
+			}
+
+			entry := kv{key: item.KeyCopy(nil)}
+			if !dryRun {
+				value, err := item.ValueCopy(nil)
+				if err != nil {
+					return err
+				}
+				entry.value = value
+			}
+			legacy = append(legacy, entry)
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	if dryRun {
+		return len(legacy), nil
+	}
+
+	// Write batches split into multiple transactions by themselves. This is not atomic,
+	// but moving the same key twice is harmless.
+	batch := db.NewWriteBatch()
+	defer batch.Cancel()
+
+	for _, entry := range legacy {
+		if err := batch.Set(append([]byte("stats/"), entry.key...), entry.value); err != nil {
+			return 0, err
+		}
+		if err := batch.Delete(entry.key); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := batch.Flush(); err != nil {
+		return 0, err
+	}
+
+	return len(legacy), nil
+}
+
+// Recount the outcomes of every gift event logged. Journaled events are left out, as they are
+// counted when committed. Counts are overwritten, so running it twice is harmless.
+func migrateOutcomeCounts(db *badger.DB, dryRun bool) (int, error) {
+	counts := make(map[string]*OutcomeCount)
+	if err := db.View(func(txn *badger.Txn) error {
+		journaled := make(map[string]bool)
+
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte("journal/")
+		opts.PrefetchValues = false
+		iter := txn.NewIterator(opts)
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			journaled[strings.TrimPrefix(string(iter.Item().Key()), "journal/")] = true
+		}
+		iter.Close()
+
+		opts = badger.DefaultIteratorOptions
+		opts.Prefix = []byte("event/")
+		iter = txn.NewIterator(opts)
+		defer iter.Close()
+
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			var event GiftEvent
+			if err := iter.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &event)
+			}); err != nil {
+				return fmt.Errorf("malformed gift event %s: %w", string(iter.Item().Key()), err)
+			}
+			if event.ID != "" && journaled[fmt.Sprintf("%d/%s", event.RoomID, event.ID)] {
+				continue
+			}
+
+			key := string(outcomeKey(event.RoomID, event.UID, event.BoxID, event.GiftID))
+			if _, ok := counts[key]; !ok {
+				counts[key] = &OutcomeCount{RoomID: event.RoomID, UID: event.UID, BoxID: event.BoxID, GiftID: event.GiftID}
+			}
+			counts[key].Num += event.Num
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	if dryRun {
+		return len(counts), nil
+	}
+
+	batch := db.NewWriteBatch()
+	defer batch.Cancel()
+
+	for key, count := range counts {
+		value, err := json.Marshal(count.Num)
+		if err != nil {
+			return 0, err
+		}
+		if err := batch.Set([]byte(key), value); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := batch.Flush(); err != nil {
+		return 0, err
+	}
+
+	return len(counts), nil
+}
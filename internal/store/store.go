@@ -32,6 +32,8 @@ type Store interface {
 	GetUser(ctx context.Context, uid int64) (*User, error)
 	// Set user info by UID.
 	SetUser(ctx context.Context, uid int64, user *User) error
+	// List all room IDs in the store.
+	ListAllRoomIDs(ctx context.Context) ([]int64, error)
 	// Get room info by Room ID.
 	// If the given room is not found, return ErrNotFound.
 	GetRoom(ctx context.Context, roomID int64) (*Room, error)
@@ -39,6 +41,8 @@ type Store interface {
 	SetRoom(ctx context.Context, roomID int64, room *Room) error
 	// Return a key representation for the given roomID, uid, boxID.
 	BoxStatisticsKey(roomID int64, uid int64, boxID int64) []byte
+	// Parse a key returned by BoxStatisticsKey back into roomID, uid, boxID.
+	ParseBoxStatisticsKey(key []byte) (roomID int64, uid int64, boxID int64, err error)
 	// Batch get box statistics.
 	GetBoxStatistics(ctx context.Context, transfers []BoxStatisticsTransfer, notFoundBehavior NotFoundBehavior) error
 	// Set box statistics.
@@ -47,11 +51,60 @@ type Store interface {
 	ListAllBoxSenderUserIDs(ctx context.Context, roomID int64) ([]int64, error)
 	// Get all box statistics for the given room
 	ListAllBoxStatistics(ctx context.Context, roomID int64) (map[string]*BoxStatistics, error)
+	// Append gift events to the event log.
+	AppendGiftEvents(ctx context.Context, events []*GiftEvent) error
+	// Accept a gift event: append it to the event log and to the journal of events not yet committed
+	// to box statistics, unless an event with the same ID was accepted within GIFT_EVENT_DEDUPE_WINDOW.
+	// Returns false if the event is a duplicate.
+	AcceptGiftEvent(ctx context.Context, event *GiftEvent) (bool, error)
+	// List journaled gift events of the given room not yet committed, ordered by time.
+	ListJournal(ctx context.Context, roomID int64) ([]*GiftEvent, error)
+	// Atomically set box statistics and session box statistics of finished batches, add their
+	// outcome counts, and remove the merged events from the journal.
+	CommitBatch(ctx context.Context, batch *Batch) error
+	// List the outcome counts of the given room, only those of the given user if uid is not 0.
+	ListOutcomeCounts(ctx context.Context, roomID int64, uid int64) ([]*OutcomeCount, error)
+	// Set outcome counts, replacing the stored ones.
+	SetOutcomeCounts(ctx context.Context, counts []*OutcomeCount) error
+	// Add outcome counts to the stored ones.
+	AddOutcomeCounts(ctx context.Context, counts []*OutcomeCount) error
+	// Accept a revenue event: append it to the revenue log, unless an event with the same ID was
+	// accepted within GIFT_EVENT_DEDUPE_WINDOW. Returns false if the event is a duplicate.
+	AcceptRevenueEvent(ctx context.Context, event *RevenueEvent) (bool, error)
+	// List revenue events in the given room within [start, end), ordered by time.
+	// A zero start or end means the range is unbounded on that side.
+	ListRevenueEventsByTime(ctx context.Context, roomID int64, start, end time.Time) ([]*RevenueEvent, error)
+	// List revenue events of the given user in the given room within [start, end), ordered by time.
+	// A zero start or end means the range is unbounded on that side.
+	ListRevenueEventsByUser(ctx context.Context, roomID int64, uid int64, start, end time.Time) ([]*RevenueEvent, error)
+	// Add scores to leaderboards, unless scores of an event with the same ID were added within
+	// GIFT_EVENT_DEDUPE_WINDOW. Scores of the same board, period and user are added up.
+	// Returns false if the event is a duplicate.
+	AddLeaderboardScores(ctx context.Context, eventID string, scores []*LeaderboardScore) (bool, error)
+	// List the scores of every user on the given leaderboard of the given room within the given period.
+	ListLeaderboardScores(ctx context.Context, roomID int64, board string, period string) ([]*LeaderboardScore, error)
+	// List gift events in the given room within [start, end), ordered by time.
+	// A zero start or end means the range is unbounded on that side.
+	ListGiftEventsByTime(ctx context.Context, roomID int64, start, end time.Time) ([]*GiftEvent, error)
+	// List gift events of the given user in the given room within [start, end), ordered by time.
+	// A zero start or end means the range is unbounded on that side.
+	ListGiftEventsByUser(ctx context.Context, roomID int64, uid int64, start, end time.Time) ([]*GiftEvent, error)
+	// Get the most recent live session of the given room.
+	// If the room has no session, return ErrNotFound.
+	GetLatestSession(ctx context.Context, roomID int64) (*Session, error)
+	// Create or update a live session.
+	SetSession(ctx context.Context, session *Session) error
+	// Set box statistics of the given live session, uid -> boxID -> statistics.
+	// Entries not in the given map are left untouched.
+	SetSessionBoxStatistics(ctx context.Context, session *Session, st map[int64]map[int64]*BoxStatistics) error
+	// Get all box statistics of the given live session, uid -> boxID -> statistics.
+	ListSessionBoxStatistics(ctx context.Context, session *Session) (map[int64]map[int64]*BoxStatistics, error)
 }
 
 // Statistics for a single <roomID, uid, boxID>, meaning,
 // user UID's history of sending box boxID in room roomID.
-// NOTE: Do NOT add JSON struct tag to this struct for backward compabilitity
+// NOTE: Do NOT add JSON struct tag to this struct for backward compabilitity, changing
+// the encoding requires a migration (see migration.go)
 type BoxStatistics struct {
 	TotalNum           int64     // 盲盒总数量
 	TotalOriginalPrice int64     // 盲盒总原价
@@ -70,6 +123,162 @@ func (b *BoxStatistics) Merge(other BoxStatistics) {
 	b.LastUpdateTime = other.LastUpdateTime
 }
 
+// A single blind box result received in a live room. Gift events are append-only, and
+// BoxStatistics can always be recomputed from them.
+type GiftEvent struct {
+	ID            string    `json:"id,omitempty"`   // Identity of the gift message, empty for events recorded before it was introduced
+	Timestamp     time.Time `json:"timestamp"`      // Time the gift is sent
+	RoomID        int64     `json:"room_id"`        // Room ID
+	UID           int64     `json:"uid"`            // Sender UID
+	BoxID         int64     `json:"box_id"`         // Blind box gift ID
+	GiftID        int64     `json:"gift_id"`        // Outcome gift ID
+	Num           int64     `json:"num"`            // Number of boxes opened
+	Price         int64     `json:"price"`          // Price of a single outcome gift
+	OriginalPrice int64     `json:"original_price"` // Price of a single blind box
+}
+
+type RevenueKind string
+
+const (
+	// Guard purchase (大航海), i.e., 舰长, 提督 or 总督
+	RevenueKindGuard RevenueKind = "guard"
+	// Super Chat (醒目留言)
+	RevenueKindSuperChat RevenueKind = "super_chat"
+)
+
+// Label of the revenue kind shown to the streamer
+func (k RevenueKind) Label() string {
+	switch k {
+	case RevenueKindGuard:
+		return "大航海"
+	case RevenueKindSuperChat:
+		return "醒目留言"
+	default:
+		return string(k)
+	}
+}
+
+// A single paid event received in a live room other than a gift, e.g., a guard purchase or a
+// Super Chat. Revenue events are append-only.
+type RevenueEvent struct {
+	ID        string      `json:"id"`                   // Identity of the message, the same if the message is delivered more than once
+	Timestamp time.Time   `json:"timestamp"`            // Time the event happens, e.g., the purchase time
+	RoomID    int64       `json:"room_id"`              // Room ID
+	SessionID int64       `json:"session_id,omitempty"` // Live session the event is attributed to, 0 if none
+	UID       int64       `json:"uid"`                  // Sender UID
+	Kind      RevenueKind `json:"kind"`                 // Kind of the event
+	Name      string      `json:"name"`                 // What is bought, e.g., 舰长 or 醒目留言
+	Num       int64       `json:"num"`                  // Number of units, e.g., months of guard
+	Price     int64       `json:"price"`                // Price of a single unit, in the same unit as gift prices
+	Message   string      `json:"message,omitempty"`    // Content of the Super Chat
+}
+
+// Total price of the event
+func (e *RevenueEvent) TotalPrice() int64 {
+	return e.Price * e.Num
+}
+
+// Accepted gift events are remembered for this long to drop duplicates, e.g., messages delivered
+// again after a reconnect.
+const GIFT_EVENT_DEDUPE_WINDOW = 24 * time.Hour
+
+// Statistics contributed by this event
+func (e *GiftEvent) BoxStatistics() BoxStatistics {
+	return BoxStatistics{
+		TotalNum:           e.Num,
+		TotalOriginalPrice: e.OriginalPrice * e.Num,
+		TotalPrice:         e.Price * e.Num,
+		LastUpdateTime:     e.Timestamp,
+	}
+}
+
+// Recompute and overwrite the box statistics of every <roomID, uid, boxID> found in the event log
+// of the given room.
+//
+// NOTE: statistics accumulated before the event log was introduced are not in the log, so
+// rebuilding discards them.
+func RebuildBoxStatistics(ctx context.Context, s Store, roomID int64) error {
+	events, err := s.ListGiftEventsByTime(ctx, roomID, time.Time{}, time.Time{})
+	if err != nil {
+		return err
+	}
+
+	rebuilt := make(map[string]*keyedBoxStatistics)
+	for _, event := range events {
+		key := s.BoxStatisticsKey(event.RoomID, event.UID, event.BoxID)
+		if _, ok := rebuilt[string(key)]; !ok {
+			rebuilt[string(key)] = &keyedBoxStatistics{key: key}
+		}
+		rebuilt[string(key)].st.Merge(event.BoxStatistics())
+	}
+
+	var transfers []BoxStatisticsTransfer
+	for _, transfer := range rebuilt {
+		transfers = append(transfers, transfer)
+	}
+
+	return s.SetBoxStatistics(ctx, transfers)
+}
+
+// Finished batches committed atomically, see Store.CommitBatch
+type Batch struct {
+	RoomID        int64
+	BoxStatistics []BoxStatisticsTransfer
+	// Session the batches are attributed to, nil if none
+	Session              *Session
+	SessionBoxStatistics map[int64]map[int64]*BoxStatistics
+	// IDs of the journaled events merged into the batches
+	EventIDs []string
+	// Outcomes drawn in the batches, added to the stored counts
+	OutcomeCounts []*OutcomeCount
+}
+
+// Number of times a blind box yielded a specific outcome gift to a user in a room. Counts of
+// a room are the sum over its users.
+type OutcomeCount struct {
+	RoomID int64 `json:"room_id"`
+	UID    int64 `json:"uid"`
+	BoxID  int64 `json:"box_id"`
+	GiftID int64 `json:"gift_id"` // Outcome gift ID
+	Num    int64 `json:"num"`
+}
+
+// Score of a user on a leaderboard within a period, e.g., the number of 电影票 drawn in a live
+// session. Scores are keyed by room ID, board, period and UID.
+type LeaderboardScore struct {
+	RoomID int64  `json:"room_id"`
+	Board  string `json:"board"`  // Identity of the leaderboard, e.g., 电影票/count
+	Period string `json:"period"` // Period the score is accumulated in, e.g., session/1717745212, day/2024-06-07 or all
+	UID    int64  `json:"uid"`
+	Value  int64  `json:"value"`
+}
+
+// A BoxStatisticsTransfer holding its own statistics
+type keyedBoxStatistics struct {
+	key []byte
+	st  BoxStatistics
+}
+
+func (r *keyedBoxStatistics) Key() []byte {
+	return r.key
+}
+
+func (r *keyedBoxStatistics) GetBoxStatistics() *BoxStatistics {
+	return &r.st
+}
+
+// A single broadcast of a live room, from LIVE to PREPARING. Keyed by room ID and session ID.
+type Session struct {
+	RoomID    int64     `json:"room_id"`    // Room ID
+	ID        int64     `json:"id"`         // Unix seconds of the broadcast start, unique within a room
+	StartTime time.Time `json:"start_time"` // Broadcast start time
+	EndTime   time.Time `json:"end_time"`   // Broadcast end time, zero if the session is ongoing
+}
+
+func (s *Session) Ongoing() bool {
+	return s.EndTime.IsZero()
+}
+
 // Metadata for a single user. Keyed by UID.
 type User struct {
 	MID  int64  `json:"mid"`  // Use ID
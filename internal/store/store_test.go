@@ -1,11 +1,17 @@
 package store_test
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/YangchenYe323/boxtroll/internal/store"
+	"github.com/dgraph-io/badger/v4"
 )
 
 type testBoxStatisticsTransfer struct {
@@ -70,6 +76,17 @@ func TestBoxStatisticsOperations(t *testing.T) {
 		t.Fatalf("failed to batch transfer box statistics: %v", err)
 	}
 
+	roomID, uid, boxID, err := badgerStore.ParseBoxStatisticsKey(badgerStore.BoxStatisticsKey(1, 2, 3))
+	if err != nil {
+		t.Fatalf("failed to parse box statistics key: %v", err)
+	}
+	if roomID != 1 || uid != 2 || boxID != 3 {
+		t.Fatalf("expected key <1, 2, 3>, got <%d, %d, %d>", roomID, uid, boxID)
+	}
+	if _, _, _, err := badgerStore.ParseBoxStatisticsKey([]byte("user/1")); err == nil {
+		t.Fatalf("expected error parsing malformed key")
+	}
+
 	for i := range len(transfers) {
 		expected := transfers[i].(*testBoxStatisticsTransfer)
 		expectedSt := expected.GetBoxStatistics()
@@ -167,4 +184,599 @@ func TestRoomOperations(t *testing.T) {
 			t.Fatalf("expected gift name %s, got %s", expected.Name, actual.Name)
 		}
 	}
+
+	if err := badgerStore.SetRoom(context.Background(), 2, &store.Room{RoomID: 2}); err != nil {
+		t.Fatalf("failed to set room: %v", err)
+	}
+
+	roomIDs, err := badgerStore.ListAllRoomIDs(context.Background())
+	if err != nil {
+		t.Fatalf("failed to list room IDs: %v", err)
+	}
+	if len(roomIDs) != 2 || roomIDs[0] != 1 || roomIDs[1] != 2 {
+		t.Fatalf("expected room IDs [1 2], got %v", roomIDs)
+	}
+}
+
+func TestGiftEventOperations(t *testing.T) {
+	badgerStore, err := store.NewBadger(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create badger store: %v", err)
+	}
+	defer badgerStore.Close()
+
+	base := time.Date(2024, 6, 1, 20, 0, 0, 0, time.UTC)
+	events := []*store.GiftEvent{
+		{Timestamp: base, RoomID: 1, UID: 1, BoxID: 10, GiftID: 100, Num: 1, Price: 500, OriginalPrice: 1500},
+		{Timestamp: base.Add(time.Hour), RoomID: 1, UID: 2, BoxID: 10, GiftID: 101, Num: 2, Price: 2000, OriginalPrice: 1500},
+		// Same timestamp as the previous event
+		{Timestamp: base.Add(time.Hour), RoomID: 1, UID: 1, BoxID: 10, GiftID: 102, Num: 1, Price: 100, OriginalPrice: 1500},
+		{Timestamp: base.Add(2 * time.Hour), RoomID: 1, UID: 1, BoxID: 11, GiftID: 103, Num: 3, Price: 1000, OriginalPrice: 1000},
+		// Another room
+		{Timestamp: base.Add(time.Hour), RoomID: 2, UID: 1, BoxID: 10, GiftID: 100, Num: 1, Price: 500, OriginalPrice: 1500},
+	}
+
+	if err := badgerStore.AppendGiftEvents(context.Background(), events); err != nil {
+		t.Fatalf("failed to append gift events: %v", err)
+	}
+
+	all, err := badgerStore.ListGiftEventsByTime(context.Background(), 1, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("failed to list gift events: %v", err)
+	}
+	if len(all) != 4 {
+		t.Fatalf("expected 4 gift events, got %d", len(all))
+	}
+	for i := 1; i < len(all); i++ {
+		if all[i].Timestamp.Before(all[i-1].Timestamp) {
+			t.Fatalf("expected gift events ordered by time, got %v before %v", all[i-1].Timestamp, all[i].Timestamp)
+		}
+	}
+
+	ranged, err := badgerStore.ListGiftEventsByTime(context.Background(), 1, base.Add(time.Hour), base.Add(2*time.Hour))
+	if err != nil {
+		t.Fatalf("failed to list gift events: %v", err)
+	}
+	if len(ranged) != 2 {
+		t.Fatalf("expected 2 gift events, got %d", len(ranged))
+	}
+
+	byUser, err := badgerStore.ListGiftEventsByUser(context.Background(), 1, 1, base.Add(time.Minute), time.Time{})
+	if err != nil {
+		t.Fatalf("failed to list gift events by user: %v", err)
+	}
+	if len(byUser) != 2 {
+		t.Fatalf("expected 2 gift events, got %d", len(byUser))
+	}
+	for _, event := range byUser {
+		if event.UID != 1 || event.RoomID != 1 {
+			t.Fatalf("expected events of user 1 in room 1, got user %d in room %d", event.UID, event.RoomID)
+		}
+	}
+
+	if err := store.RebuildBoxStatistics(context.Background(), badgerStore, 1); err != nil {
+		t.Fatalf("failed to rebuild box statistics: %v", err)
+	}
+
+	rebuilt := &testBoxStatisticsTransfer{key: badgerStore.BoxStatisticsKey(1, 1, 10)}
+	if err := badgerStore.GetBoxStatistics(context.Background(), []store.BoxStatisticsTransfer{rebuilt}, store.NotFoundBehaviorError); err != nil {
+		t.Fatalf("failed to get rebuilt box statistics: %v", err)
+	}
+	if rebuilt.st.TotalNum != 2 {
+		t.Fatalf("expected total num %d, got %d", 2, rebuilt.st.TotalNum)
+	}
+	if rebuilt.st.TotalOriginalPrice != 3000 {
+		t.Fatalf("expected total original price %d, got %d", 3000, rebuilt.st.TotalOriginalPrice)
+	}
+	if rebuilt.st.TotalPrice != 600 {
+		t.Fatalf("expected total price %d, got %d", 600, rebuilt.st.TotalPrice)
+	}
+}
+
+func TestRevenueEventOperations(t *testing.T) {
+	badgerStore, err := store.NewBadger(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create badger store: %v", err)
+	}
+	defer badgerStore.Close()
+
+	ctx := context.Background()
+	base := time.Date(2024, 6, 1, 20, 0, 0, 0, time.UTC)
+	events := []*store.RevenueEvent{
+		{ID: "guard-1", Timestamp: base, RoomID: 1, SessionID: 7, UID: 1, Kind: store.RevenueKindGuard, Name: "舰长", Num: 2, Price: 198000},
+		{ID: "sc-1", Timestamp: base.Add(time.Hour), RoomID: 1, SessionID: 7, UID: 2, Kind: store.RevenueKindSuperChat, Name: "醒目留言", Num: 1, Price: 30000, Message: "加油"},
+		{ID: "sc-2", Timestamp: base.Add(2 * time.Hour), RoomID: 1, UID: 1, Kind: store.RevenueKindSuperChat, Name: "醒目留言", Num: 1, Price: 50000},
+		// Another room
+		{ID: "sc-1", Timestamp: base, RoomID: 2, UID: 1, Kind: store.RevenueKindSuperChat, Name: "醒目留言", Num: 1, Price: 30000},
+	}
+	for _, event := range events {
+		accepted, err := badgerStore.AcceptRevenueEvent(ctx, event)
+		if err != nil {
+			t.Fatalf("failed to accept revenue event: %v", err)
+		}
+		if !accepted {
+			t.Fatalf("expected revenue event %s in room %d accepted, got duplicate", event.ID, event.RoomID)
+		}
+	}
+
+	// Delivered again, e.g., after a reconnect
+	accepted, err := badgerStore.AcceptRevenueEvent(ctx, events[0])
+	if err != nil {
+		t.Fatalf("failed to accept revenue event: %v", err)
+	}
+	if accepted {
+		t.Fatalf("expected duplicate revenue event rejected, got accepted")
+	}
+	if _, err := badgerStore.AcceptRevenueEvent(ctx, &store.RevenueEvent{RoomID: 1}); err == nil {
+		t.Fatalf("expected error for revenue event without ID, got nil")
+	}
+
+	all, err := badgerStore.ListRevenueEventsByTime(ctx, 1, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("failed to list revenue events: %v", err)
+	}
+	if len(all) != 3 {
+		t.Fatalf("expected 3 revenue events, got %d", len(all))
+	}
+	if all[0].TotalPrice() != 396000 || all[1].Message != "加油" || all[1].SessionID != 7 {
+		t.Fatalf("expected revenue events round trip, got %+v and %+v", all[0], all[1])
+	}
+
+	ranged, err := badgerStore.ListRevenueEventsByTime(ctx, 1, base.Add(time.Minute), base.Add(2*time.Hour))
+	if err != nil {
+		t.Fatalf("failed to list revenue events: %v", err)
+	}
+	if len(ranged) != 1 || ranged[0].ID != "sc-1" {
+		t.Fatalf("expected only sc-1 within range, got %d events", len(ranged))
+	}
+
+	byUser, err := badgerStore.ListRevenueEventsByUser(ctx, 1, 1, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("failed to list revenue events by user: %v", err)
+	}
+	if len(byUser) != 2 || byUser[0].ID != "guard-1" || byUser[1].ID != "sc-2" {
+		t.Fatalf("expected guard-1 and sc-2 of user 1, got %d events", len(byUser))
+	}
+}
+
+func TestLeaderboardScores(t *testing.T) {
+	badgerStore, err := store.NewBadger(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create badger store: %v", err)
+	}
+	defer badgerStore.Close()
+
+	ctx := context.Background()
+	scores := func(uid int64, value int64) []*store.LeaderboardScore {
+		return []*store.LeaderboardScore{
+			{RoomID: 1, Board: "电影票/count", Period: "session/1", UID: uid, Value: value},
+			{RoomID: 1, Board: "电影票/count", Period: "all", UID: uid, Value: value},
+		}
+	}
+
+	for i, add := range []struct {
+		id    string
+		uid   int64
+		value int64
+	}{{"tid-1", 1, 2}, {"tid-2", 1, 3}, {"tid-3", 10, 1}} {
+		accepted, err := badgerStore.AddLeaderboardScores(ctx, add.id, scores(add.uid, add.value))
+		if err != nil {
+			t.Fatalf("failed to add leaderboard scores: %v", err)
+		}
+		if !accepted {
+			t.Fatalf("expected scores %d accepted, got duplicate", i)
+		}
+	}
+
+	// Delivered again, e.g., after a reconnect
+	accepted, err := badgerStore.AddLeaderboardScores(ctx, "tid-1", scores(1, 2))
+	if err != nil {
+		t.Fatalf("failed to add leaderboard scores: %v", err)
+	}
+	if accepted {
+		t.Fatalf("expected duplicate scores rejected, got accepted")
+	}
+
+	listed, err := badgerStore.ListLeaderboardScores(ctx, 1, "电影票/count", "session/1")
+	if err != nil {
+		t.Fatalf("failed to list leaderboard scores: %v", err)
+	}
+	values := make(map[int64]int64)
+	for _, score := range listed {
+		values[score.UID] = score.Value
+	}
+	if len(values) != 2 || values[1] != 5 || values[10] != 1 {
+		t.Fatalf("expected scores 5 and 1 of users 1 and 10, got %v", values)
+	}
+
+	// Periods are kept apart
+	listed, err = badgerStore.ListLeaderboardScores(ctx, 1, "电影票/count", "session/10")
+	if err != nil {
+		t.Fatalf("failed to list leaderboard scores: %v", err)
+	}
+	if len(listed) != 0 {
+		t.Fatalf("expected no scores in session 10, got %d", len(listed))
+	}
+
+	// Scores of the same key in one event are added up
+	same := append(scores(20, 2), scores(20, 3)...)
+	if _, err := badgerStore.AddLeaderboardScores(ctx, "tid-4", same); err != nil {
+		t.Fatalf("failed to add leaderboard scores: %v", err)
+	}
+	listed, err = badgerStore.ListLeaderboardScores(ctx, 1, "电影票/count", "all")
+	if err != nil {
+		t.Fatalf("failed to list leaderboard scores: %v", err)
+	}
+	values = make(map[int64]int64)
+	for _, score := range listed {
+		values[score.UID] = score.Value
+	}
+	if len(values) != 3 || values[20] != 5 {
+		t.Fatalf("expected score 5 of user 20, got %v", values)
+	}
+}
+
+func TestSessionOperations(t *testing.T) {
+	badgerStore, err := store.NewBadger(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create badger store: %v", err)
+	}
+	defer badgerStore.Close()
+
+	if _, err := badgerStore.GetLatestSession(context.Background(), 1); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	start := time.Date(2024, 6, 1, 20, 0, 0, 0, time.UTC)
+	sessions := []*store.Session{
+		{RoomID: 1, ID: start.Unix(), StartTime: start, EndTime: start.Add(time.Hour)},
+		{RoomID: 1, ID: start.Add(24 * time.Hour).Unix(), StartTime: start.Add(24 * time.Hour)},
+		{RoomID: 2, ID: start.Add(48 * time.Hour).Unix(), StartTime: start.Add(48 * time.Hour)},
+	}
+	for _, session := range sessions {
+		if err := badgerStore.SetSession(context.Background(), session); err != nil {
+			t.Fatalf("failed to set session: %v", err)
+		}
+	}
+
+	latest, err := badgerStore.GetLatestSession(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("failed to get latest session: %v", err)
+	}
+	if latest.ID != sessions[1].ID {
+		t.Fatalf("expected session %d, got %d", sessions[1].ID, latest.ID)
+	}
+	if !latest.Ongoing() {
+		t.Fatalf("expected session %d to be ongoing", latest.ID)
+	}
+
+	st := map[int64]map[int64]*store.BoxStatistics{
+		1: {10: {TotalNum: 1, TotalOriginalPrice: 1500, TotalPrice: 500}},
+		2: {10: {TotalNum: 2, TotalOriginalPrice: 3000, TotalPrice: 4000}, 11: {TotalNum: 1, TotalOriginalPrice: 1000, TotalPrice: 1000}},
+	}
+	if err := badgerStore.SetSessionBoxStatistics(context.Background(), latest, st); err != nil {
+		t.Fatalf("failed to set session box statistics: %v", err)
+	}
+
+	actual, err := badgerStore.ListSessionBoxStatistics(context.Background(), latest)
+	if err != nil {
+		t.Fatalf("failed to list session box statistics: %v", err)
+	}
+	for uid, boxIDMap := range st {
+		for boxID, expected := range boxIDMap {
+			actualSt, ok := actual[uid][boxID]
+			if !ok {
+				t.Fatalf("expected session box statistics of user %d box %d", uid, boxID)
+			}
+			if actualSt.TotalPrice != expected.TotalPrice {
+				t.Fatalf("expected total price %d, got %d", expected.TotalPrice, actualSt.TotalPrice)
+			}
+		}
+	}
+
+	other, err := badgerStore.ListSessionBoxStatistics(context.Background(), sessions[0])
+	if err != nil {
+		t.Fatalf("failed to list session box statistics: %v", err)
+	}
+	if len(other) != 0 {
+		t.Fatalf("expected no box statistics for session %d, got %d users", sessions[0].ID, len(other))
+	}
+}
+
+func TestBundleOperations(t *testing.T) {
+	ctx := context.Background()
+
+	source, err := store.NewBadger(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create badger store: %v", err)
+	}
+	defer source.Close()
+
+	if err := source.SetUser(ctx, 1, &store.User{MID: 1, Name: "test"}); err != nil {
+		t.Fatalf("failed to set user: %v", err)
+	}
+	if err := source.SetRoom(ctx, 1, &store.Room{RoomID: 1}); err != nil {
+		t.Fatalf("failed to set room: %v", err)
+	}
+	if err := source.SetBoxStatistics(ctx, []store.BoxStatisticsTransfer{
+		&testBoxStatisticsTransfer{
+			key: source.BoxStatisticsKey(1, 1, 1),
+			st:  store.BoxStatistics{TotalNum: 10, TotalOriginalPrice: 1000, TotalPrice: 800, LastUpdateTime: time.Now()},
+		},
+	}); err != nil {
+		t.Fatalf("failed to set box statistics: %v", err)
+	}
+	if err := source.SetOutcomeCounts(ctx, []*store.OutcomeCount{{RoomID: 1, UID: 1, BoxID: 1, GiftID: 2, Num: 10}}); err != nil {
+		t.Fatalf("failed to set outcome counts: %v", err)
+	}
+
+	var bundle bytes.Buffer
+	summary, err := store.ExportBundle(ctx, source, &bundle, nil)
+	if err != nil {
+		t.Fatalf("failed to export bundle: %v", err)
+	}
+	if summary.Users != 1 || summary.Rooms != 1 || summary.BoxStatistics != 1 || summary.OutcomeCounts != 1 {
+		t.Fatalf("expected to export 1 user, 1 room, 1 box statistics, 1 outcome count, got %+v", summary)
+	}
+
+	target, err := store.NewBadger(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create badger store: %v", err)
+	}
+	defer target.Close()
+
+	// Importing twice in merge mode adds the statistics up
+	for range 2 {
+		if _, err := store.ImportBundle(ctx, target, bytes.NewReader(bundle.Bytes()), store.ImportModeMerge); err != nil {
+			t.Fatalf("failed to import bundle: %v", err)
+		}
+	}
+
+	user, err := target.GetUser(ctx, 1)
+	if err != nil {
+		t.Fatalf("failed to get user: %v", err)
+	}
+	if user.Name != "test" {
+		t.Fatalf("expected user name test, got %s", user.Name)
+	}
+
+	st := &testBoxStatisticsTransfer{key: target.BoxStatisticsKey(1, 1, 1)}
+	if err := target.GetBoxStatistics(ctx, []store.BoxStatisticsTransfer{st}, store.NotFoundBehaviorError); err != nil {
+		t.Fatalf("failed to get box statistics: %v", err)
+	}
+	if st.st.TotalNum != 20 || st.st.TotalPrice != 1600 {
+		t.Fatalf("expected merged total num 20 and total price 1600, got %d and %d", st.st.TotalNum, st.st.TotalPrice)
+	}
+	counts, err := target.ListOutcomeCounts(ctx, 1, 0)
+	if err != nil {
+		t.Fatalf("failed to list outcome counts: %v", err)
+	}
+	if len(counts) != 1 || counts[0].Num != 20 {
+		t.Fatalf("expected merged outcome count 20, got %+v", counts)
+	}
+
+	if _, err := store.ImportBundle(ctx, target, bytes.NewReader(bundle.Bytes()), store.ImportModeOverwrite); err != nil {
+		t.Fatalf("failed to import bundle: %v", err)
+	}
+	if err := target.GetBoxStatistics(ctx, []store.BoxStatisticsTransfer{st}, store.NotFoundBehaviorError); err != nil {
+		t.Fatalf("failed to get box statistics: %v", err)
+	}
+	if st.st.TotalNum != 10 {
+		t.Fatalf("expected overwritten total num 10, got %d", st.st.TotalNum)
+	}
+	counts, err = target.ListOutcomeCounts(ctx, 1, 0)
+	if err != nil {
+		t.Fatalf("failed to list outcome counts: %v", err)
+	}
+	if len(counts) != 1 || counts[0].Num != 10 {
+		t.Fatalf("expected overwritten outcome count 10, got %+v", counts)
+	}
+
+	if _, err := store.ImportBundle(ctx, target, strings.NewReader(`{"type":"header","version":999}`), store.ImportModeMerge); err == nil {
+		t.Fatalf("expected error importing bundle of unsupported version")
+	}
+}
+
+func TestSchemaMigration(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "db")
+
+	// Write a database in the original layout
+	db, err := badger.Open(badger.DefaultOptions(dbPath).WithLogger(nil))
+	if err != nil {
+		t.Fatalf("failed to open badger: %v", err)
+	}
+	if err := db.Update(func(txn *badger.Txn) error {
+		if err := txn.Set([]byte("user/2"), []byte(`{"mid":2,"name":"test"}`)); err != nil {
+			return err
+		}
+		// Logged gift events, the journaled one is counted when committed
+		for i, event := range []string{
+			`{"id":"a","room_id":1,"uid":2,"box_id":3,"gift_id":4,"num":2}`,
+			`{"id":"b","room_id":1,"uid":2,"box_id":3,"gift_id":4,"num":1}`,
+			`{"id":"c","room_id":1,"uid":2,"box_id":3,"gift_id":4,"num":5}`,
+		} {
+			if err := txn.Set(fmt.Appendf(nil, "event/1/%020d/%020d", i, i), []byte(event)); err != nil {
+				return err
+			}
+		}
+		if err := txn.Set([]byte("journal/1/c"), []byte(`{"id":"c"}`)); err != nil {
+			return err
+		}
+		return txn.Set([]byte("1/2/3"), []byte(`{"TotalNum":10,"TotalOriginalPrice":1000,"TotalPrice":800}`))
+	}); err != nil {
+		t.Fatalf("failed to write legacy keys: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close badger: %v", err)
+	}
+
+	if _, err := store.NewBadger(dbPath, store.WithReadOnly()); err == nil {
+		t.Fatalf("expected error opening an outdated database read-only")
+	}
+
+	results, err := store.Migrate(dbPath, true)
+	if err != nil {
+		t.Fatalf("failed to dry run migrations: %v", err)
+	}
+	if len(results) != 2 || results[0].Version != 2 || results[0].Keys != 1 || results[1].Version != 3 || results[1].Keys != 1 {
+		t.Fatalf("expected pending migrations to version 2 and 3 changing 1 key each, got %+v", results)
+	}
+
+	badgerStore, err := store.NewBadger(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create badger store: %v", err)
+	}
+	defer badgerStore.Close()
+
+	boxStatistics, err := badgerStore.ListAllBoxStatistics(ctx, 1)
+	if err != nil {
+		t.Fatalf("failed to list box statistics: %v", err)
+	}
+	st, ok := boxStatistics[string(badgerStore.BoxStatisticsKey(1, 2, 3))]
+	if !ok {
+		t.Fatalf("expected migrated box statistics, got %v", boxStatistics)
+	}
+	if st.TotalNum != 10 {
+		t.Fatalf("expected total num 10, got %d", st.TotalNum)
+	}
+
+	counts, err := badgerStore.ListOutcomeCounts(ctx, 1, 0)
+	if err != nil {
+		t.Fatalf("failed to list outcome counts: %v", err)
+	}
+	if len(counts) != 1 || counts[0].GiftID != 4 || counts[0].Num != 3 {
+		t.Fatalf("expected 3 outcomes of gift 4 backfilled, got %+v", counts)
+	}
+
+	backups, err := filepath.Glob(dbPath + ".v1-*.bak")
+	if err != nil {
+		t.Fatalf("failed to glob backups: %v", err)
+	}
+	if len(backups) != 1 {
+		t.Fatalf("expected 1 backup, got %v", backups)
+	}
+}
+
+func TestGiftEventJournal(t *testing.T) {
+	ctx := context.Background()
+
+	badgerStore, err := store.NewBadger(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create badger store: %v", err)
+	}
+	defer badgerStore.Close()
+
+	event := &store.GiftEvent{
+		ID:            "1700000000120000001",
+		Timestamp:     time.Now(),
+		RoomID:        1,
+		UID:           2,
+		BoxID:         3,
+		GiftID:        4,
+		Num:           1,
+		Price:         500,
+		OriginalPrice: 1500,
+	}
+
+	for i, expected := range []bool{true, false} {
+		accepted, err := badgerStore.AcceptGiftEvent(ctx, event)
+		if err != nil {
+			t.Fatalf("failed to accept gift event: %v", err)
+		}
+		if accepted != expected {
+			t.Fatalf("expected accepted %v on attempt %d, got %v", expected, i, accepted)
+		}
+	}
+
+	journal, err := badgerStore.ListJournal(ctx, 1)
+	if err != nil {
+		t.Fatalf("failed to list journal: %v", err)
+	}
+	if len(journal) != 1 || journal[0].ID != event.ID {
+		t.Fatalf("expected journal with event %s, got %v", event.ID, journal)
+	}
+
+	events, err := badgerStore.ListGiftEventsByTime(ctx, 1, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("failed to list gift events: %v", err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("expected 1 gift event, got %d", len(events))
+	}
+
+	session := &store.Session{RoomID: 1, ID: 100, StartTime: time.Unix(100, 0)}
+	st := event.BoxStatistics()
+	if err := badgerStore.CommitBatch(ctx, &store.Batch{
+		RoomID: 1,
+		BoxStatistics: []store.BoxStatisticsTransfer{
+			&testBoxStatisticsTransfer{key: badgerStore.BoxStatisticsKey(1, 2, 3), st: st},
+		},
+		Session:              session,
+		SessionBoxStatistics: map[int64]map[int64]*store.BoxStatistics{2: {3: &st}},
+		EventIDs:             []string{event.ID},
+		OutcomeCounts:        []*store.OutcomeCount{{RoomID: 1, UID: 2, BoxID: 3, GiftID: 4, Num: 1}},
+	}); err != nil {
+		t.Fatalf("failed to commit batch: %v", err)
+	}
+	// Outcome counts of later batches add up
+	if err := badgerStore.CommitBatch(ctx, &store.Batch{
+		RoomID:        1,
+		OutcomeCounts: []*store.OutcomeCount{{RoomID: 1, UID: 2, BoxID: 3, GiftID: 4, Num: 2}, {RoomID: 1, UID: 5, BoxID: 3, GiftID: 6, Num: 1}},
+	}); err != nil {
+		t.Fatalf("failed to commit batch: %v", err)
+	}
+
+	counts, err := badgerStore.ListOutcomeCounts(ctx, 1, 2)
+	if err != nil {
+		t.Fatalf("failed to list outcome counts: %v", err)
+	}
+	if len(counts) != 1 || counts[0].GiftID != 4 || counts[0].Num != 3 {
+		t.Fatalf("expected 3 outcomes of gift 4 for user 2, got %+v", counts)
+	}
+	counts, err = badgerStore.ListOutcomeCounts(ctx, 1, 0)
+	if err != nil {
+		t.Fatalf("failed to list outcome counts: %v", err)
+	}
+	if len(counts) != 2 {
+		t.Fatalf("expected outcome counts of 2 users, got %+v", counts)
+	}
+
+	// Counts added outside a batch add up as well
+	if err := badgerStore.AddOutcomeCounts(ctx, []*store.OutcomeCount{{RoomID: 1, UID: 2, BoxID: 3, GiftID: 4, Num: 4}}); err != nil {
+		t.Fatalf("failed to add outcome counts: %v", err)
+	}
+	counts, err = badgerStore.ListOutcomeCounts(ctx, 1, 2)
+	if err != nil {
+		t.Fatalf("failed to list outcome counts: %v", err)
+	}
+	if len(counts) != 1 || counts[0].Num != 7 {
+		t.Fatalf("expected 7 outcomes of gift 4 for user 2, got %+v", counts)
+	}
+
+	journal, err = badgerStore.ListJournal(ctx, 1)
+	if err != nil {
+		t.Fatalf("failed to list journal: %v", err)
+	}
+	if len(journal) != 0 {
+		t.Fatalf("expected empty journal after commit, got %d events", len(journal))
+	}
+
+	sessionSt, err := badgerStore.ListSessionBoxStatistics(ctx, session)
+	if err != nil {
+		t.Fatalf("failed to list session box statistics: %v", err)
+	}
+	if sessionSt[2][3] == nil || sessionSt[2][3].TotalPrice != 500 {
+		t.Fatalf("expected committed session box statistics, got %v", sessionSt)
+	}
+
+	// Committed events are still deduplicated
+	accepted, err := badgerStore.AcceptGiftEvent(ctx, event)
+	if err != nil {
+		t.Fatalf("failed to accept gift event: %v", err)
+	}
+	if accepted {
+		t.Fatalf("expected committed event to be rejected as duplicate")
+	}
 }